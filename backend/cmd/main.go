@@ -2,21 +2,20 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"time"
 
 	"backend/internal/api"
 	"backend/internal/auth"
 	"backend/internal/config"
 	"backend/internal/database"
-	"backend/internal/fetcher"
-	"backend/internal/rules"
+	"backend/internal/jobs"
+	"backend/internal/schedule"
+	"backend/internal/worker"
 
 	"github.com/go-co-op/gocron"
 	"github.com/joho/godotenv"
 	"github.com/redis/go-redis/v9"
 	log "github.com/sirupsen/logrus"
-	"google.golang.org/api/option"
 )
 
 func main() {
@@ -44,14 +43,26 @@ func main() {
 	}
 	rdb := redis.NewClient(opt)
 
-	tokenStore := auth.NewTokenStore(rdb)
+	var keyring *auth.Keyring
+	if len(cfg.TokenKeys) > 0 {
+		if keyring, err = auth.NewKeyring(cfg.TokenKeys, cfg.TokenKeyID); err != nil {
+			log.Fatalf("token encryption key error: %v", err)
+		}
+	} else {
+		log.Warn("TOKEN_ENCRYPTION_KEYS is not set; OAuth tokens are stored unencrypted")
+	}
+	tokenStore := auth.NewTokenStore(rdb, keyring)
 
 	api.InitOAuthConfig(cfg)
+	migrateTokens(context.Background(), store, tokenStore)
 
 	// Start the background scheduler with the store interface
-	go startScheduler(store, tokenStore)
+	go startScheduler(cfg, store, tokenStore, schedule.NewSlotLock(rdb))
 
-	router := api.NewRouter(cfg, store, tokenStore)
+	// Sync, clean and bulk requests are queued and run here, outside the request
+	runner := jobs.NewRunner(store, cfg.JobConcurrency, cfg.JobTimeout)
+	router := api.NewRouter(cfg, store, tokenStore, auth.NewSessionStore(rdb, cfg.SessionTTL), runner)
+	runner.Run(context.Background())
 
 	log.Infof("MailCleaner starting on %s", cfg.HttpAddr)
 	if err := router.Run(cfg.HttpAddr); err != nil {
@@ -59,16 +70,31 @@ func main() {
 	}
 }
 
-// Track last execution to prevent duplicate runs in the same minute
-var lastExecutionKey = make(map[string]string)
-
 // NEW: Function to run the automated cleaning job
-func startScheduler(store api.DataStore, tokenStore *auth.TokenStore) {
+func startScheduler(cfg *config.Config, store api.DataStore, tokenStore *auth.TokenStore, lock *schedule.SlotLock) {
 	log.Info("Starting automated cleaning scheduler...")
+
+	// Due users are cleaned in parallel so one slow mailbox can't hold up
+	// the others or overrun the next tick
+	pool := worker.New(cfg.SchedulerConcurrency,
+		worker.WithQueueSize(cfg.SchedulerConcurrency*16),
+		worker.WithTimeout(cfg.SchedulerJobTimeout),
+		worker.WithResultHandler(func(r worker.Result) {
+			if r.Err != nil {
+				log.Errorf("Scheduler: failed to clean for user %s after %s: %v", r.JobID, r.Duration.Round(time.Second), r.Err)
+			} else {
+				log.Infof("Scheduler: Successfully completed cleaning for user %s in %s", r.JobID, r.Duration.Round(time.Second))
+			}
+		}),
+	)
+	pool.Run(context.Background())
+
 	s := gocron.NewScheduler(time.UTC)
 	_, err := s.Every(1).Minute().Do(func() {
 		log.Debug("Scheduler tick: checking for users to clean...")
 		ctx := context.Background()
+		sweepQuarantine(ctx, store, tokenStore, pool, 2*cfg.SchedulerJobTimeout)
+
 		userSettings, err := store.ListAutomatedUsers(ctx)
 		if err != nil {
 			log.Errorf("Scheduler error: could not list automated users: %v", err)
@@ -81,140 +107,147 @@ func startScheduler(store api.DataStore, tokenStore *auth.TokenStore) {
 		}
 
 		log.Debugf("Scheduler: Checking %d users with automation enabled", len(userSettings))
+		now := time.Now().UTC().Truncate(time.Minute) // the slot this tick covers
 		for _, settings := range userSettings {
-			now := time.Now().UTC()
-			loc, err := time.LoadLocation("Asia/Kolkata") // IST timezone
-			if err != nil {
-				log.Errorf("Scheduler: could not load IST location for user %s: %v", settings.UserID, err)
+			// Paused users are skipped; slots missed while paused are not made up
+			if settings.PausedUntil != nil && now.Before(*settings.PausedUntil) {
+				log.Debugf("Scheduler: automation paused for user %s until %s", settings.UserID, settings.PausedUntil.Format(time.RFC3339))
 				continue
 			}
-			
-			// Get current time in IST
-			nowIST := now.In(loc)
-			
-			userTime, err := time.ParseInLocation("15:04", settings.AutomationTime, loc)
+
+			loc, err := schedule.LoadLocation(settings.Timezone)
 			if err != nil {
-				log.Errorf("Scheduler: could not parse time for user %s: %v", settings.UserID, err)
-				continue
+				log.Errorf("Scheduler: invalid timezone for user %s, using %s: %v", settings.UserID, schedule.DefaultTimezone, err)
+				loc, _ = schedule.LoadLocation(schedule.DefaultTimezone)
 			}
 
-			// Check if it's the right time to run the job
-			shouldRun := false
-			executionKey := ""
-			
-			switch settings.AutomationFrequency {
-			case "daily":
-				if nowIST.Hour() == userTime.Hour() && nowIST.Minute() == userTime.Minute() {
-					executionKey = fmt.Sprintf("%s-daily-%s", settings.UserID, nowIST.Format("2006-01-02-15:04"))
-					shouldRun = true
-				}
-			case "weekly":
-				// Weekly runs on the same weekday, at the specified time
-				if nowIST.Hour() == userTime.Hour() && nowIST.Minute() == userTime.Minute() {
-					// Run once per week on this weekday
-					executionKey = fmt.Sprintf("%s-weekly-%s", settings.UserID, nowIST.Format("2006-W01-Mon-15:04"))
-					shouldRun = true
-				}
-			case "hourly":
-				if nowIST.Minute() == userTime.Minute() {
-					executionKey = fmt.Sprintf("%s-hourly-%s", settings.UserID, nowIST.Format("2006-01-02-15:04"))
-					shouldRun = true
-				}
+			// Check if it's the right time to run the job in the user's zone
+			cron, err := scheduleFor(settings)
+			if err != nil {
+				log.Errorf("Scheduler: could not check schedule for user %s: %v", settings.UserID, err)
+				continue
 			}
+			shouldRun := cron.Due(loc, now)
+			localNow := now.In(loc)
 
 			if shouldRun {
-				// Prevent duplicate execution in the same minute
-				if lastExecutionKey[settings.UserID] == executionKey {
+				// Exactly one replica runs each slot, once, even across restarts
+				if !claimSlot(ctx, store, lock, settings.UserID, now) {
 					log.Debugf("Scheduler: Already executed for user %s at this time", settings.UserID)
 					continue
 				}
-				
-				lastExecutionKey[settings.UserID] = executionKey
-				log.Infof("Scheduler: Triggering %s cleaning for user %s at %s IST", settings.AutomationFrequency, settings.UserID, nowIST.Format("15:04"))
-				
-				if err := executeCleanForUser(ctx, store, tokenStore, settings.UserID); err != nil {
-					log.Errorf("Scheduler: failed to clean for user %s: %v", settings.UserID, err)
-				} else {
-					log.Infof("Scheduler: Successfully completed cleaning for user %s", settings.UserID)
+				log.Infof("Scheduler: Triggering cleaning (%s) for user %s at %s", cron, settings.UserID, localNow.Format("15:04 MST"))
+
+				userID := settings.UserID
+				err := pool.Submit(worker.Job{
+					ID: userID,
+					Execute: func(ctx context.Context) error {
+						_, err := api.ExecuteCleanForUser(ctx, store, tokenStore, userID, database.TriggerScheduled, false)
+						return err
+					},
+				})
+				if err != nil {
+					// The run never started, so don't leave the slot marked as done
+					log.Errorf("Scheduler: skipped cleaning for user %s: %v", userID, err)
+					releaseSlot(ctx, store, lock, userID, now)
 				}
 			}
 		}
 	})
-	
+
 	if err != nil {
 		log.Errorf("Failed to schedule job: %v", err)
 		return
 	}
-	
+
 	s.StartAsync()
 	log.Info("Scheduler started successfully")
 }
 
-// NEW: Standalone cleaning logic for the scheduler
-func executeCleanForUser(ctx context.Context, store api.DataStore, tokenStore *auth.TokenStore, userEmail string) error {
-	// This logic is a simplified, non-HTTP version of executeClean from clean.go
-	dbRules, err := store.ListRules(ctx, userEmail)
+// sweepQuarantine trashes quarantined emails whose deadline has passed, one
+// pool job per user. This runs whether or not automation is still enabled.
+// Due emails are claimed for claim, which must cover waiting in the pool's
+// queue and running, so only one replica trashes each; emails left behind
+// by a failed or skipped job are swept again once the claim runs out.
+func sweepQuarantine(ctx context.Context, store api.DataStore, tokenStore *auth.TokenStore, pool *worker.Pool, claim time.Duration) {
+	due, err := store.ClaimDueQuarantine(ctx, time.Now(), claim)
 	if err != nil {
-		return fmt.Errorf("could not fetch rules: %w", err)
+		log.Errorf("Scheduler error: could not claim due quarantine: %v", err)
+		return
 	}
-	if len(dbRules) == 0 {
-		return nil // No rules, nothing to do
+	byUser := make(map[string][]database.QuarantinedEmail)
+	for _, q := range due {
+		byUser[q.UserID] = append(byUser[q.UserID], q)
 	}
+	for userID, emails := range byUser {
+		userID, emails := userID, emails
+		err := pool.Submit(worker.Job{
+			ID: "quarantine:" + userID,
+			Execute: func(ctx context.Context) error {
+				return api.TrashDueQuarantine(ctx, store, tokenStore, userID, emails)
+			},
+		})
+		if err != nil {
+			log.Errorf("Scheduler: skipped quarantine for user %s: %v", userID, err)
+		}
+	}
+}
 
-	dbEmails, err := store.ListAllEmailsForUser(ctx, userEmail)
+// migrateTokens moves tokens saved under a Gmail address, from before
+// mailboxes had IDs, to their mailbox. Users whose token can't be moved
+// just have to sign in again.
+func migrateTokens(ctx context.Context, store api.DataStore, tokenStore *auth.TokenStore) {
+	mailboxes, err := store.ListAllMailboxes(ctx)
 	if err != nil {
-		return fmt.Errorf("could not fetch emails: %w", err)
+		log.Errorf("could not list mailboxes to migrate tokens: %v", err)
+		return
 	}
-
-	tok, err := tokenStore.Get(ctx, userEmail)
-	if err != nil || tok == nil {
-		// Attempt to refresh token if it's nil but might be refreshable in a real scenario
-		return fmt.Errorf("could not get token for user: %w", err)
+	for _, m := range mailboxes {
+		if err := tokenStore.Move(ctx, m.Email, m.ID); err != nil {
+			log.Errorf("could not migrate token for mailbox %s: %v", m.Email, err)
+		}
 	}
+}
 
-	// The oauth2 library automatically handles token refreshes
-	tokenSource := api.OAuthConfig().TokenSource(ctx, tok)
-
-	gmailFetcher, err := fetcher.NewGmailFetcher(ctx, option.WithTokenSource(tokenSource))
+// claimSlot decides whether this replica runs a user's scheduled slot. The
+// Redis SET NX key settles races between replicas; the marker persisted in
+// user_settings survives Redis restarts and stops a restarted process from
+// repeating a slot it already ran. If Redis is unavailable the database
+// marker alone decides, which is still atomic.
+func claimSlot(ctx context.Context, store api.DataStore, lock *schedule.SlotLock, userID string, slot time.Time) bool {
+	won, err := lock.Claim(ctx, userID, slot)
 	if err != nil {
-		return fmt.Errorf("failed to create gmail service: %w", err)
-	}
-
-	var affectedEmailIDs []string
-	for _, dbEmail := range dbEmails {
-		for _, dbRule := range dbRules {
-			ruleEmail := rules.Email{Sender: dbEmail.Sender, Subject: dbEmail.Subject, Snippet: dbEmail.Snippet, Date: dbEmail.Date}
-			ruleRule := rules.Rule{Type: dbRule.Type, Value: dbRule.Value, Action: dbRule.Action, AgeDays: dbRule.AgeDays}
-
-			if rules.Match(ruleEmail, ruleRule) {
-				var actionErr error
-				switch ruleRule.Action {
-				case "DELETE":
-					actionErr = gmailFetcher.TrashMessage("me", dbEmail.ID)
-				case "ARCHIVE":
-					actionErr = gmailFetcher.ArchiveMessage("me", dbEmail.ID)
-				case "MARK_READ":
-					actionErr = gmailFetcher.MarkRead("me", dbEmail.ID)
-				}
+		log.Warnf("Scheduler: redis slot lock unavailable for user %s, relying on database marker: %v", userID, err)
+	} else if !won {
+		return false
+	}
+	claimed, err := store.ClaimScheduledRun(ctx, userID, slot)
+	if err != nil {
+		log.Errorf("Scheduler: could not record run for user %s: %v", userID, err)
+		return false
+	}
+	return claimed
+}
 
-				if actionErr != nil {
-					log.Errorf("Scheduler: action %s failed for email %s: %v", ruleRule.Action, dbEmail.ID, actionErr)
-					// Don't stop for one failed action, just continue
-				} else {
-					// Only delete from local DB if API call was successful
-					_ = store.DeleteEmail(context.Background(), dbEmail.ID)
-					affectedEmailIDs = append(affectedEmailIDs, dbEmail.ID)
-				}
-				break // Move to the next email once one rule matches
-			}
-		}
+// releaseSlot undoes claimSlot for a run that could not be queued
+func releaseSlot(ctx context.Context, store api.DataStore, lock *schedule.SlotLock, userID string, slot time.Time) {
+	if err := store.ReleaseScheduledRun(ctx, userID, slot); err != nil {
+		log.Errorf("Scheduler: could not release run for user %s: %v", userID, err)
 	}
+	if err := lock.Release(ctx, userID, slot); err != nil {
+		log.Warnf("Scheduler: could not release redis slot lock for user %s: %v", userID, err)
+	}
+}
 
-	if len(affectedEmailIDs) > 0 {
-		if _, err := store.CreateCleaningHistory(ctx, userEmail, affectedEmailIDs); err != nil {
-			log.Errorf("Scheduler: failed to log cleaning history for user %s: %v", userEmail, err)
+// scheduleFor returns a user's cron schedule, deriving it from the frequency
+// settings for rows saved before cron schedules existed.
+func scheduleFor(settings database.UserSettings) (*schedule.Cron, error) {
+	expr := settings.AutomationCron
+	if expr == "" {
+		var err error
+		if expr, err = schedule.FromFrequency(settings.AutomationFrequency, settings.AutomationTime, settings.AutomationDayOfWeek); err != nil {
+			return nil, err
 		}
-		log.Infof("Scheduler: successfully cleaned %d emails for user %s", len(affectedEmailIDs), userEmail)
 	}
-	return nil
+	return schedule.ParseCron(expr)
 }
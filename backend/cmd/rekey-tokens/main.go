@@ -0,0 +1,47 @@
+// Command rekey-tokens re-encrypts every stored OAuth token with the active
+// key in TOKEN_ENCRYPTION_KEY_ID and encrypts tokens stored before
+// encryption was enabled. Run it after rotating keys and before removing the
+// old key from TOKEN_ENCRYPTION_KEYS.
+package main
+
+import (
+	"context"
+
+	"backend/internal/auth"
+	"backend/internal/config"
+
+	"github.com/joho/godotenv"
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	if err := godotenv.Load(".env"); err != nil {
+		log.Println("Warning: No .env file found, reading from environment")
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("config error: %v", err)
+	}
+	if len(cfg.TokenKeys) == 0 {
+		log.Fatal("TOKEN_ENCRYPTION_KEYS is not set; nothing to encrypt with")
+	}
+	keyring, err := auth.NewKeyring(cfg.TokenKeys, cfg.TokenKeyID)
+	if err != nil {
+		log.Fatalf("token encryption key error: %v", err)
+	}
+
+	opt, err := redis.ParseURL(cfg.RedisURL)
+	if err != nil {
+		log.Fatalf("could not parse redis url: %v", err)
+	}
+	rdb := redis.NewClient(opt)
+	defer rdb.Close()
+
+	n, err := auth.NewTokenStore(rdb, keyring).ReEncrypt(context.Background())
+	if err != nil {
+		log.Fatalf("re-encrypted %d tokens before failing: %v", n, err)
+	}
+	log.Infof("Re-encrypted %d tokens with key %q", n, cfg.TokenKeyID)
+}
@@ -9,7 +9,7 @@ import (
 )
 
 func (s *Server) GetSenderAnalyticsHandler(c *gin.Context) {
-	userEmail := getUserEmail(c)
+	userEmail := getMailboxID(c)
 	analytics, err := s.store.GetTopSenders(c.Request.Context(), userEmail)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch analytics"})
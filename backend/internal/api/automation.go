@@ -0,0 +1,187 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"backend/internal/auth"
+	"backend/internal/cleaner"
+	"backend/internal/database"
+	"backend/internal/jobs"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// ListAutomationRunsHandler lists the user's recent manual and scheduled runs.
+func (s *Server) ListAutomationRunsHandler(c *gin.Context) {
+	userEmail := getMailboxID(c)
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		limit = 50
+	}
+	runs, err := s.store.ListAutomationRuns(c.Request.Context(), userEmail, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch automation runs"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"runs": runs})
+}
+
+// GetAutomationRunHandler returns one run with its per-email outcomes.
+func (s *Server) GetAutomationRunHandler(c *gin.Context) {
+	userEmail := getMailboxID(c)
+	run, err := s.store.GetAutomationRun(c.Request.Context(), c.Param("id"), userEmail)
+	if err != nil {
+		if err.Error() == "automation run not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch automation run"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"run": run})
+}
+
+// ExecuteCleanForUser runs the user's rules the way the scheduler does and
+// records the run in automation_runs, including runs that fail part way. A
+// dry run only plans the actions; its run is returned but not stored. The
+// user's safety limits and quarantine setting apply.
+func ExecuteCleanForUser(ctx context.Context, store DataStore, tokenStore *auth.TokenStore, userEmail, trigger string, dryRun bool) (*database.AutomationRun, error) {
+	opts, err := safetyOptions(ctx, store, userEmail, cleaner.Options{DryRun: dryRun})
+	if err != nil {
+		return nil, fmt.Errorf("could not load safety settings: %w", err)
+	}
+	run, _, err := runCleaner(ctx, store, tokenStore, userEmail, trigger, opts)
+	return run, err
+}
+
+// safetyOptions caps an unattended clean at the user's per-run and
+// share-of-mailbox limits, whichever is lower, and holds its deletes in
+// quarantine when the user asked for that. The mailbox size is the number of
+// synced emails.
+func safetyOptions(ctx context.Context, store DataStore, userEmail string, opts cleaner.Options) (cleaner.Options, error) {
+	settings, err := store.GetUserSettings(ctx, userEmail)
+	if err != nil {
+		return opts, err
+	}
+	limit := settings.MaxEmailsPerRun
+	if settings.MaxMailboxPercent > 0 {
+		total, err := store.CountEmails(ctx, userEmail)
+		if err != nil {
+			return opts, err
+		}
+		byShare := total * settings.MaxMailboxPercent / 100
+		if byShare < 1 {
+			byShare = 1
+		}
+		if limit == 0 || byShare < limit {
+			limit = byShare
+		}
+	}
+	opts.MaxActions = limit
+	if settings.QuarantineEnabled {
+		opts.QuarantineUntil = time.Now().AddDate(0, 0, settings.QuarantineDays)
+	}
+	opts.SkipQuarantined = true
+	return opts, nil
+}
+
+// runCleaner runs a clean with the given options and records it as an
+// automation run. Dry runs are not stored and need no Gmail access.
+func runCleaner(ctx context.Context, store DataStore, tokenStore *auth.TokenStore, userEmail, trigger string, opts cleaner.Options) (*database.AutomationRun, *cleaner.Report, error) {
+	if opts.DryRun {
+		run := &database.AutomationRun{UserID: userEmail, Trigger: trigger, Status: database.RunSucceeded, StartedAt: time.Now()}
+		report, err := cleaner.New(store, nil, opts).Run(ctx, userEmail, run)
+		if err != nil {
+			run.Fail(err)
+		}
+		return run, report, err
+	}
+
+	run, err := store.CreateAutomationRun(ctx, userEmail, trigger)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not record automation run: %w", err)
+	}
+	// Record the outcome even when the job ran out of time
+	defer func() {
+		if ferr := store.FinishAutomationRun(context.WithoutCancel(ctx), run); ferr != nil {
+			log.Errorf("Failed to record automation run for user %s: %v", userEmail, ferr)
+		}
+	}()
+
+	svc, err := NewEmailService(ctx, tokenStore, userEmail)
+	if err != nil {
+		err = fmt.Errorf("could not get token for user: %w", err)
+		run.Fail(err)
+		return run, nil, err
+	}
+	report, err := cleaner.New(store, svc, opts).Run(ctx, userEmail, run)
+	if err != nil {
+		run.Fail(err)
+	}
+	return run, report, err
+}
+
+// RunAutomationHandler queues the user's automated clean right away, outside
+// the schedule. With ?dry_run=true the job only reports what it would do.
+func (s *Server) RunAutomationHandler(c *gin.Context) {
+	dryRun, _ := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+	s.enqueueJob(c, database.JobAutomation, automationPayload{DryRun: dryRun})
+}
+
+// automationPayload is the payload of an on-demand automation job.
+type automationPayload struct {
+	DryRun bool `json:"dry_run"`
+}
+
+// runAutomationJob performs a queued on-demand automation run.
+func (s *Server) runAutomationJob(ctx context.Context, job database.Job) (interface{}, error) {
+	var payload automationPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return nil, jobs.Permanent(err)
+	}
+	run, err := ExecuteCleanForUser(ctx, s.store, s.tokenStore, job.UserID, database.TriggerManual, payload.DryRun)
+	if run == nil {
+		return nil, err
+	}
+	if !payload.DryRun {
+		// A partly applied run is not repeated; its outcome is in the run
+		err = jobs.Permanent(err)
+	}
+	return gin.H{"dry_run": payload.DryRun, "run": run}, err
+}
+
+// PauseAutomationHandler makes the scheduler skip the user until the time
+// given in ?until= (RFC 3339).
+func (s *Server) PauseAutomationHandler(c *gin.Context) {
+	until, err := time.Parse(time.RFC3339, c.Query("until"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "until must be an RFC 3339 timestamp, e.g. 2025-01-31T09:00:00Z"})
+		return
+	}
+	if !until.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "until must be in the future"})
+		return
+	}
+	settings, err := s.store.SetAutomationPause(c.Request.Context(), getMailboxID(c), &until)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to pause automation"})
+		return
+	}
+	c.JSON(http.StatusOK, settings)
+}
+
+// ResumeAutomationHandler clears a pause so the next scheduled run happens.
+func (s *Server) ResumeAutomationHandler(c *gin.Context) {
+	settings, err := s.store.SetAutomationPause(c.Request.Context(), getMailboxID(c), nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resume automation"})
+		return
+	}
+	c.JSON(http.StatusOK, settings)
+}
@@ -1,171 +1,165 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 
-	"backend/internal/fetcher"
-	"backend/internal/rules"
+	"backend/internal/cleaner"
+	"backend/internal/database"
+	"backend/internal/jobs"
 
 	"github.com/gin-gonic/gin"
-	"golang.org/x/oauth2"
-	"google.golang.org/api/option"
+	log "github.com/sirupsen/logrus"
 )
 
+// cleanRequest is the optional body of the clean endpoints and the payload
+// of clean jobs.
+type cleanRequest struct {
+	IDs             []string `json:"ids"` // only clean these matched emails
+	PermanentDelete bool     `json:"permanentDelete"`
+}
+
 // CleanPreviewHandler performs a dry run of the cleaning process.
 func (s *Server) CleanPreviewHandler(c *gin.Context) {
-	s.executeClean(c, true)
+	var request cleanRequest
+	_ = c.ShouldBindJSON(&request) // the body is optional
+	result, err := s.executeClean(c.Request.Context(), getMailboxID(c), request, true)
+	if err != nil {
+		log.Errorf("Failed to preview clean: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not evaluate rules"})
+		return
+	}
+	c.JSON(http.StatusOK, result)
 }
 
-// CleanHandler performs the actual cleaning of emails.
+// CleanHandler queues the actual cleaning of emails; poll the returned job
+// for the outcome.
 func (s *Server) CleanHandler(c *gin.Context) {
-	s.executeClean(c, false)
+	var request cleanRequest
+	_ = c.ShouldBindJSON(&request)
+	s.enqueueJob(c, database.JobClean, request)
 }
 
-// executeClean contains the shared logic for both preview and actual cleaning.
-func (s *Server) executeClean(c *gin.Context, dryRun bool) {
-	userEmail := getUserEmail(c)
-	ctx := c.Request.Context()
+// executeClean contains the shared logic for both preview and actual
+// cleaning. The actual clean runs as a background job and is recorded as a
+// manual automation run.
+func (s *Server) executeClean(ctx context.Context, userEmail string, request cleanRequest, dryRun bool) (gin.H, error) {
+	opts := cleaner.Options{DryRun: dryRun, IDs: request.IDs, PermanentDelete: request.PermanentDelete}
+	run, report, err := runCleaner(ctx, s.store, s.tokenStore, userEmail, database.TriggerManual, opts)
+	if report == nil {
+		return nil, err
+	}
 
-	// 1. Fetch user's rules from the database.
-	dbRules, err := s.store.ListRules(ctx, userEmail)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not fetch rules"})
-		return
+	var msg string
+	switch {
+	case report.RulesEvaluated == 0 && dryRun:
+		msg = "No rules defined. Nothing to preview."
+	case report.RulesEvaluated == 0:
+		msg = "No rules defined. Nothing to clean."
+	case report.Matched == 0:
+		msg = "No emails matched your rules."
+	case len(report.Entries) == 0:
+		msg = "No emails selected."
+	case dryRun:
+		msg = "Preview generated successfully."
+	default:
+		msg = "Cleaning complete"
 	}
-	if len(dbRules) == 0 {
-		msg := "No rules defined. Nothing to clean."
-		if dryRun {
-			msg = "No rules defined. Nothing to preview."
-		}
-		c.JSON(http.StatusOK, gin.H{"message": msg, "affected": []gin.H{}})
-		return
+	result := gin.H{"message": msg, "affected": report.Entries}
+	if report.Entries == nil {
+		result["affected"] = []cleaner.Entry{}
+	}
+	if !dryRun {
+		result["affected_count"] = len(report.AppliedIDs)
+		result["affected_ids"] = report.AppliedIDs
+		result["protected_ids"] = report.ProtectedIDs
+		result["failed_ids"] = report.FailedIDs
+		result["run_id"] = run.ID
 	}
+	return result, err
+}
 
-	// 2. Fetch all user's emails from the database.
-	dbEmails, err := s.store.ListAllEmailsForUser(ctx, userEmail)
+// GetCleanHistoryHandler fetches the cleaning history from the database.
+func (s *Server) GetCleanHistoryHandler(c *gin.Context) {
+	userEmail := getMailboxID(c)
+	history, err := s.store.ListCleaningHistory(c.Request.Context(), userEmail)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not fetch emails"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch cleaning history"})
 		return
 	}
+	c.JSON(http.StatusOK, gin.H{"history": history})
+}
 
-    // 3. Apply rules and determine which emails to delete/archive.
-	var affectedEmails []gin.H
-	for _, dbEmail := range dbEmails {
-		for _, dbRule := range dbRules {
-			// Convert database types to our domain types for the rule engine.
-			ruleEmail := rules.Email{Sender: dbEmail.Sender, Subject: dbEmail.Subject, Snippet: dbEmail.Snippet, Date: dbEmail.Date}
-			ruleRule := rules.Rule{Type: dbRule.Type, Value: dbRule.Value, Action: dbRule.Action, AgeDays: dbRule.AgeDays}
+// undoPayload is the payload of an undo job.
+type undoPayload struct {
+	HistoryID string `json:"history_id"`
+}
 
-			if rules.Match(ruleEmail, ruleRule) {
-				affectedEmails = append(affectedEmails, gin.H{
-					"id":      dbEmail.ID,
-					"sender":  dbEmail.Sender,
-					"subject": dbEmail.Subject,
-					"date":    dbEmail.Date,
-					"action":  dbRule.Action, // Include the action in the preview
-				})
-				break // Move to the next email once one rule matches
-			}
+// UndoCleanHandler queues undoing a clean from the cleaning history; poll
+// the returned job for the emails that were restored and those that could
+// not be because they were already purged. A clean some emails failed to
+// restore for can be undone again.
+func (s *Server) UndoCleanHandler(c *gin.Context) {
+	history, err := s.store.GetCleaningHistory(c.Request.Context(), c.Param("id"), getMailboxID(c))
+	if err != nil {
+		if err.Error() == "cleaning history not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch cleaning history"})
 		}
-	}
-
-    if len(affectedEmails) == 0 {
-		c.JSON(http.StatusOK, gin.H{"message": "No emails matched your rules.", "affected": []gin.H{}})
 		return
 	}
-
-    // 4a. If client provided an allowlist of IDs, filter to those only.
-    var request struct {
-        IDs              []string `json:"ids"`
-        PermanentDelete  bool     `json:"permanentDelete"`
-    }
-    if err := c.ShouldBindJSON(&request); err == nil && len(request.IDs) > 0 {
-        allowed := make(map[string]struct{}, len(request.IDs))
-        for _, id := range request.IDs {
-            allowed[id] = struct{}{}
-        }
-        filtered := make([]gin.H, 0, len(request.IDs))
-        for _, e := range affectedEmails {
-            if _, ok := allowed[e["id"].(string)]; ok {
-                filtered = append(filtered, e)
-            }
-        }
-        affectedEmails = filtered
-    }
-
-    if len(affectedEmails) == 0 {
-        c.JSON(http.StatusOK, gin.H{"message": "No emails selected.", "affected": []gin.H{}})
-        return
-    }
-
-    // 4b. If this is a dry run, return the list of emails that would be affected.
-	if dryRun {
-		c.JSON(http.StatusOK, gin.H{
-			"message":  "Preview generated successfully.",
-			"affected": affectedEmails,
-		})
+	if history.UndoneAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "cleaning already undone"})
 		return
 	}
+	// Two undos of one clean would race each other restoring its emails
+	s.enqueueUniqueJob(c, database.JobUndo, "undo:"+history.ID, undoPayload{HistoryID: history.ID})
+}
 
-	// 5. If not a dry run, perform the actual actions via Gmail API.
-	tok, err := s.getUserToken(c)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User token is invalid"})
-		return
+// runUndoJob performs a queued undo.
+func (s *Server) runUndoJob(ctx context.Context, job database.Job) (interface{}, error) {
+	var payload undoPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return nil, jobs.Permanent(err)
 	}
-	gmailFetcher, err := fetcher.NewGmailFetcher(ctx, option.WithTokenSource(oauth2.StaticTokenSource(tok)))
+	history, err := s.store.GetCleaningHistory(ctx, payload.HistoryID, job.UserID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create Gmail service"})
-		return
+		return nil, err
 	}
-
-    var successfullyProcessedIDs []string
-	for _, emailData := range affectedEmails {
-		emailID := emailData["id"].(string)
-		action := emailData["action"].(string)
-		var actionErr error
-
-        switch action {
-		case "DELETE":
-            if request.PermanentDelete {
-                actionErr = gmailFetcher.DeleteMessagePermanently("me", emailID)
-            } else {
-                actionErr = gmailFetcher.TrashMessage("me", emailID)
-            }
-		case "ARCHIVE":
-			actionErr = gmailFetcher.ArchiveMessage("me", emailID)
-		case "MARK_READ":
-			actionErr = gmailFetcher.MarkRead("me", emailID)
-		}
-
-		if actionErr != nil {
-			c.Error(actionErr)
-			continue
-		}
-
-		_ = s.store.DeleteEmail(ctx, emailID)
-		successfullyProcessedIDs = append(successfullyProcessedIDs, emailID)
+	if history.UndoneAt != nil {
+		return nil, jobs.Permanent(errors.New("cleaning already undone"))
 	}
-
-	// 6. Log the cleaning event to the database.
-	if _, err := s.store.CreateCleaningHistory(ctx, userEmail, successfullyProcessedIDs); err != nil {
-		c.Error(err) // Log error but don't fail the whole request
+	emailService, err := s.emailServiceFor(ctx, job.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("user token is invalid: %w", err)
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"message":        "Cleaning complete",
-		"affected_count": len(successfullyProcessedIDs),
-		"affected_ids":   successfullyProcessedIDs,
-	})
-}
-
-// GetCleanHistoryHandler fetches the cleaning history from the database.
-func (s *Server) GetCleanHistoryHandler(c *gin.Context) {
-	userEmail := getUserEmail(c)
-	history, err := s.store.ListCleaningHistory(c.Request.Context(), userEmail)
+	report, err := cleaner.Undo(ctx, s.store, emailService, job.UserID, history)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch cleaning history"})
-		return
+		return report, err
 	}
-	c.JSON(http.StatusOK, gin.H{"history": history})
+	msg := fmt.Sprintf("Restored %d emails", len(report.RestoredIDs))
+	if len(report.PurgedIDs) > 0 {
+		msg += fmt.Sprintf("; %d were already purged", len(report.PurgedIDs))
+	}
+	if len(report.ReadStateLostIDs) > 0 {
+		msg += fmt.Sprintf("; %d stay marked read, their earlier state is unknown", len(report.ReadStateLostIDs))
+	}
+	if len(report.FailedIDs) > 0 {
+		msg += fmt.Sprintf("; %d failed, undo again to retry them", len(report.FailedIDs))
+	}
+	return gin.H{
+		"message":             msg,
+		"history_id":          report.HistoryID,
+		"undone":              report.Undone,
+		"restored_ids":        report.RestoredIDs,
+		"purged_ids":          report.PurgedIDs,
+		"failed_ids":          report.FailedIDs,
+		"read_state_lost_ids": report.ReadStateLostIDs,
+		"errors":              report.Errors,
+	}, nil
 }
@@ -6,10 +6,13 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/textproto"
 	"strings"
 	"time"
 
+	"backend/internal/cleaner"
 	"backend/internal/database"
+	"backend/internal/rules"
 
 	"github.com/gin-gonic/gin"
 	log "github.com/sirupsen/logrus"
@@ -22,18 +25,20 @@ import (
 	"github.com/google/uuid"
 )
 
+// SyncEmailsHandler queues a full sync of the user's inbox; poll the
+// returned job for the outcome.
 func (s *Server) SyncEmailsHandler(c *gin.Context) {
-	userEmail := getUserEmail(c)
-	
-	// Create a longer context for sync operations (5 minutes)
-	ctx, cancel := context.WithTimeout(c.Request.Context(), 5*time.Minute)
-	defer cancel()
+	s.enqueueJob(c, database.JobSync, struct{}{})
+}
+
+// syncEmails fetches every inbox message and stores it locally. It runs as a
+// background job.
+func (s *Server) syncEmails(ctx context.Context, userEmail string) (gin.H, error) {
 	defer s.clearSyncProgress(userEmail)
 
-	emailService, err := s.getEmailService(c)
+	emailService, err := s.emailServiceFor(ctx, userEmail)
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "User token is invalid"})
-		return
+		return nil, fmt.Errorf("user token is invalid: %w", err)
 	}
 
 	log.Infof("Starting full email sync for user: %s", userEmail)
@@ -43,8 +48,7 @@ func (s *Server) SyncEmailsHandler(c *gin.Context) {
     ids, err := emailService.ListAllMessageIDs("me", "", []string{"INBOX"})
 	if err != nil {
 		log.Errorf("Failed to list Gmail messages: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list Gmail messages"})
-		return
+		return nil, fmt.Errorf("failed to list Gmail messages: %w", err)
 	}
 
 	log.Infof("Found %d total emails to sync", len(ids))
@@ -53,8 +57,7 @@ func (s *Server) SyncEmailsHandler(c *gin.Context) {
 	messages, err := emailService.GetMessageDetails("me", ids)
 	if err != nil {
 		log.Errorf("Failed to get Gmail message details: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get Gmail message details"})
-		return
+		return nil, fmt.Errorf("failed to get Gmail message details: %w", err)
 	}
 
 	log.Infof("Successfully fetched details for %d messages", len(messages))
@@ -99,6 +102,8 @@ func (s *Server) SyncEmailsHandler(c *gin.Context) {
 			Snippet: cleanSnippet,
 			Date:    date,
 			Read:    isRead,
+			Headers: s.extractSyncHeaders(msg),
+			Labels:  msg.LabelIds,
 		})
 	}
 
@@ -107,8 +112,7 @@ func (s *Server) SyncEmailsHandler(c *gin.Context) {
 
 	if err := s.store.UpsertEmails(ctx, emailsToUpsert); err != nil {
 		log.Errorf("Failed to save emails to database: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save emails to database"})
-		return
+		return nil, fmt.Errorf("failed to save emails to database: %w", err)
 	}
 
 	// Initialize history ID for future quick syncs using the History API
@@ -122,40 +126,28 @@ func (s *Server) SyncEmailsHandler(c *gin.Context) {
 
 	s.updateSyncProgress(userEmail, "full", "Complete", 100, 100)
 	log.Infof("Successfully synced %d emails for user %s", len(emailsToUpsert), userEmail)
-	c.JSON(http.StatusOK, gin.H{
+	return gin.H{
 		"message": fmt.Sprintf("Successfully synced %d emails.", len(emailsToUpsert)),
 		"total":   len(emailsToUpsert),
-	})
+	}, nil
 }
 
 // BulkMarkReadHandler marks multiple emails as read
 func (s *Server) BulkMarkReadHandler(c *gin.Context) {
-	emailService, err := s.getEmailService(c)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "No token"})
-		return
-	}
-
-	var request struct {
-		EmailIDs []string `json:"emailIds"`
-	}
-
-	if err := c.ShouldBindJSON(&request); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
-		return
-	}
-
-	if len(request.EmailIDs) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "No email IDs provided"})
-		return
-	}
+	s.enqueueBulk(c, bulkRead)
+}
 
-	log.Infof("Bulk marking %d emails as read", len(request.EmailIDs))
+// bulkMarkRead marks the emails as read
+func (s *Server) bulkMarkRead(ctx context.Context, emailService EmailService, userEmail string, emailIDs []string) (gin.H, error) {
+	log.Infof("Bulk marking %d emails as read", len(emailIDs))
 
 	var successCount int
 	var errors []string
 
-	for _, id := range request.EmailIDs {
+	for _, id := range emailIDs {
+		if ctx.Err() != nil {
+			break // cancelled or timed out; the job reports it
+		}
 		if err := emailService.MarkRead("me", id); err != nil {
 			log.Errorf("Failed to mark email %s as read: %v", id, err)
 			errors = append(errors, fmt.Sprintf("Failed to mark %s as read", id))
@@ -165,47 +157,35 @@ func (s *Server) BulkMarkReadHandler(c *gin.Context) {
 	}
 
 	if len(errors) > 0 {
-		c.JSON(http.StatusPartialContent, gin.H{
+		return gin.H{
 			"message":      fmt.Sprintf("Marked %d emails as read", successCount),
 			"successCount": successCount,
 			"errors":       errors,
-		})
+		}, nil
 	} else {
-		c.JSON(http.StatusOK, gin.H{
+		return gin.H{
 			"message":      fmt.Sprintf("Successfully marked %d emails as read", successCount),
 			"successCount": successCount,
-		})
+		}, nil
 	}
 }
 
 // BulkMarkUnreadHandler marks multiple emails as unread
 func (s *Server) BulkMarkUnreadHandler(c *gin.Context) {
-	emailService, err := s.getEmailService(c)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "No token"})
-		return
-	}
-
-	var request struct {
-		EmailIDs []string `json:"emailIds"`
-	}
-
-	if err := c.ShouldBindJSON(&request); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
-		return
-	}
-
-	if len(request.EmailIDs) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "No email IDs provided"})
-		return
-	}
+	s.enqueueBulk(c, bulkUnread)
+}
 
-	log.Infof("Bulk marking %d emails as unread", len(request.EmailIDs))
+// bulkMarkUnread marks the emails as unread
+func (s *Server) bulkMarkUnread(ctx context.Context, emailService EmailService, userEmail string, emailIDs []string) (gin.H, error) {
+	log.Infof("Bulk marking %d emails as unread", len(emailIDs))
 
 	var successCount int
 	var errors []string
 
-	for _, id := range request.EmailIDs {
+	for _, id := range emailIDs {
+		if ctx.Err() != nil {
+			break // cancelled or timed out; the job reports it
+		}
 		if err := emailService.MarkUnread("me", id); err != nil {
 			log.Errorf("Failed to mark email %s as unread: %v", id, err)
 			errors = append(errors, fmt.Sprintf("Failed to mark %s as unread", id))
@@ -215,49 +195,47 @@ func (s *Server) BulkMarkUnreadHandler(c *gin.Context) {
 	}
 
 	if len(errors) > 0 {
-		c.JSON(http.StatusPartialContent, gin.H{
+		return gin.H{
 			"message":      fmt.Sprintf("Marked %d emails as unread", successCount),
 			"successCount": successCount,
 			"errors":       errors,
-		})
+		}, nil
 	} else {
-		c.JSON(http.StatusOK, gin.H{
+		return gin.H{
 			"message":      fmt.Sprintf("Successfully marked %d emails as unread", successCount),
 			"successCount": successCount,
-		})
+		}, nil
 	}
 }
 
 // BulkDeleteHandler moves multiple emails to trash
 func (s *Server) BulkDeleteHandler(c *gin.Context) {
-	emailService, err := s.getEmailService(c)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "No token"})
-		return
-	}
-
-	var request struct {
-		EmailIDs []string `json:"emailIds"`
-	}
-
-	if err := c.ShouldBindJSON(&request); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
-		return
-	}
-
-	if len(request.EmailIDs) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "No email IDs provided"})
-		return
-	}
+	s.enqueueBulk(c, bulkDelete)
+}
 
-	log.Infof("Bulk deleting %d emails", len(request.EmailIDs))
+// bulkDelete moves the emails to trash, skipping protected senders
+func (s *Server) bulkDelete(ctx context.Context, emailService EmailService, userEmail string, emailIDs []string) (gin.H, error) {
+	log.Infof("Bulk deleting %d emails", len(emailIDs))
 
 	var successCount int
 	var errors []string
-	userEmail := getUserEmail(c)
-	ctx := c.Request.Context()
 
-	for _, id := range request.EmailIDs {
+	// Never trash mail covered by the user's protected senders
+	protected, err := s.protectedEmailIDs(ctx, emailService, userEmail, emailIDs)
+	if err != nil {
+		log.Errorf("Failed to check protected senders: %v", err)
+		return nil, fmt.Errorf("failed to check protected senders: %w", err)
+	}
+	var skipped []string
+
+	for _, id := range emailIDs {
+		if ctx.Err() != nil {
+			break
+		}
+		if _, ok := protected[id]; ok {
+			skipped = append(skipped, id)
+			continue
+		}
 		// Save origin inbox state for each email
 		hadInbox, _ := emailService.HasInboxLabel("me", id)
 		_ = s.store.SaveTrashOrigin(ctx, userEmail, id, hadInbox)
@@ -272,48 +250,70 @@ func (s *Server) BulkDeleteHandler(c *gin.Context) {
 	}
 
 	if len(errors) > 0 {
-		c.JSON(http.StatusPartialContent, gin.H{
+		return gin.H{
 			"message":      fmt.Sprintf("Moved %d emails to trash", successCount),
 			"successCount": successCount,
 			"errors":       errors,
-		})
+			"protected":    protected,
+		}, nil
 	} else {
-		c.JSON(http.StatusOK, gin.H{
-			"message":      fmt.Sprintf("Successfully moved %d emails to trash", successCount),
+		message := fmt.Sprintf("Successfully moved %d emails to trash", successCount)
+		if len(skipped) > 0 {
+			message += fmt.Sprintf(", skipped %d protected emails", len(skipped))
+		}
+		return gin.H{
+			"message":      message,
 			"successCount": successCount,
-		})
+			"protected":    protected,
+		}, nil
 	}
 }
 
-// BulkArchiveHandler archives multiple emails
-func (s *Server) BulkArchiveHandler(c *gin.Context) {
-	emailService, err := s.getEmailService(c)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "No token"})
-		return
+// protectedEmailIDs checks live sender and label data for the given messages
+// against the user's allowlist and returns the protected ones with the entry
+// that covers them.
+func (s *Server) protectedEmailIDs(ctx context.Context, emailService EmailService, userEmail string, ids []string) (map[string]rules.Protection, error) {
+	protected := make(map[string]rules.Protection)
+	protections, err := cleaner.LoadProtections(ctx, s.store, userEmail)
+	if err != nil || len(protections) == 0 {
+		return protected, err
 	}
-
-	var request struct {
-		EmailIDs []string `json:"emailIds"`
+	messages, err := emailService.GetMessageDetails("me", ids)
+	if err != nil {
+		return nil, err
 	}
-
-	if err := c.ShouldBindJSON(&request); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
-		return
+	for _, msg := range messages {
+		email := rules.Email{Labels: msg.LabelIds}
+		if msg.Payload != nil {
+			for _, h := range msg.Payload.Headers {
+				if h.Name == "From" {
+					email.Sender = h.Value
+				}
+			}
+		}
+		if p, ok := rules.ProtectedBy(email, protections); ok {
+			protected[msg.Id] = p
+		}
 	}
+	return protected, nil
+}
 
-	if len(request.EmailIDs) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "No email IDs provided"})
-		return
-	}
+// BulkArchiveHandler archives multiple emails
+func (s *Server) BulkArchiveHandler(c *gin.Context) {
+	s.enqueueBulk(c, bulkArchive)
+}
 
-	log.Infof("Bulk archiving %d emails", len(request.EmailIDs))
+// bulkArchive archives the emails
+func (s *Server) bulkArchive(ctx context.Context, emailService EmailService, userEmail string, emailIDs []string) (gin.H, error) {
+	log.Infof("Bulk archiving %d emails", len(emailIDs))
 
     var successCount int
 	var errors []string
-    ctx := c.Request.Context()
 
-    for _, id := range request.EmailIDs {
+    for _, id := range emailIDs {
+        if ctx.Err() != nil {
+            break
+        }
         if err := emailService.ArchiveMessage("me", id); err != nil {
 			log.Errorf("Failed to archive email %s: %v", id, err)
 			errors = append(errors, fmt.Sprintf("Failed to archive %s", id))
@@ -334,19 +334,48 @@ func (s *Server) BulkArchiveHandler(c *gin.Context) {
 	}
 
 	if len(errors) > 0 {
-		c.JSON(http.StatusPartialContent, gin.H{
+		return gin.H{
 			"message":      fmt.Sprintf("Archived %d emails", successCount),
 			"successCount": successCount,
 			"errors":       errors,
-		})
+		}, nil
 	} else {
-		c.JSON(http.StatusOK, gin.H{
+		return gin.H{
 			"message":      fmt.Sprintf("Successfully archived %d emails", successCount),
 			"successCount": successCount,
-		})
+		}, nil
 	}
 }
 
+// extractSyncHeaders keeps the configured headers of a message so rules can
+// test them later. Names are stored in canonical form.
+func (s *Server) extractSyncHeaders(msg *gmail.Message) map[string]string {
+	if msg.Payload == nil || s.cfg == nil || len(s.cfg.SyncHeaders) == 0 {
+		return nil
+	}
+	wanted := make(map[string]bool, len(s.cfg.SyncHeaders))
+	for _, name := range s.cfg.SyncHeaders {
+		wanted[textproto.CanonicalMIMEHeaderKey(name)] = true
+	}
+	headers := make(map[string]string)
+	for _, h := range msg.Payload.Headers {
+		name := textproto.CanonicalMIMEHeaderKey(h.Name)
+		if !wanted[name] {
+			continue
+		}
+		value := strings.ReplaceAll(h.Value, "\x00", "")
+		// Repeated headers are joined the same way net/mail folds them
+		if existing, ok := headers[name]; ok {
+			value = existing + ", " + value
+		}
+		headers[name] = value
+	}
+	if len(headers) == 0 {
+		return nil
+	}
+	return headers
+}
+
 // parseGmailDate handles multiple potential date formats from the Gmail API.
 func parseGmailDate(dateStr string) (time.Time, error) {
 	if idx := strings.LastIndex(dateStr, " ("); idx != -1 {
@@ -368,13 +397,8 @@ func parseGmailDate(dateStr string) (time.Time, error) {
 	return time.Time{}, fmt.Errorf("could not parse date: %s", dateStr)
 }
 
-func getUserEmail(c *gin.Context) string {
-	email, _ := c.Cookie("session_user")
-	return email
-}
-
 func (s *Server) getUserToken(c *gin.Context) (*oauth2.Token, error) {
-	email := getUserEmail(c)
+	email := getMailboxID(c)
 	if email == "" {
 		return nil, errors.New("no user in session")
 	}
@@ -389,13 +413,13 @@ func (s *Server) getUserToken(c *gin.Context) (*oauth2.Token, error) {
 }
 
 func (s *Server) GetEmailsHandler(c *gin.Context) {
-	userEmail := getUserEmail(c)
+	userEmail := getMailboxID(c)
 	emails, total, err := s.store.ListEmails(c.Request.Context(), userEmail, 1, 25, "")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list emails from database"})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"emails": emails, "total": total, "user": userEmail})
+	c.JSON(http.StatusOK, gin.H{"emails": emails, "total": total, "user": c.GetString(ctxMailboxEmail)})
 }
 
 func (s *Server) DeleteEmailHandler(c *gin.Context) {
@@ -407,7 +431,7 @@ func (s *Server) DeleteEmailHandler(c *gin.Context) {
     ctx := c.Request.Context()
     id := c.Param("id")
     // Record whether this email was in INBOX prior to trashing, so we can restore accordingly.
-    userEmail := getUserEmail(c)
+    userEmail := getMailboxID(c)
     hadInbox, _ := emailService.HasInboxLabel("me", id)
     _ = s.store.SaveTrashOrigin(ctx, userEmail, id, hadInbox)
 	err = emailService.TrashMessage("me", id)
@@ -435,7 +459,7 @@ func (s *Server) UntrashEmailHandler(c *gin.Context) {
 		return
 	}
     id := c.Param("id")
-    userEmail := getUserEmail(c)
+    userEmail := getMailboxID(c)
     err = emailService.UntrashMessage("me", id)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to untrash email"})
@@ -513,7 +537,7 @@ func (s *Server) ArchiveEmailHandler(c *gin.Context) {
 }
 
 func (s *Server) GetEmailsPaginatedHandler(c *gin.Context) {
-	userEmail := getUserEmail(c)
+	userEmail := getMailboxID(c)
 	page := 1
 	pageSize := 10
 	var filter string
@@ -534,11 +558,11 @@ func (s *Server) GetEmailsPaginatedHandler(c *gin.Context) {
 	}
 
 	// Include the total in the response
-	c.JSON(http.StatusOK, gin.H{"emails": emails, "total": total, "user": userEmail})
+	c.JSON(http.StatusOK, gin.H{"emails": emails, "total": total, "user": c.GetString(ctxMailboxEmail)})
 }
 
 func (s *Server) BlockSenderHandler(c *gin.Context) {
-	userEmail := getUserEmail(c)
+	userEmail := getMailboxID(c)
 	var req struct {
 		Sender string `json:"sender"`
 	}
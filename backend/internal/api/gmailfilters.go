@@ -0,0 +1,145 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"backend/internal/database"
+	"backend/internal/rules"
+	"backend/internal/rules/gmailfilter"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// maxFilterXMLSize bounds uploaded filter exports
+const maxFilterXMLSize = 5 << 20
+
+// ImportGmailFiltersHandler creates rules from a Gmail filter export. The
+// XML is the raw request body. With ?dry_run=true nothing is saved and the
+// rules that would be created are returned.
+func (s *Server) ImportGmailFiltersHandler(c *gin.Context) {
+	userEmail := getMailboxID(c)
+	dryRun := c.Query("dry_run") == "true"
+
+	imported, report, err := gmailfilter.Import(http.MaxBytesReader(c.Writer, c.Request.Body, maxFilterXMLSize))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	toCreate := make([]importedRule, len(imported))
+	for i, im := range imported {
+		toCreate[i] = importedRule{Entry: im.Entry, Params: im.Params}
+	}
+	created, rejected, err := s.createImportedRules(c.Request.Context(), userEmail, toCreate, dryRun)
+	for _, r := range rejected {
+		report.Issues = append(report.Issues, gmailfilter.Issue{Entry: r.Entry, Reason: r.Reason, Skipped: true})
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create rules; none were imported", "report": report})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"dry_run":  dryRun,
+		"imported": len(created),
+		"rules":    created,
+		"report":   report,
+	})
+}
+
+// importedRule is a rule translated from an import, with the filter or
+// script line it came from
+type importedRule struct {
+	Entry  string
+	Params database.CreateRuleParams
+}
+
+// rejectedRule is an imported rule that failed validation
+type rejectedRule struct {
+	Entry  string
+	Reason string
+}
+
+// createImportedRules validates the imported rules and saves the valid ones
+// in order, in one transaction, so each is appended after the user's
+// existing rules and a failure leaves none behind. In dry-run mode the
+// validated params are returned instead.
+func (s *Server) createImportedRules(ctx context.Context, userEmail string, imported []importedRule, dryRun bool) ([]interface{}, []rejectedRule, error) {
+	var valid []database.CreateRuleParams
+	var rejected []rejectedRule
+	for _, im := range imported {
+		p := im.Params
+		engineRule := rules.Rule{Type: p.Type, Value: p.Value, Condition: p.Conditions, MatchOp: p.MatchOp, Action: p.Action}
+		err := engineRule.Validate()
+		if err == nil {
+			err = rules.ValidateAction(p.Action)
+		}
+		if err != nil {
+			rejected = append(rejected, rejectedRule{Entry: im.Entry, Reason: err.Error()})
+			continue
+		}
+		p.ID = uuid.NewString()
+		p.UserID = userEmail
+		valid = append(valid, p)
+	}
+
+	created := make([]interface{}, 0, len(valid))
+	if dryRun {
+		for _, p := range valid {
+			created = append(created, p)
+		}
+		return created, rejected, nil
+	}
+	if len(valid) == 0 {
+		return created, rejected, nil
+	}
+	saved, err := s.store.CreateRules(ctx, valid)
+	if err != nil {
+		return created, rejected, err
+	}
+	for _, rule := range saved {
+		created = append(created, rule)
+	}
+	return created, rejected, nil
+}
+
+// ExportGmailFiltersHandler downloads the user's rules as a Gmail filter
+// export. Rules that could not be exported are listed in the
+// X-Unexported-Rules header, or in the body with ?format=json.
+func (s *Server) ExportGmailFiltersHandler(c *gin.Context) {
+	userEmail := getMailboxID(c)
+	ruleset, err := s.store.ListRules(c.Request.Context(), userEmail)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch rules"})
+		return
+	}
+
+	var buf bytes.Buffer
+	report, err := gmailfilter.Export(&buf, ruleset, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export rules"})
+		return
+	}
+
+	if c.Query("format") == "json" {
+		c.JSON(http.StatusOK, gin.H{"xml": buf.String(), "report": report})
+		return
+	}
+
+	var skipped []string
+	for _, issue := range report.Issues {
+		if issue.Skipped {
+			skipped = append(skipped, issue.Entry)
+		}
+	}
+	if len(skipped) > 0 {
+		c.Header("X-Unexported-Rules", strings.Join(skipped, ","))
+	}
+	c.Header("Content-Disposition", `attachment; filename="mailFilters.xml"`)
+	c.Data(http.StatusOK, "application/atom+xml; charset=utf-8", buf.Bytes())
+}
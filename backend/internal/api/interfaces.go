@@ -2,8 +2,10 @@ package api
 
 import (
 	"context"
+	"time"
 
 	"backend/internal/database"
+	"backend/internal/rules"
 
 	"google.golang.org/api/gmail/v1"
 )
@@ -12,30 +14,74 @@ import (
 type DataStore interface {
 	// Rule methods
 	ListRules(ctx context.Context, userEmail string) ([]database.Rule, error)
+	GetRule(ctx context.Context, ruleID, userEmail string) (database.Rule, error)
 	CreateRule(ctx context.Context, arg database.CreateRuleParams) (database.Rule, error)
-	UpdateRule(ctx context.Context, ruleID, userEmail, ruleType, value, action string, ageDays int) (database.Rule, error)
+	CreateRules(ctx context.Context, args []database.CreateRuleParams) ([]database.Rule, error)
+	UpdateRule(ctx context.Context, arg database.UpdateRuleParams) (database.Rule, error)
 	DeleteRule(ctx context.Context, ruleID, userEmail string) error
+	ReorderRules(ctx context.Context, userEmail string, ruleIDs []string) ([]database.Rule, error)
 
 	// Email methods
 	ListEmails(ctx context.Context, userEmail string, page, pageSize int, filter string) ([]database.Email, int, error)
 	ListAllEmailsForUser(ctx context.Context, userEmail string) ([]database.Email, error)
+	GetEmailsByIDs(ctx context.Context, userEmail string, ids []string) ([]database.Email, error)
+	StreamRuleMatches(ctx context.Context, userEmail string, ruleset []rules.Rule, fn func(database.RuleMatch) error) error
+	ListRuleMatches(ctx context.Context, userEmail string, ruleset []rules.Rule, after *database.RuleMatchCursor, limit int) ([]database.RuleMatch, *database.RuleMatchCursor, error)
 	DeleteEmail(ctx context.Context, id string) error
 	UpsertEmails(ctx context.Context, emails []database.Email) error
 
+	// User and mailbox methods
+	SignInMailbox(ctx context.Context, email string) (database.User, database.Mailbox, error)
+	LinkMailbox(ctx context.Context, userID, email string) (database.Mailbox, error)
+	GetUser(ctx context.Context, id string) (database.User, error)
+	ListMailboxes(ctx context.Context, userID string) ([]database.Mailbox, error)
+	ListAllMailboxes(ctx context.Context) ([]database.Mailbox, error)
+
 	// History methods
-	CreateCleaningHistory(ctx context.Context, userID string, affectedEmails []string) (database.CleaningHistory, error)
+	CreateCleaningHistory(ctx context.Context, userID string, entries []database.HistoryEntry) (database.CleaningHistory, error)
 	ListCleaningHistory(ctx context.Context, userID string) ([]database.CleaningHistory, error)
+	GetCleaningHistory(ctx context.Context, id, userID string) (database.CleaningHistory, error)
+	MarkCleaningUndone(ctx context.Context, id, userID string) error
+
+	// Protected sender methods
+	ListProtectedSenders(ctx context.Context, userID string) ([]database.ProtectedSender, error)
+	CreateProtectedSender(ctx context.Context, userID, kind, value string) (database.ProtectedSender, error)
+	DeleteProtectedSender(ctx context.Context, id, userID string) error
 
 	// Analytics methods
 	GetTopSenders(ctx context.Context, userID string) ([]database.SenderAnalytic, error)
 
     // Settings methods
     GetUserSettings(ctx context.Context, userID string) (database.UserSettings, error)
-    UpdateUserSettings(ctx context.Context, userID string, enabled bool, frequency string, timeOfDay string) (database.UserSettings, error)
+    UpdateUserSettings(ctx context.Context, arg database.UpdateUserSettingsParams) (database.UserSettings, error)
     UpdateHistoryID(ctx context.Context, userID string, historyID uint64) error
 
 	// Automation methods
 	ListAutomatedUsers(ctx context.Context) ([]database.UserSettings, error)
+	ClaimScheduledRun(ctx context.Context, userID string, slot time.Time) (bool, error)
+	ReleaseScheduledRun(ctx context.Context, userID string, slot time.Time) error
+	SetAutomationPause(ctx context.Context, userID string, until *time.Time) (database.UserSettings, error)
+	CreateAutomationRun(ctx context.Context, userID, trigger string) (*database.AutomationRun, error)
+	FinishAutomationRun(ctx context.Context, run *database.AutomationRun) error
+	ListAutomationRuns(ctx context.Context, userID string, limit int) ([]database.AutomationRun, error)
+	GetAutomationRun(ctx context.Context, id, userID string) (database.AutomationRun, error)
+
+	// Quarantine methods
+	QuarantineEmail(ctx context.Context, q database.QuarantinedEmail) error
+	ListQuarantine(ctx context.Context, userID string) ([]database.QuarantinedEmail, error)
+	ClaimDueQuarantine(ctx context.Context, now time.Time, lease time.Duration) ([]database.QuarantinedEmail, error)
+	ReleaseQuarantine(ctx context.Context, userID, emailID string) error
+	DeleteQuarantine(ctx context.Context, userID, emailID string) error
+
+	// Job methods
+	EnqueueJob(ctx context.Context, userID, jobType string, payload interface{}, maxAttempts int) (database.Job, error)
+	EnqueueUniqueJob(ctx context.Context, userID, jobType, dedupKey string, payload interface{}, maxAttempts int) (database.Job, error)
+	GetJob(ctx context.Context, id, userID string) (database.Job, error)
+	CancelJob(ctx context.Context, id, userID string) (database.Job, error)
+	ClaimJobs(ctx context.Context, limit int, lease time.Duration) ([]database.Job, error)
+	HeartbeatJob(ctx context.Context, id, leaseToken string, lease time.Duration) (bool, error)
+	FinishJob(ctx context.Context, id, leaseToken, status string, result []byte, lastErr string) error
+	RetryJob(ctx context.Context, id, leaseToken, lastErr string, runAfter time.Time) error
 
     // Trash origin methods
     SaveTrashOrigin(ctx context.Context, userID, emailID string, hadInbox bool) error
@@ -61,10 +107,14 @@ type EmailService interface {
 	ArchiveMessage(userID, id string) error
 	MarkRead(userID, id string) error
 	MarkUnread(userID, id string) error
+	AddLabel(userID, id, labelName string) error
+	RemoveLabel(userID, id, labelName string) error
 	DeleteMessagePermanently(userID, id string) error
 
 	CountArchivedMessages(userID string) (int, error)
 	GetLabelMessageCount(userID, labelID string) (int, error)
     HasInboxLabel(userID, id string) (bool, error)
+	GetLabelIDs(userID, id string) ([]string, error)
+	AddLabelIDs(userID, id string, labelIDs []string) error
 	SendMessage(userID string, message *gmail.Message) (*gmail.Message, error)
 }
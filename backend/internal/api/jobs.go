@@ -0,0 +1,170 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"backend/internal/database"
+	"backend/internal/jobs"
+
+	"github.com/gin-gonic/gin"
+)
+
+// jobMaxAttempts is how often a failing job is tried before it is marked
+// failed.
+const jobMaxAttempts = 3
+
+// Bulk actions carried by bulk jobs
+const (
+	bulkRead    = "read"
+	bulkUnread  = "unread"
+	bulkDelete  = "delete"
+	bulkArchive = "archive"
+)
+
+// bulkPayload is the payload of a bulk job.
+type bulkPayload struct {
+	Action   string   `json:"action"`
+	EmailIDs []string `json:"emailIds"`
+}
+
+// registerJobHandlers wires the background job types to the server's
+// handlers.
+func (s *Server) registerJobHandlers() {
+	if s.jobs == nil {
+		return
+	}
+	s.jobs.Register(database.JobSync, func(ctx context.Context, job database.Job) (interface{}, error) {
+		return s.syncEmails(ctx, job.UserID)
+	})
+	s.jobs.Register(database.JobClean, func(ctx context.Context, job database.Job) (interface{}, error) {
+		var request cleanRequest
+		if err := json.Unmarshal(job.Payload, &request); err != nil {
+			return nil, jobs.Permanent(err)
+		}
+		result, err := s.executeClean(ctx, job.UserID, request, false)
+		// A partly applied clean is not repeated; what it did is in the result
+		return result, jobs.Permanent(err)
+	})
+	s.jobs.Register(database.JobBulk, s.runBulkJob)
+	s.jobs.Register(database.JobAutomation, s.runAutomationJob)
+	s.jobs.Register(database.JobUndo, s.runUndoJob)
+}
+
+// enqueueJob queues a job for the session user and responds with its ID.
+func (s *Server) enqueueJob(c *gin.Context, jobType string, payload interface{}) {
+	s.enqueueUniqueJob(c, jobType, "", payload)
+}
+
+// enqueueUniqueJob is enqueueJob for jobs that must not run concurrently.
+// It responds with a conflict while a job with the same dedup key is queued
+// or running; an empty key queues the job unconditionally.
+func (s *Server) enqueueUniqueJob(c *gin.Context, jobType, dedupKey string, payload interface{}) {
+	// Fail fast while the user can still sign in again
+	if _, err := s.getUserToken(c); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User token is invalid"})
+		return
+	}
+	var job database.Job
+	var err error
+	if dedupKey == "" {
+		job, err = s.store.EnqueueJob(c.Request.Context(), getMailboxID(c), jobType, payload, jobMaxAttempts)
+	} else {
+		job, err = s.store.EnqueueUniqueJob(c.Request.Context(), getMailboxID(c), jobType, dedupKey, payload, jobMaxAttempts)
+	}
+	if err != nil {
+		if err.Error() == "job already queued" {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue job"})
+		}
+		return
+	}
+	if s.jobs != nil {
+		s.jobs.Notify()
+	}
+	c.JSON(http.StatusAccepted, gin.H{"job_id": job.ID, "status": job.Status})
+}
+
+// enqueueBulk validates a bulk request body and queues it as a bulk job.
+func (s *Server) enqueueBulk(c *gin.Context, action string) {
+	var request struct {
+		EmailIDs []string `json:"emailIds"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	if len(request.EmailIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No email IDs provided"})
+		return
+	}
+
+	s.enqueueJob(c, database.JobBulk, bulkPayload{Action: action, EmailIDs: request.EmailIDs})
+}
+
+// runBulkJob performs a queued bulk action.
+func (s *Server) runBulkJob(ctx context.Context, job database.Job) (interface{}, error) {
+	var payload bulkPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return nil, jobs.Permanent(err)
+	}
+	emailService, err := s.emailServiceFor(ctx, job.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("user token is invalid: %w", err)
+	}
+
+	var result gin.H
+	switch payload.Action {
+	case bulkRead:
+		result, err = s.bulkMarkRead(ctx, emailService, job.UserID, payload.EmailIDs)
+	case bulkUnread:
+		result, err = s.bulkMarkUnread(ctx, emailService, job.UserID, payload.EmailIDs)
+	case bulkDelete:
+		result, err = s.bulkDelete(ctx, emailService, job.UserID, payload.EmailIDs)
+	case bulkArchive:
+		result, err = s.bulkArchive(ctx, emailService, job.UserID, payload.EmailIDs)
+	default:
+		return nil, jobs.Permanent(fmt.Errorf("unknown bulk action %q", payload.Action))
+	}
+	if err == nil {
+		err = ctx.Err() // the loop stopped early
+	}
+	return result, err
+}
+
+// GetJobHandler returns a job's status and, once finished, its result.
+func (s *Server) GetJobHandler(c *gin.Context) {
+	job, err := s.store.GetJob(c.Request.Context(), c.Param("id"), getMailboxID(c))
+	if err != nil {
+		if err.Error() == "job not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch job"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"job": job})
+}
+
+// CancelJobHandler cancels a queued job, or stops a running one at the next
+// email it would have processed.
+func (s *Server) CancelJobHandler(c *gin.Context) {
+	job, err := s.store.CancelJob(c.Request.Context(), c.Param("id"), getMailboxID(c))
+	if err != nil {
+		switch err.Error() {
+		case "job not found":
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case "job already finished":
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel job"})
+		}
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"job": job})
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"backend/internal/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// loginStateCookie binds a login's OAuth state to the browser that started
+// it, so a callback carrying someone else's state is rejected.
+const loginStateCookie = "oauth_state"
+
+// returnTo resolves the page a login should land on. Paths are taken
+// relative to the frontend; absolute URLs must be on the frontend's origin
+// or one of the configured return origins. Anything else falls back to the
+// frontend.
+func returnTo(cfg *config.Config, raw string) string {
+	if raw == "" {
+		return cfg.FrontendURL + "/"
+	}
+	// A lone path, but not a scheme-relative //host
+	if strings.HasPrefix(raw, "/") && !strings.HasPrefix(raw, "//") && !strings.HasPrefix(raw, "/\\") {
+		return cfg.FrontendURL + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return cfg.FrontendURL + "/"
+	}
+	origin := u.Scheme + "://" + u.Host
+	if strings.EqualFold(origin, cfg.FrontendURL) {
+		return u.String()
+	}
+	for _, allowed := range cfg.ReturnOrigins {
+		if strings.EqualFold(origin, strings.TrimRight(allowed, "/")) {
+			return u.String()
+		}
+	}
+	return cfg.FrontendURL + "/"
+}
+
+// setLoginStateCookie remembers the state for the callback; an empty state
+// clears it.
+func setLoginStateCookie(c *gin.Context, state string) {
+	maxAge := 600 // the login must finish within ten minutes
+	if state == "" {
+		maxAge = -1
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     loginStateCookie,
+		Value:    state,
+		Path:     "/auth/google",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode, // sent on Google's top-level redirect back
+		Secure:   false,                // Set to true in production with HTTPS
+	})
+}
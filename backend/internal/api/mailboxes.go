@@ -0,0 +1,75 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// mailboxHeader selects which of the user's mailboxes a request acts on; the
+// mailbox query parameter does the same for links. Without either the
+// mailbox the user signed up with is used.
+const mailboxHeader = "X-Mailbox-ID"
+
+// Context keys set by mailboxMiddleware
+const (
+	ctxMailbox      = "mailbox_id"
+	ctxMailboxEmail = "mailbox_email"
+)
+
+// mailboxMiddleware resolves the selected mailbox for the signed-in user. It
+// runs after sessionMiddleware.
+func (s *Server) mailboxMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		mailboxes, err := s.store.ListMailboxes(c.Request.Context(), getUserID(c))
+		if err != nil {
+			log.Errorf("Failed to list mailboxes: %v", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch mailboxes"})
+			return
+		}
+		if len(mailboxes) == 0 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+			return
+		}
+
+		selected := c.GetHeader(mailboxHeader)
+		if selected == "" {
+			selected = c.Query("mailbox")
+		}
+		mailbox := mailboxes[0]
+		if selected != "" {
+			found := false
+			for _, m := range mailboxes {
+				if m.ID == selected {
+					mailbox, found = m, true
+					break
+				}
+			}
+			if !found {
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "mailbox not found"})
+				return
+			}
+		}
+		c.Set(ctxMailbox, mailbox.ID)
+		c.Set(ctxMailboxEmail, mailbox.Email)
+		c.Next()
+	}
+}
+
+// getMailboxID returns the mailbox the request acts on. Rules, emails,
+// settings, jobs and tokens are all stored under it.
+func getMailboxID(c *gin.Context) string {
+	return c.GetString(ctxMailbox)
+}
+
+// ListMailboxesHandler lists the user's linked mailboxes and the one the
+// request selected. Link another with /auth/google/login?link=true.
+func (s *Server) ListMailboxesHandler(c *gin.Context) {
+	mailboxes, err := s.store.ListMailboxes(c.Request.Context(), getUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch mailboxes"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"mailboxes": mailboxes, "current": getMailboxID(c)})
+}
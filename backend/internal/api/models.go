@@ -1,15 +1,17 @@
 package api
 
 import (
+	"context"
 	"errors"
 	"sync"
 	"time"
 
 	"backend/internal/auth"
+	"backend/internal/config"
 	"backend/internal/fetcher"
+	"backend/internal/jobs"
 
 	"github.com/gin-gonic/gin"
-	"golang.org/x/oauth2"
 	"google.golang.org/api/option"
 )
 
@@ -26,19 +28,28 @@ type SyncProgress struct {
 // Server represents the API server with its dependencies.
 // It now depends on interfaces, not concrete types.
 type Server struct {
+	cfg           *config.Config
 	store         DataStore
 	tokenStore    *auth.TokenStore
+	sessions      *auth.SessionStore
+	jobs          *jobs.Runner
 	syncProgress  map[string]*SyncProgress // user email -> progress
 	progressMutex sync.RWMutex
 }
 
-// NewServer creates a new Server instance.
-func NewServer(store DataStore, tokenStore *auth.TokenStore) *Server {
-	return &Server{
+// NewServer creates a new Server instance and registers its background job
+// handlers with the runner.
+func NewServer(cfg *config.Config, store DataStore, tokenStore *auth.TokenStore, sessions *auth.SessionStore, runner *jobs.Runner) *Server {
+	s := &Server{
+		cfg:          cfg,
 		store:        store,
 		tokenStore:   tokenStore,
+		sessions:     sessions,
+		jobs:         runner,
 		syncProgress: make(map[string]*SyncProgress),
 	}
+	s.registerJobHandlers()
+	return s
 }
 
 // updateSyncProgress updates the sync progress for a user
@@ -82,20 +93,28 @@ func (s *Server) clearSyncProgress(userEmail string) {
 // getEmailService is a helper to create an EmailService instance for a given request.
 // This encapsulates the logic of getting a user token and instantiating the fetcher.
 func (s *Server) getEmailService(c *gin.Context) (EmailService, error) {
-	email, _ := c.Cookie("session_user")
+	email := getMailboxID(c)
 	if email == "" {
 		return nil, errors.New("no user in session")
 	}
-	tok, err := s.tokenStore.Get(c.Request.Context(), email)
+	return s.emailServiceFor(c.Request.Context(), email)
+}
+
+// emailServiceFor creates an EmailService for a user outside of a request,
+// e.g. in a background job.
+func (s *Server) emailServiceFor(ctx context.Context, userEmail string) (EmailService, error) {
+	return NewEmailService(ctx, s.tokenStore, userEmail)
+}
+
+// NewEmailService creates an EmailService from the user's stored token. The
+// access token is refreshed as needed and refreshed tokens are saved back.
+func NewEmailService(ctx context.Context, tokenStore *auth.TokenStore, userEmail string) (EmailService, error) {
+	tokenSource, err := tokenStore.TokenSource(ctx, oauthConf, userEmail)
 	if err != nil {
 		return nil, err
 	}
-	if tok == nil {
-		return nil, errors.New("no token for user")
-	}
-
 	// The concrete *fetcher.GmailFetcher type implicitly satisfies the EmailService interface.
-	return fetcher.NewGmailFetcher(c.Request.Context(), option.WithTokenSource(oauth2.StaticTokenSource(tok)))
+	return fetcher.NewGmailFetcher(ctx, option.WithTokenSource(tokenSource))
 }
 
 // Rule is now primarily defined in the database package.
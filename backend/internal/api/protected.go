@@ -0,0 +1,60 @@
+package api
+
+import (
+	"net/http"
+
+	"backend/internal/rules"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetProtectedSendersHandler lists the user's protected senders.
+func (s *Server) GetProtectedSendersHandler(c *gin.Context) {
+	userEmail := getMailboxID(c)
+	list, err := s.store.ListProtectedSenders(c.Request.Context(), userEmail)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch protected senders"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"protected": list})
+}
+
+// CreateProtectedSenderHandler adds an address, domain or label to the allowlist.
+func (s *Server) CreateProtectedSenderHandler(c *gin.Context) {
+	userEmail := getMailboxID(c)
+	var req rules.Protection
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid protected sender: " + err.Error()})
+		return
+	}
+	if err := req.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid protected sender: " + err.Error()})
+		return
+	}
+
+	p, err := s.store.CreateProtectedSender(c.Request.Context(), userEmail, req.Kind, req.Value)
+	if err != nil {
+		if err.Error() == "sender already protected" {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save protected sender"})
+		}
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"message": "Sender protected", "protected": p})
+}
+
+// DeleteProtectedSenderHandler removes an allowlist entry.
+func (s *Server) DeleteProtectedSenderHandler(c *gin.Context) {
+	userEmail := getMailboxID(c)
+	err := s.store.DeleteProtectedSender(c.Request.Context(), c.Param("id"), userEmail)
+	if err != nil {
+		if err.Error() == "protected sender not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete protected sender"})
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Protection removed"})
+}
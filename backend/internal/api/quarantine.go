@@ -0,0 +1,65 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"backend/internal/auth"
+	"backend/internal/cleaner"
+	"backend/internal/database"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// GetQuarantineHandler lists the emails automation is holding back, with
+// the time each will be trashed, and the ones the user released.
+func (s *Server) GetQuarantineHandler(c *gin.Context) {
+	list, err := s.store.ListQuarantine(c.Request.Context(), getMailboxID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch quarantine"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"quarantine": list, "label": cleaner.QuarantineLabel})
+}
+
+// ReleaseQuarantineHandler keeps a quarantined email: it is never trashed
+// and automation leaves it alone from now on.
+func (s *Server) ReleaseQuarantineHandler(c *gin.Context) {
+	userEmail := getMailboxID(c)
+	emailID := c.Param("id")
+	if err := s.store.ReleaseQuarantine(c.Request.Context(), userEmail, emailID); err != nil {
+		if err.Error() == "quarantined email not found" {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to release email"})
+		}
+		return
+	}
+
+	emailService, err := s.getEmailService(c)
+	if err == nil {
+		err = emailService.RemoveLabel("me", emailID, cleaner.QuarantineLabel)
+	}
+	if err != nil {
+		log.Errorf("Failed to remove quarantine label from %s: %v", emailID, err)
+		c.JSON(http.StatusOK, gin.H{"message": "Email released, but its quarantine label could not be removed"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Email released"})
+}
+
+// TrashDueQuarantine trashes the user's quarantined emails whose deadline
+// has passed. The scheduler calls it.
+func TrashDueQuarantine(ctx context.Context, store DataStore, tokenStore *auth.TokenStore, userEmail string, due []database.QuarantinedEmail) error {
+	svc, err := NewEmailService(ctx, tokenStore, userEmail)
+	if err != nil {
+		return fmt.Errorf("could not get token for user: %w", err)
+	}
+	trashed, err := cleaner.TrashQuarantined(ctx, store, svc, userEmail, due)
+	if len(trashed) > 0 {
+		log.Infof("Quarantine: trashed %d emails for user %s", len(trashed), userEmail)
+	}
+	return err
+}
@@ -7,6 +7,7 @@ import (
 
 	"backend/internal/auth"
 	"backend/internal/config"
+	"backend/internal/jobs"
 
 	"github.com/gin-gonic/gin"
 	"golang.org/x/oauth2"
@@ -31,25 +32,14 @@ func InitOAuthConfig(cfg *config.Config) {
 	}
 }
 
-func sessionMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		_, err := c.Cookie("session_user")
-		if err != nil && c.Request.URL.Path != "/auth/google/login" && c.Request.URL.Path != "/auth/google/callback" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
-			return
-		}
-		c.Next()
-	}
-}
-
-func NewRouter(cfg *config.Config, store DataStore, tokenStore *auth.TokenStore) *gin.Engine {
+func NewRouter(cfg *config.Config, store DataStore, tokenStore *auth.TokenStore, sessions *auth.SessionStore, runner *jobs.Runner) *gin.Engine {
 	r := gin.Default()
 
 	r.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
 		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE, PATCH")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, "+mailboxHeader)
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(http.StatusNoContent)
 			return
@@ -57,20 +47,56 @@ func NewRouter(cfg *config.Config, store DataStore, tokenStore *auth.TokenStore)
 		c.Next()
 	})
 
-	server := NewServer(store, tokenStore)
+	server := NewServer(cfg, store, tokenStore, sessions, runner)
 
 	r.GET("/auth/google/login", func(c *gin.Context) {
-		url := oauthConf.AuthCodeURL("state", oauth2.AccessTypeOffline, oauth2.ApprovalForce)
+		// Linking another mailbox needs the user who is signed in
+		var linkTo string
+		if c.Query("link") == "true" {
+			token, _ := c.Cookie(sessionCookie)
+			sess, err := sessions.Lookup(c.Request.Context(), token)
+			if err != nil || sess == nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+				return
+			}
+			linkTo = sess.UserID
+		}
+
+		// A fresh state and PKCE verifier per login, checked in the callback
+		state, login, err := sessions.BeginLogin(c.Request.Context(), returnTo(cfg, c.Query("return_to")), linkTo)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+			return
+		}
+		setLoginStateCookie(c, state)
+		url := oauthConf.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.ApprovalForce, oauth2.S256ChallengeOption(login.Verifier))
 		c.Redirect(http.StatusTemporaryRedirect, url)
 	})
 
 	r.GET("/auth/google/callback", func(c *gin.Context) {
+		state := c.Query("state")
+		cookieState, _ := c.Cookie(loginStateCookie)
+		setLoginStateCookie(c, "")
+		if state == "" || state != cookieState {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid OAuth state"})
+			return
+		}
+		login, err := sessions.FinishLogin(c.Request.Context(), state)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check OAuth state"})
+			return
+		}
+		if login == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Login expired, please try again"})
+			return
+		}
+
 		code := c.Query("code")
 		if code == "" {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "No code in request"})
 			return
 		}
-		tok, err := oauthConf.Exchange(c, code)
+		tok, err := oauthConf.Exchange(c, code, oauth2.VerifierOption(login.Verifier))
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Token exchange failed"})
 			return
@@ -83,6 +109,10 @@ func NewRouter(cfg *config.Config, store DataStore, tokenStore *auth.TokenStore)
 			return
 		}
 		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to get userinfo"})
+			return
+		}
 		var u struct {
 			Email string `json:"email"`
 		}
@@ -90,31 +120,55 @@ func NewRouter(cfg *config.Config, store DataStore, tokenStore *auth.TokenStore)
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode userinfo"})
 			return
 		}
+		// Without an address every such login would share one account
+		if u.Email == "" {
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Userinfo has no email address"})
+			return
+		}
 
-		if err := tokenStore.Save(c, u.Email, tok); err != nil {
+		if login.LinkTo != "" {
+			// Add the Google account to the signed-in user's mailboxes
+			mailbox, err := store.LinkMailbox(c, login.LinkTo, u.Email)
+			if err != nil {
+				if err.Error() == "mailbox is linked to another user" {
+					c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+				} else {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to link mailbox"})
+				}
+				return
+			}
+			if err := tokenStore.Save(c, mailbox.ID, tok); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save token"})
+				return
+			}
+			c.Redirect(http.StatusTemporaryRedirect, login.ReturnTo)
+			return
+		}
+
+		user, mailbox, err := store.SignInMailbox(c, u.Email)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+			return
+		}
+		if err := tokenStore.Save(c, mailbox.ID, tok); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save token"})
 			return
 		}
 
-		http.SetCookie(c.Writer, &http.Cookie{
-			Name:     "session_user",
-			Value:    u.Email,
-			Path:     "/",
-			MaxAge:   3600 * 24, // Extend cookie to 24 hours
-			HttpOnly: true,
-			SameSite: http.SameSiteLaxMode,
-			Secure:   false, // Set to true in production with HTTPS
-		})
-		c.Redirect(http.StatusTemporaryRedirect, "http://localhost:3000/")
+		if err := startSession(c, sessions, user.ID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start session"})
+			return
+		}
+		c.Redirect(http.StatusTemporaryRedirect, login.ReturnTo)
 	})
 
 	authGroup := r.Group("/")
-	authGroup.Use(sessionMiddleware())
+	authGroup.Use(sessionMiddleware(sessions), server.mailboxMiddleware())
 	{
-		authGroup.POST("/logout", func(c *gin.Context) {
-			c.SetCookie("session_user", "", -1, "/", "", false, true)
-			c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
-		})
+		authGroup.POST("/logout", server.LogoutHandler)
+		authGroup.GET("/sessions", server.ListSessionsHandler)
+		authGroup.DELETE("/sessions/:id", server.RevokeSessionHandler)
+		authGroup.GET("/mailboxes", server.ListMailboxesHandler)
 
 		authGroup.GET("/healthz", func(c *gin.Context) { c.JSON(http.StatusOK, gin.H{"status": "ok"}) })
 
@@ -148,14 +202,42 @@ func NewRouter(cfg *config.Config, store DataStore, tokenStore *auth.TokenStore)
 		// --- Rule Routes ---
 		authGroup.GET("/rules", server.GetRulesHandler)
 		authGroup.POST("/rules", server.CreateRuleHandler)
+		authGroup.PUT("/rules/order", server.ReorderRulesHandler)
+		authGroup.POST("/rules/import", server.ImportGmailFiltersHandler)
+		authGroup.GET("/rules/export", server.ExportGmailFiltersHandler)
+		authGroup.POST("/rules/import/sieve", server.ImportSieveHandler)
+		authGroup.GET("/rules/export/sieve", server.ExportSieveHandler)
+		authGroup.POST("/rules/test", server.TestUnsavedRuleHandler)
 		authGroup.DELETE("/rules/:id", server.DeleteRuleHandler)
 		authGroup.PUT("/rules/:id", server.UpdateRuleHandler)
 		authGroup.PATCH("/rules/:id", server.UpdateRuleHandler)
+		authGroup.POST("/rules/:id/test", server.TestRuleHandler)
+
+		// --- Protected Sender Routes ---
+		authGroup.GET("/protected", server.GetProtectedSendersHandler)
+		authGroup.POST("/protected", server.CreateProtectedSenderHandler)
+		authGroup.DELETE("/protected/:id", server.DeleteProtectedSenderHandler)
 
 		// --- Clean Routes ---
 		authGroup.POST("/clean", server.CleanHandler)
 		authGroup.POST("/clean/preview", server.CleanPreviewHandler)
 		authGroup.GET("/clean/history", server.GetCleanHistoryHandler)
+		authGroup.POST("/clean/history/:id/undo", server.UndoCleanHandler)
+
+		// --- Quarantine Routes ---
+		authGroup.GET("/quarantine", server.GetQuarantineHandler)
+		authGroup.POST("/quarantine/:id/release", server.ReleaseQuarantineHandler)
+
+		// --- Automation Routes ---
+		authGroup.POST("/automation/run", server.RunAutomationHandler)
+		authGroup.POST("/automation/pause", server.PauseAutomationHandler)
+		authGroup.POST("/automation/resume", server.ResumeAutomationHandler)
+		authGroup.GET("/automation/runs", server.ListAutomationRunsHandler)
+		authGroup.GET("/automation/runs/:id", server.GetAutomationRunHandler)
+
+		// --- Job Routes ---
+		authGroup.GET("/jobs/:id", server.GetJobHandler)
+		authGroup.POST("/jobs/:id/cancel", server.CancelJobHandler)
 
 		// --- Other Feature Routes ---
 		authGroup.POST("/block-sender", server.BlockSenderHandler)
@@ -172,7 +254,7 @@ func NewRouter(cfg *config.Config, store DataStore, tokenStore *auth.TokenStore)
 	}
 
 	debugGroup := r.Group("/debug")
-	debugGroup.Use(sessionMiddleware())
+	debugGroup.Use(sessionMiddleware(sessions))
 	{
 		debugGroup.POST("/reset-db", server.ResetDBHandler)
 	}
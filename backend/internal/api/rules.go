@@ -1,9 +1,14 @@
 package api
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"net/textproto"
+	"time"
 
 	"backend/internal/database"
+	"backend/internal/rules"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -11,7 +16,7 @@ import (
 
 // GetRulesHandler fetches rules from the database.
 func (s *Server) GetRulesHandler(c *gin.Context) {
-	userEmail := getUserEmail(c)
+	userEmail := getMailboxID(c)
 	rules, err := s.store.ListRules(c.Request.Context(), userEmail)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch rules"})
@@ -20,31 +25,69 @@ func (s *Server) GetRulesHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"rules": rules})
 }
 
+// ruleRequest is the body accepted when creating or updating a rule.
+// Either a flat type/value pair or a conditions tree must be supplied.
+type ruleRequest struct {
+	Type       string           `json:"type"`
+	Value      string           `json:"value"`
+	Conditions *rules.Condition `json:"conditions"`
+	MatchOp    string           `json:"match_op"`
+	Action     string           `json:"action"`
+	AgeDays    int              `json:"age_days"`
+	Priority   *int             `json:"priority"`
+	Stop       bool             `json:"stop"`
+}
+
+// normalize validates the request and fills in defaults.
+func (req *ruleRequest) normalize() error {
+	if req.Conditions == nil {
+		if req.Type == "" || req.Value == "" {
+			return errors.New("either type and value or conditions are required")
+		}
+		req.Conditions = rules.Predicate(req.Type, req.Value)
+	} else if req.Type == "" {
+		// Compound rules have no single type/value pair
+		req.Type = "compound"
+	}
+	if req.MatchOp == "" {
+		req.MatchOp = rules.MatchContains
+	}
+	// Compiles any regex/glob patterns so bad ones are rejected up front
+	engineRule := rules.Rule{Condition: req.Conditions, MatchOp: req.MatchOp}
+	if err := engineRule.Validate(); err != nil {
+		return err
+	}
+	// Default action if not provided
+	if req.Action == "" {
+		req.Action = rules.ActionDelete
+	}
+	return rules.ValidateAction(req.Action)
+}
+
 // CreateRuleHandler creates a new rule in the database.
 func (s *Server) CreateRuleHandler(c *gin.Context) {
-	userEmail := getUserEmail(c)
-	var req struct {
-		Type    string `json:"type" binding:"required"`
-		Value   string `json:"value" binding:"required"`
-		Action  string `json:"action"`
-		AgeDays int    `json:"age_days"`
-	}
+	userEmail := getMailboxID(c)
+	var req ruleRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rule data: " + err.Error()})
 		return
 	}
-	// Default action if not provided
-	if req.Action == "" {
-		req.Action = "DELETE"
+	if err := req.normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rule data: " + err.Error()})
+		return
 	}
 
 	params := database.CreateRuleParams{
-		ID:      uuid.NewString(),
-		UserID:  userEmail,
-		Type:    req.Type,
-		Value:   req.Value,
-		Action:  req.Action,
-		AgeDays: req.AgeDays,
+		ID:         uuid.NewString(),
+		UserID:     userEmail,
+		Type:       req.Type,
+		Value:      req.Value,
+		Conditions: req.Conditions,
+		MatchOp:    req.MatchOp,
+		Action:     req.Action,
+		AgeDays:    req.AgeDays,
+		Priority:   req.Priority,
+		Stop:       req.Stop,
 	}
 
 	rule, err := s.store.CreateRule(c.Request.Context(), params)
@@ -58,7 +101,7 @@ func (s *Server) CreateRuleHandler(c *gin.Context) {
 
 // DeleteRuleHandler deletes a rule from the database.
 func (s *Server) DeleteRuleHandler(c *gin.Context) {
-	userEmail := getUserEmail(c)
+	userEmail := getMailboxID(c)
 	ruleID := c.Param("id")
 
 	err := s.store.DeleteRule(c.Request.Context(), ruleID, userEmail)
@@ -70,29 +113,37 @@ func (s *Server) DeleteRuleHandler(c *gin.Context) {
 		}
 		return
 	}
+	rules.Forget(ruleID)
 
 	c.JSON(http.StatusOK, gin.H{"message": "Rule deleted"})
 }
 
 // UpdateRuleHandler updates a rule in the database.
 func (s *Server) UpdateRuleHandler(c *gin.Context) {
-	userEmail := getUserEmail(c)
+	userEmail := getMailboxID(c)
 	ruleID := c.Param("id")
-	var req struct {
-		Type    string `json:"type" binding:"required"`
-		Value   string `json:"value" binding:"required"`
-		Action  string `json:"action"`
-		AgeDays int    `json:"age_days"`
-	}
+	var req ruleRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rule data"})
 		return
 	}
-	if req.Action == "" {
-		req.Action = "DELETE"
+	if err := req.normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rule data: " + err.Error()})
+		return
 	}
 
-	rule, err := s.store.UpdateRule(c.Request.Context(), ruleID, userEmail, req.Type, req.Value, req.Action, req.AgeDays)
+	rule, err := s.store.UpdateRule(c.Request.Context(), database.UpdateRuleParams{
+		ID:         ruleID,
+		UserID:     userEmail,
+		Type:       req.Type,
+		Value:      req.Value,
+		Conditions: req.Conditions,
+		MatchOp:    req.MatchOp,
+		Action:     req.Action,
+		AgeDays:    req.AgeDays,
+		Priority:   req.Priority,
+		Stop:       req.Stop,
+	})
 	if err != nil {
 		if err.Error() == "rule not found or not owned by user" {
 			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
@@ -101,6 +152,164 @@ func (s *Server) UpdateRuleHandler(c *gin.Context) {
 		}
 		return
 	}
+	// Drop patterns compiled for the previous version of the rule
+	rules.Forget(ruleID)
 
 	c.JSON(http.StatusOK, gin.H{"message": "Rule updated", "rule": rule})
 }
+
+// ReorderRulesHandler sets rule priorities from an ordered list of rule IDs.
+// The first ID is evaluated first.
+func (s *Server) ReorderRulesHandler(c *gin.Context) {
+	userEmail := getMailboxID(c)
+	var req struct {
+		RuleIDs []string `json:"rule_ids" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rule order: " + err.Error()})
+		return
+	}
+
+	ordered, err := s.store.ReorderRules(c.Request.Context(), userEmail, req.RuleIDs)
+	if err != nil {
+		switch err.Error() {
+		case "rule not found or not owned by user":
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case "rule order must list every rule exactly once":
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reorder rules"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Rules reordered", "rules": ordered})
+}
+
+// ruleTestLimit caps how many cached emails one rule test evaluates
+const ruleTestLimit = 1000
+
+// ruleTestRequest selects the emails a rule is tested against: a single
+// supplied email, a list of cached email IDs, or (by default) the newest
+// ruleTestLimit cached emails. Only matching emails are returned unless
+// IncludeUnmatched is set.
+type ruleTestRequest struct {
+	Email            *database.Email `json:"email"`
+	EmailIDs         []string        `json:"email_ids"`
+	IncludeUnmatched bool            `json:"include_unmatched"`
+}
+
+// TestRuleHandler explains how a saved rule evaluates against emails.
+func (s *Server) TestRuleHandler(c *gin.Context) {
+	userEmail := getMailboxID(c)
+	dbRule, err := s.store.GetRule(c.Request.Context(), c.Param("id"), userEmail)
+	if err != nil {
+		if err.Error() == "rule not found or not owned by user" {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch rule"})
+		}
+		return
+	}
+
+	var req ruleTestRequest
+	// An empty body tests against every cached email
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid test request: " + err.Error()})
+			return
+		}
+	}
+	s.respondRuleTest(c, dbRule.EngineRule(), req)
+}
+
+// TestUnsavedRuleHandler explains how a rule body that has not been saved
+// yet would evaluate against emails.
+func (s *Server) TestUnsavedRuleHandler(c *gin.Context) {
+	var req struct {
+		Rule ruleRequest `json:"rule"`
+		ruleTestRequest
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid test request: " + err.Error()})
+		return
+	}
+	if err := req.Rule.normalize(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rule data: " + err.Error()})
+		return
+	}
+	s.respondRuleTest(c, rules.Rule{
+		Type:      req.Rule.Type,
+		Value:     req.Rule.Value,
+		Condition: req.Rule.Conditions,
+		MatchOp:   req.Rule.MatchOp,
+		Action:    req.Rule.Action,
+		AgeDays:   req.Rule.AgeDays,
+		Stop:      req.Rule.Stop,
+	}, req.ruleTestRequest)
+}
+
+// respondRuleTest runs the rule against the selected emails and writes the
+// per-email explanations.
+func (s *Server) respondRuleTest(c *gin.Context, rule rules.Rule, req ruleTestRequest) {
+	userEmail := getMailboxID(c)
+
+	var emails []database.Email
+	truncated := false
+	switch {
+	case req.Email != nil:
+		if req.Email.Date.IsZero() {
+			req.Email.Date = time.Now()
+		}
+		// Stored headers are keyed by canonical name, which Email.Header relies on
+		headers := make(map[string]string, len(req.Email.Headers))
+		for k, v := range req.Email.Headers {
+			headers[textproto.CanonicalMIMEHeaderKey(k)] = v
+		}
+		req.Email.Headers = headers
+		emails = []database.Email{*req.Email}
+	case len(req.EmailIDs) > 0:
+		if len(req.EmailIDs) > ruleTestLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("at most %d email_ids can be tested at once", ruleTestLimit)})
+			return
+		}
+		var err error
+		if emails, err = s.store.GetEmailsByIDs(c.Request.Context(), userEmail, req.EmailIDs); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not fetch emails"})
+			return
+		}
+	default:
+		var total int
+		var err error
+		if emails, total, err = s.store.ListEmails(c.Request.Context(), userEmail, 1, ruleTestLimit, ""); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not fetch emails"})
+			return
+		}
+		truncated = total > len(emails)
+	}
+
+	results := []gin.H{}
+	matched := 0
+	for _, e := range emails {
+		exp := rules.Explain(e.EngineEmail(), rule)
+		if exp.Matched {
+			matched++
+		} else if !req.IncludeUnmatched && req.Email == nil {
+			continue
+		}
+		results = append(results, gin.H{
+			"id":          e.ID,
+			"sender":      e.Sender,
+			"subject":     e.Subject,
+			"date":        e.Date,
+			"explanation": exp,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"tested":    len(emails),
+		"matched":   matched,
+		"truncated": truncated,
+		"results":   results,
+	})
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"net/http"
+
+	"backend/internal/auth"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// sessionCookie holds the opaque session token
+const sessionCookie = "session_id"
+
+// Context keys set by sessionMiddleware
+const (
+	ctxUserID  = "user_id"
+	ctxSession = "session"
+)
+
+// sessionMiddleware resolves the session cookie to its user. Requests
+// without a live session are rejected.
+func sessionMiddleware(sessions *auth.SessionStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, _ := c.Cookie(sessionCookie)
+		sess, err := sessions.Lookup(c.Request.Context(), token)
+		if err != nil {
+			log.Errorf("Failed to look up session: %v", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to check session"})
+			return
+		}
+		if sess == nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Not authenticated"})
+			return
+		}
+		c.Set(ctxUserID, sess.UserID)
+		c.Set(ctxSession, sess)
+		c.Next()
+	}
+}
+
+// getUserID returns the signed-in user, as resolved by sessionMiddleware.
+func getUserID(c *gin.Context) string {
+	return c.GetString(ctxUserID)
+}
+
+// currentSession returns the session sessionMiddleware resolved
+func currentSession(c *gin.Context) *auth.Session {
+	sess, _ := c.Get(ctxSession)
+	s, _ := sess.(*auth.Session)
+	return s
+}
+
+// startSession signs the user in with a new session, ending the one the
+// browser had so a login always rotates the session ID.
+func startSession(c *gin.Context, sessions *auth.SessionStore, userID string) error {
+	if token, _ := c.Cookie(sessionCookie); token != "" {
+		if old, err := sessions.Lookup(c.Request.Context(), token); err == nil && old != nil {
+			_, _ = sessions.Revoke(c.Request.Context(), old.UserID, old.ID)
+		}
+	}
+	token, _, err := sessions.Create(c.Request.Context(), userID, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		return err
+	}
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(sessions.TTL().Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   false, // Set to true in production with HTTPS
+	})
+	return nil
+}
+
+// LogoutHandler revokes the current session and clears its cookie.
+func (s *Server) LogoutHandler(c *gin.Context) {
+	sess := currentSession(c)
+	if _, err := s.sessions.Revoke(c.Request.Context(), sess.UserID, sess.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+	c.SetCookie(sessionCookie, "", -1, "/", "", false, true)
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+// ListSessionsHandler lists the user's active sessions and marks the one
+// making the request.
+func (s *Server) ListSessionsHandler(c *gin.Context) {
+	sessions, err := s.sessions.List(c.Request.Context(), getUserID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch sessions"})
+		return
+	}
+	if sessions == nil {
+		sessions = []auth.Session{}
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions, "current": currentSession(c).ID})
+}
+
+// RevokeSessionHandler signs out one of the user's sessions, e.g. a lost
+// device. Revoking the current session also clears its cookie.
+func (s *Server) RevokeSessionHandler(c *gin.Context) {
+	id := c.Param("id")
+	ok, err := s.sessions.Revoke(c.Request.Context(), getUserID(c), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+	if id == currentSession(c).ID {
+		c.SetCookie(sessionCookie, "", -1, "/", "", false, true)
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+}
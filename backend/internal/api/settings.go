@@ -2,22 +2,22 @@ package api
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"backend/internal/database"
+	"backend/internal/schedule"
 
 	"github.com/gin-gonic/gin"
 	"google.golang.org/api/gmail/v1"
 	"google.golang.org/api/option"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/oauth2"
 )
 
 func (s *Server) GetSettingsHandler(c *gin.Context) {
-	userEmail := getUserEmail(c)
+	userEmail := getMailboxID(c)
 	settings, err := s.store.GetUserSettings(c.Request.Context(), userEmail)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user settings: " + err.Error()})
@@ -26,27 +26,117 @@ func (s *Server) GetSettingsHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, settings)
 }
 
+// UpdateSettingsHandler changes the fields present in the request and keeps
+// the rest. A cron schedule makes the frequency "custom"; otherwise the
+// schedule is rebuilt from the frequency, time and weekday whenever one of
+// them changes, except that a custom schedule is kept until a new frequency
+// or cron replaces it.
 func (s *Server) UpdateSettingsHandler(c *gin.Context) {
-	userEmail := getUserEmail(c)
+	userEmail := getMailboxID(c)
 	var req struct {
-		Enabled   bool   `json:"automation_enabled"`
-		Frequency string `json:"automation_frequency"`
-		TimeOfDay string `json:"automation_time"`
+		Enabled   *bool   `json:"automation_enabled"`
+		Frequency *string `json:"automation_frequency"`
+		TimeOfDay *string `json:"automation_time"`
+		DayOfWeek *string `json:"automation_day_of_week"`
+		Cron      *string `json:"automation_cron"` // 5-field cron; overrides frequency and time
+		Timezone  *string `json:"timezone"`        // IANA name; empty keeps the current zone
+
+		// Safety limits for automated cleans
+		MaxEmailsPerRun   *int  `json:"max_emails_per_run"`  // 0 means no limit
+		MaxMailboxPercent *int  `json:"max_mailbox_percent"` // 0 means no limit
+		QuarantineEnabled *bool `json:"quarantine_enabled"`
+		QuarantineDays    *int  `json:"quarantine_days"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid settings data"})
 		return
 	}
-    settings, err := s.store.UpdateUserSettings(c.Request.Context(), userEmail, req.Enabled, req.Frequency, req.TimeOfDay)
+	if (req.MaxEmailsPerRun != nil && *req.MaxEmailsPerRun < 0) ||
+		(req.MaxMailboxPercent != nil && (*req.MaxMailboxPercent < 0 || *req.MaxMailboxPercent > 100)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid safety limit"})
+		return
+	}
+	if req.QuarantineDays != nil && (*req.QuarantineDays < 1 || *req.QuarantineDays > 90) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Quarantine must last between 1 and 90 days"})
+		return
+	}
+
+	current, err := s.store.GetUserSettings(c.Request.Context(), userEmail)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user settings"})
+		return
+	}
+	params := database.UpdateUserSettingsParams{
+		UserID:    userEmail,
+		Enabled:   current.AutomationEnabled,
+		Frequency: current.AutomationFrequency,
+		TimeOfDay: current.AutomationTime,
+		DayOfWeek: current.AutomationDayOfWeek,
+		Cron:      current.AutomationCron,
+		Timezone:  current.Timezone,
+
+		MaxEmailsPerRun:   req.MaxEmailsPerRun,
+		MaxMailboxPercent: req.MaxMailboxPercent,
+		QuarantineEnabled: req.QuarantineEnabled,
+		QuarantineDays:    req.QuarantineDays,
+	}
+	if req.Enabled != nil {
+		params.Enabled = *req.Enabled
+	}
+	if req.Timezone != nil && *req.Timezone != "" {
+		loc, err := schedule.LoadLocation(*req.Timezone)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timezone: " + err.Error()})
+			return
+		}
+		params.Timezone = loc.String()
+	}
+
+	frequencyChanged := req.Frequency != nil || req.TimeOfDay != nil || req.DayOfWeek != nil
+	if req.Frequency != nil {
+		params.Frequency = *req.Frequency
+	}
+	if req.TimeOfDay != nil {
+		params.TimeOfDay = *req.TimeOfDay
+	}
+	if req.DayOfWeek != nil {
+		params.DayOfWeek = strings.ToLower(*req.DayOfWeek)
+	}
+	switch {
+	case req.Cron != nil && *req.Cron != "":
+		cron, err := schedule.ParseCron(*req.Cron)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid schedule: " + err.Error()})
+			return
+		}
+		// The cron is the schedule now; a stale frequency would contradict it
+		params.Cron = cron.String()
+		params.Frequency = "custom"
+	case params.Frequency == "custom" && req.Frequency == nil && req.Cron != nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid schedule: an automation frequency is required to leave a custom schedule"})
+		return
+	case params.Frequency == "custom" && req.Frequency == nil:
+		// The time and weekday don't apply to a custom schedule; keep it
+	case req.Cron != nil || frequencyChanged:
+		// Older clients send only a frequency, time and weekday
+		cron, err := schedule.FromFrequency(params.Frequency, params.TimeOfDay, params.DayOfWeek)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid schedule: " + err.Error()})
+			return
+		}
+		params.Cron = cron
+	}
+
+	settings, err := s.store.UpdateUserSettings(c.Request.Context(), params)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user settings"})
 		return
 	}
-    c.JSON(http.StatusOK, settings)
+	c.JSON(http.StatusOK, settings)
 }
 
 func (s *Server) SyncHistoryHandler(c *gin.Context) {
-	userEmail := getUserEmail(c)
+	userEmail := getMailboxID(c)
 	ctx := c.Request.Context()
 	defer s.clearSyncProgress(userEmail)
 	
@@ -71,7 +161,7 @@ func (s *Server) SyncHistoryHandler(c *gin.Context) {
 		return
 	}
 
-	historyResponse, err := gmailService.Users.History.List(userEmail).StartHistoryId(settings.LastHistoryID).Do()
+	historyResponse, err := gmailService.Users.History.List("me").StartHistoryId(settings.LastHistoryID).Do()
 	if err != nil {
 		log.Warnf("Failed to retrieve history for user %s (history ID may be too old): %v", userEmail, err)
 		log.Infof("Falling back to query-based sync for user %s", userEmail)
@@ -100,7 +190,7 @@ func (s *Server) SyncHistoryHandler(c *gin.Context) {
 				if processedIds[msg.Message.Id] {
 					continue
 				}
-				fullMsg, err := gmailService.Users.Messages.Get(userEmail, msg.Message.Id).Format("full").Do()
+				fullMsg, err := gmailService.Users.Messages.Get("me", msg.Message.Id).Format("full").Do()
 				if err != nil {
 					log.Errorf("Failed to get message %s: %v", msg.Message.Id, err)
 					continue
@@ -125,7 +215,7 @@ func (s *Server) SyncHistoryHandler(c *gin.Context) {
 					}
 				}
 				if hasInbox {
-					fullMsg, err := gmailService.Users.Messages.Get(userEmail, labelAdded.Message.Id).Format("full").Do()
+					fullMsg, err := gmailService.Users.Messages.Get("me", labelAdded.Message.Id).Format("full").Do()
 					if err != nil {
 						log.Errorf("Failed to get message %s after label addition: %v", labelAdded.Message.Id, err)
 						continue
@@ -231,7 +321,7 @@ func (s *Server) fallbackSync(c *gin.Context, userEmail string, ctx context.Cont
 		// Get a message to extract history ID
 		initIds, err := emailService.ListMessageIDs("me", "", []string{"INBOX"}, 1)
 		if err == nil && len(initIds) > 0 {
-			msg, err := gmailService.Users.Messages.Get(userEmail, initIds[0]).Format("minimal").Do()
+			msg, err := gmailService.Users.Messages.Get("me", initIds[0]).Format("minimal").Do()
 			if err == nil && msg.HistoryId > 0 {
 				_ = s.store.UpdateHistoryID(ctx, userEmail, msg.HistoryId)
 				log.Infof("Initialized history ID to %d for user %s", msg.HistoryId, userEmail)
@@ -281,15 +371,12 @@ func (s *Server) fallbackSync(c *gin.Context, userEmail string, ctx context.Cont
 
 // getGmailService creates a Gmail service for the given user
 func (s *Server) getGmailService(ctx context.Context, userEmail string) (*gmail.Service, error) {
-	tok, err := s.tokenStore.Get(ctx, userEmail)
+	tokenSource, err := s.tokenStore.TokenSource(ctx, oauthConf, userEmail)
 	if err != nil {
 		return nil, err
 	}
-	if tok == nil {
-		return nil, errors.New("no token for user")
-	}
 
-	srv, err := gmail.NewService(ctx, option.WithTokenSource(oauth2.StaticTokenSource(tok)))
+	srv, err := gmail.NewService(ctx, option.WithTokenSource(tokenSource))
 	if err != nil {
 		return nil, err
 	}
@@ -359,6 +446,8 @@ func (s *Server) gmailMessagesToEmails(messages []*gmail.Message, userEmail stri
 			Snippet: snippet,
 			Date:    date,
 			Read:    isRead,
+			Headers: s.extractSyncHeaders(msg),
+			Labels:  msg.LabelIds,
 		})
 	}
 	return emails
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"backend/internal/rules/sieve"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxSieveScriptSize bounds uploaded Sieve scripts
+const maxSieveScriptSize = 1 << 20
+
+// ImportSieveHandler creates rules from a Sieve script sent as the raw
+// request body. With ?dry_run=true nothing is saved.
+func (s *Server) ImportSieveHandler(c *gin.Context) {
+	userEmail := getMailboxID(c)
+	dryRun := c.Query("dry_run") == "true"
+
+	script, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxSieveScriptSize))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read script: " + err.Error()})
+		return
+	}
+	imported, report, err := sieve.Import(string(script))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	toCreate := make([]importedRule, len(imported))
+	for i, im := range imported {
+		toCreate[i] = importedRule{Entry: im.Entry, Params: im.Params}
+	}
+	created, rejected, err := s.createImportedRules(c.Request.Context(), userEmail, toCreate, dryRun)
+	for _, r := range rejected {
+		report.Issues = append(report.Issues, sieve.Issue{Entry: r.Entry, Reason: r.Reason, Skipped: true})
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create rules; none were imported", "report": report})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"dry_run":  dryRun,
+		"imported": len(created),
+		"rules":    created,
+		"report":   report,
+	})
+}
+
+// ExportSieveHandler downloads the user's rules as a Sieve script. Rules
+// that could not be exported are listed in the X-Unexported-Rules header,
+// or in the body with ?format=json.
+func (s *Server) ExportSieveHandler(c *gin.Context) {
+	userEmail := getMailboxID(c)
+	ruleset, err := s.store.ListRules(c.Request.Context(), userEmail)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch rules"})
+		return
+	}
+
+	script, report := sieve.Export(ruleset)
+	if c.Query("format") == "json" {
+		c.JSON(http.StatusOK, gin.H{"script": script, "report": report})
+		return
+	}
+
+	var skipped []string
+	for _, issue := range report.Issues {
+		if issue.Skipped {
+			skipped = append(skipped, issue.Entry)
+		}
+	}
+	if len(skipped) > 0 {
+		c.Header("X-Unexported-Rules", strings.Join(skipped, ","))
+	}
+	c.Header("Content-Disposition", `attachment; filename="mailcleaner.sieve"`)
+	c.Data(http.StatusOK, "application/sieve; charset=utf-8", []byte(script))
+}
@@ -10,7 +10,7 @@ import (
 
 // GetStatsHandler fetches various counts for the dashboard.
 func (s *Server) GetStatsHandler(c *gin.Context) {
-	userEmail := getUserEmail(c)
+	userEmail := getMailboxID(c)
 	ctx := c.Request.Context()
 
 	emailService, err := s.getEmailService(c)
@@ -8,7 +8,7 @@ import (
 
 // GetSyncProgressHandler returns the current sync progress for the authenticated user
 func (s *Server) GetSyncProgressHandler(c *gin.Context) {
-	userEmail := getUserEmail(c)
+	userEmail := getMailboxID(c)
 	progress := s.getSyncProgress(userEmail)
 	c.JSON(http.StatusOK, progress)
 }
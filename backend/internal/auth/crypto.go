@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Keyring encrypts stored tokens with envelope encryption: each token is
+// sealed with its own random data key, and the data key is sealed with a
+// key from the keyring. Rotating keys only re-seals the data keys.
+type Keyring struct {
+	keys     map[string]cipher.AEAD
+	activeID string
+}
+
+// envelope is how an encrypted token is stored. A stored value without a
+// key ID is a token saved before encryption was enabled.
+type envelope struct {
+	KeyID string `json:"kid"`
+	DEK   []byte `json:"dek"`  // nonce followed by the sealed data key
+	Data  []byte `json:"data"` // nonce followed by the sealed token
+}
+
+// NewKeyring creates a keyring from 32-byte AES keys by ID. New tokens are
+// sealed with activeID; the other keys can still open older tokens.
+func NewKeyring(keys map[string][]byte, activeID string) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD, len(keys)), activeID: activeID}
+	for id, key := range keys {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		k.keys[id] = aead
+	}
+	if k.keys[activeID] == nil {
+		return nil, fmt.Errorf("unknown active key %q", activeID)
+	}
+	return k, nil
+}
+
+// seal encrypts plaintext for the given Redis key, which is bound to the
+// ciphertext so it can't be moved to another user.
+func (k *Keyring) seal(plaintext []byte, key string) ([]byte, error) {
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, err
+	}
+	data, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+	env := envelope{KeyID: k.activeID, Data: sealWith(data, plaintext, []byte(key))}
+	env.DEK = sealWith(k.keys[k.activeID], dek, []byte(k.activeID))
+	return json.Marshal(env)
+}
+
+// open decrypts a stored value. plain is true if the value was stored
+// unencrypted and is returned as is.
+func (k *Keyring) open(stored []byte, key string) (plaintext []byte, plain bool, err error) {
+	env, ok := parseEnvelope(stored)
+	if !ok {
+		return stored, true, nil
+	}
+	dek, err := k.openDEK(env)
+	if err != nil {
+		return nil, false, err
+	}
+	data, err := newAEAD(dek)
+	if err != nil {
+		return nil, false, err
+	}
+	plaintext, err = openWith(data, env.Data, []byte(key))
+	return plaintext, false, err
+}
+
+// rewrap re-seals a stored value's data key with the active key, and
+// encrypts a value stored unencrypted. changed is false if the value was
+// already sealed with the active key.
+func (k *Keyring) rewrap(stored []byte, key string) (out []byte, changed bool, err error) {
+	env, ok := parseEnvelope(stored)
+	if !ok {
+		out, err = k.seal(stored, key)
+		return out, err == nil, err
+	}
+	if env.KeyID == k.activeID {
+		return stored, false, nil
+	}
+	dek, err := k.openDEK(env)
+	if err != nil {
+		return nil, false, err
+	}
+	env.KeyID = k.activeID
+	env.DEK = sealWith(k.keys[k.activeID], dek, []byte(k.activeID))
+	out, err = json.Marshal(env)
+	return out, err == nil, err
+}
+
+func (k *Keyring) openDEK(env envelope) ([]byte, error) {
+	kek := k.keys[env.KeyID]
+	if kek == nil {
+		return nil, fmt.Errorf("token is encrypted with unknown key %q", env.KeyID)
+	}
+	return openWith(kek, env.DEK, []byte(env.KeyID))
+}
+
+func parseEnvelope(stored []byte) (envelope, bool) {
+	var env envelope
+	if err := json.Unmarshal(stored, &env); err != nil || env.KeyID == "" {
+		return env, false
+	}
+	return env, true
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealWith encrypts with a fresh random nonce, prepended to the result
+func sealWith(aead cipher.AEAD, plaintext, aad []byte) []byte {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err) // crypto/rand does not fail on supported platforms
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad)
+}
+
+func openWith(aead cipher.AEAD, sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, aad)
+}
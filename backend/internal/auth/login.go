@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/oauth2"
+)
+
+// loginTTL is how long a user has to finish the Google consent screen
+const loginTTL = 10 * time.Minute
+
+// LoginState is what a login started with, kept until its callback.
+type LoginState struct {
+	Verifier string `json:"verifier"`  // PKCE code verifier
+	ReturnTo string `json:"return_to"` // validated page to land on afterwards
+	LinkTo   string `json:"link_to"`   // user to link the mailbox to; empty signs in
+}
+
+func loginKey(state string) string {
+	return "oauth_state:" + state
+}
+
+// BeginLogin starts an OAuth login and returns its random state parameter
+// and PKCE verifier. The state can be finished once, within loginTTL. With
+// linkTo set the Google account is linked to that user as another mailbox
+// instead of signing in.
+func (s *SessionStore) BeginLogin(ctx context.Context, returnTo, linkTo string) (string, *LoginState, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, err
+	}
+	state := base64.RawURLEncoding.EncodeToString(raw)
+	login := &LoginState{Verifier: oauth2.GenerateVerifier(), ReturnTo: returnTo, LinkTo: linkTo}
+	data, err := json.Marshal(login)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := s.rdb.Set(ctx, loginKey(state), data, loginTTL).Err(); err != nil {
+		return "", nil, err
+	}
+	return state, login, nil
+}
+
+// FinishLogin consumes a login's state. It returns nil if the state is
+// unknown, expired or was already used.
+func (s *SessionStore) FinishLogin(ctx context.Context, state string) (*LoginState, error) {
+	if state == "" {
+		return nil, nil
+	}
+	var get *redis.StringCmd
+	_, err := s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		get = pipe.Get(ctx, loginKey(state))
+		pipe.Del(ctx, loginKey(state))
+		return nil
+	})
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var login LoginState
+	if err := json.Unmarshal([]byte(get.Val()), &login); err != nil {
+		return nil, err
+	}
+	return &login, nil
+}
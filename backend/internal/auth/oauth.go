@@ -3,47 +3,194 @@ package auth
 import (
 	"context"
 	"encoding/json"
-	"time"
+	"errors"
+	"fmt"
+	"sync"
 
 	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
 )
 
 type TokenStore struct {
-	rdb *redis.Client
+	rdb     *redis.Client
+	keyring *Keyring // nil stores tokens unencrypted
 }
 
-func NewTokenStore(rdb *redis.Client) *TokenStore {
-	return &TokenStore{rdb: rdb}
+// NewTokenStore creates a token store. With a keyring tokens are encrypted
+// at rest; tokens stored before encryption was enabled can still be read.
+func NewTokenStore(rdb *redis.Client, keyring *Keyring) *TokenStore {
+	return &TokenStore{rdb: rdb, keyring: keyring}
+}
+
+func tokenKey(userID string) string {
+	return "token:" + userID
 }
 
 // Save serializes the entire token object to JSON and saves it in Redis.
+// The key does not expire: the refresh token outlives the access token and
+// is what lets automation keep running. A token without a refresh token,
+// such as one from a refresh, keeps the stored refresh token.
 func (t *TokenStore) Save(ctx context.Context, userID string, tok *oauth2.Token) error {
+	if tok.RefreshToken == "" {
+		old, err := t.Get(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if old != nil {
+			copied := *tok
+			copied.RefreshToken = old.RefreshToken
+			tok = &copied
+		}
+	}
 	// Serialize token to JSON
 	tokenJSON, err := json.Marshal(tok)
 	if err != nil {
 		return err
 	}
-	// Save the JSON string to Redis with the original expiry
-	return t.rdb.Set(ctx, "token:"+userID, tokenJSON, time.Until(tok.Expiry)).Err()
+	if t.keyring != nil {
+		if tokenJSON, err = t.keyring.seal(tokenJSON, tokenKey(userID)); err != nil {
+			return err
+		}
+	}
+	return t.rdb.Set(ctx, tokenKey(userID), tokenJSON, 0).Err()
 }
 
 // Get retrieves the token from Redis and deserializes it from JSON.
 func (t *TokenStore) Get(ctx context.Context, userID string) (*oauth2.Token, error) {
 	// Get the JSON string from Redis
-	tokenJSON, err := t.rdb.Get(ctx, "token:"+userID).Result()
+	tokenJSON, err := t.rdb.Get(ctx, tokenKey(userID)).Bytes()
 	if err != nil {
 		if err == redis.Nil {
 			return nil, nil // Return nil, nil if token not found
 		}
 		return nil, err
 	}
+	if t.keyring != nil {
+		if tokenJSON, _, err = t.keyring.open(tokenJSON, tokenKey(userID)); err != nil {
+			return nil, fmt.Errorf("could not decrypt token: %w", err)
+		}
+	} else if _, sealed := parseEnvelope(tokenJSON); sealed {
+		// Otherwise the envelope would decode as an empty token
+		return nil, errors.New("encrypted token but no keyring configured")
+	}
 
 	// Deserialize JSON back to a token object
 	var tok oauth2.Token
-	if err := json.Unmarshal([]byte(tokenJSON), &tok); err != nil {
+	if err := json.Unmarshal(tokenJSON, &tok); err != nil {
 		return nil, err
 	}
 
 	return &tok, nil
 }
+
+// Move re-keys a token stored under one ID to another, e.g. from a Gmail
+// address to its mailbox ID. It does nothing if there is no token under
+// from or one already exists under to.
+func (t *TokenStore) Move(ctx context.Context, from, to string) error {
+	if n, err := t.rdb.Exists(ctx, tokenKey(to)).Result(); err != nil || n > 0 {
+		return err
+	}
+	tok, err := t.Get(ctx, from)
+	if err != nil || tok == nil {
+		return err
+	}
+	// Saved rather than renamed: encrypted tokens are bound to their key
+	if err := t.Save(ctx, to, tok); err != nil {
+		return err
+	}
+	return t.rdb.Del(ctx, tokenKey(from)).Err()
+}
+
+// ReEncrypt seals every stored token with the keyring's active key,
+// including tokens stored unencrypted, so retired keys can be removed. A
+// token saved while it runs is left to that save. It returns how many
+// tokens were rewritten.
+func (t *TokenStore) ReEncrypt(ctx context.Context) (int, error) {
+	if t.keyring == nil {
+		return 0, errors.New("no encryption keys configured")
+	}
+	rewritten := 0
+	iter := t.rdb.Scan(ctx, 0, tokenKey("*"), 100).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		err := t.rdb.Watch(ctx, func(tx *redis.Tx) error {
+			stored, err := tx.Get(ctx, key).Bytes()
+			if err != nil {
+				return err
+			}
+			out, changed, err := t.keyring.rewrap(stored, key)
+			if err != nil || !changed {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, key, out, redis.KeepTTL)
+				return nil
+			})
+			if err == nil {
+				rewritten++
+			}
+			return err
+		}, key)
+		if err == redis.Nil || err == redis.TxFailedErr {
+			continue // deleted or saved again meanwhile
+		}
+		if err != nil {
+			return rewritten, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return rewritten, iter.Err()
+}
+
+// TokenSource returns a source for the user's stored token. With an OAuth
+// config the access token is refreshed when it expires and every refreshed
+// token is saved back, so the next caller starts from it; without one the
+// stored token is used as is.
+func (t *TokenStore) TokenSource(ctx context.Context, conf *oauth2.Config, userID string) (oauth2.TokenSource, error) {
+	tok, err := t.Get(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if tok == nil {
+		return nil, errors.New("no token for user")
+	}
+	if conf == nil {
+		return oauth2.StaticTokenSource(tok), nil
+	}
+	return &persistingSource{
+		ctx:    context.WithoutCancel(ctx),
+		store:  t,
+		userID: userID,
+		src:    conf.TokenSource(ctx, tok),
+		last:   tok.AccessToken,
+	}, nil
+}
+
+// persistingSource saves tokens its source refreshed
+type persistingSource struct {
+	ctx    context.Context
+	store  *TokenStore
+	userID string
+	src    oauth2.TokenSource
+
+	mu   sync.Mutex
+	last string // access token last seen
+}
+
+func (p *persistingSource) Token() (*oauth2.Token, error) {
+	tok, err := p.src.Token()
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if tok.AccessToken != p.last {
+		// A failed save only costs another refresh later
+		if err := p.store.Save(p.ctx, p.userID, tok); err != nil {
+			log.Warnf("Could not save refreshed token for user %s: %v", p.userID, err)
+		} else {
+			p.last = tok.AccessToken
+		}
+	}
+	return tok, nil
+}
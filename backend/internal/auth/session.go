@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Session is a signed-in browser. The cookie holds a random token; Redis
+// only stores its hash, which doubles as the session's public ID, so
+// neither a Redis dump nor the session list can be replayed as a cookie.
+type Session struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// SessionStore keeps sessions in Redis until they expire or are revoked.
+type SessionStore struct {
+	rdb *redis.Client
+	ttl time.Duration
+}
+
+func NewSessionStore(rdb *redis.Client, ttl time.Duration) *SessionStore {
+	return &SessionStore{rdb: rdb, ttl: ttl}
+}
+
+// TTL is how long a session lasts.
+func (s *SessionStore) TTL() time.Duration {
+	return s.ttl
+}
+
+func sessionKey(id string) string {
+	return "session:" + id
+}
+
+// userSessionsKey indexes a user's session IDs for listing
+func userSessionsKey(userID string) string {
+	return "sessions:" + userID
+}
+
+// sessionID derives the stored ID from the cookie token
+func sessionID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Create starts a session for the user and returns the token for the
+// session cookie.
+func (s *SessionStore) Create(ctx context.Context, userID, userAgent, ip string) (string, *Session, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", nil, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	now := time.Now().UTC()
+	sess := &Session{
+		ID:        sessionID(token),
+		UserID:    userID,
+		UserAgent: userAgent,
+		IP:        ip,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.ttl),
+	}
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return "", nil, err
+	}
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, sessionKey(sess.ID), data, s.ttl)
+		pipe.SAdd(ctx, userSessionsKey(userID), sess.ID)
+		pipe.Expire(ctx, userSessionsKey(userID), s.ttl) // the index outlives no session
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return token, sess, nil
+}
+
+// Lookup returns the session for a cookie token, or nil if it expired or
+// was revoked.
+func (s *SessionStore) Lookup(ctx context.Context, token string) (*Session, error) {
+	if token == "" {
+		return nil, nil
+	}
+	return s.get(ctx, sessionID(token))
+}
+
+func (s *SessionStore) get(ctx context.Context, id string) (*Session, error) {
+	data, err := s.rdb.Get(ctx, sessionKey(id)).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var sess Session
+	if err := json.Unmarshal(data, &sess); err != nil {
+		return nil, err
+	}
+	return &sess, nil
+}
+
+// List returns the user's active sessions, newest first.
+func (s *SessionStore) List(ctx context.Context, userID string) ([]Session, error) {
+	ids, err := s.rdb.SMembers(ctx, userSessionsKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var sessions []Session
+	for _, id := range ids {
+		sess, err := s.get(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if sess == nil {
+			// Expired; drop it from the index
+			s.rdb.SRem(ctx, userSessionsKey(userID), id)
+			continue
+		}
+		sessions = append(sessions, *sess)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.After(sessions[j].CreatedAt) })
+	return sessions, nil
+}
+
+// Revoke ends one of the user's sessions. It returns false if the user has
+// no such session.
+func (s *SessionStore) Revoke(ctx context.Context, userID, id string) (bool, error) {
+	sess, err := s.get(ctx, id)
+	if err != nil || sess == nil || sess.UserID != userID {
+		return false, err
+	}
+	_, err = s.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, sessionKey(id))
+		pipe.SRem(ctx, userSessionsKey(userID), id)
+		return nil
+	})
+	return err == nil, err
+}
@@ -0,0 +1,168 @@
+package cleaner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"backend/internal/database"
+	"backend/internal/rules"
+)
+
+// ActionError reports which planned action failed for an email.
+type ActionError struct {
+	EmailID string
+	Action  string
+	Index   int // position of the failed action in the plan
+	Err     error
+}
+
+func (e *ActionError) Error() string {
+	return fmt.Sprintf("action %s failed for email %s: %v", e.Action, e.EmailID, e.Err)
+}
+
+func (e *ActionError) Unwrap() error { return e.Err }
+
+// ApplyRuleActions performs the planned actions on one email in order and
+// drops it from the local cache unless only its labels changed. It stops at
+// the first failing action and reports it as an *ActionError.
+func ApplyRuleActions(ctx context.Context, store Store, svc EmailService, emailID string, actions []rules.AppliedAction, permanentDelete bool) error {
+	keepCached := true
+	for i, applied := range actions {
+		var err error
+		kind, label := rules.ParseAction(applied.Action)
+		switch kind {
+		case rules.ActionDelete:
+			if permanentDelete {
+				err = svc.DeleteMessagePermanently("me", emailID)
+			} else {
+				err = svc.TrashMessage("me", emailID)
+			}
+		case rules.ActionArchive:
+			err = svc.ArchiveMessage("me", emailID)
+		case rules.ActionMarkRead:
+			err = svc.MarkRead("me", emailID)
+		case rules.ActionAddLabel:
+			err = svc.AddLabel("me", emailID, label)
+		case rules.ActionRemoveLabel:
+			err = svc.RemoveLabel("me", emailID, label)
+		}
+		if err != nil {
+			return &ActionError{EmailID: emailID, Action: applied.Action, Index: i, Err: err}
+		}
+		// Labelled emails stay in the inbox, so keep them in the local cache
+		if kind != rules.ActionAddLabel && kind != rules.ActionRemoveLabel {
+			keepCached = false
+		}
+	}
+	if !keepCached {
+		_ = store.DeleteEmail(ctx, emailID)
+	}
+	return nil
+}
+
+// RecordOutcome adds one email's result to a run. err is what
+// ApplyRuleActions returned; actions before the failing one are counted as
+// succeeded and the rest were never attempted.
+func RecordOutcome(run *database.AutomationRun, emailID string, actions []rules.AppliedAction, err error) {
+	outcome := database.EmailOutcome{EmailID: emailID, Status: database.OutcomeApplied}
+	for _, a := range actions {
+		outcome.Actions = append(outcome.Actions, a.Action)
+	}
+	if len(actions) == 0 {
+		outcome.Status = database.OutcomeProtected
+	}
+
+	failed := len(actions)
+	var actionErr *ActionError
+	if errors.As(err, &actionErr) {
+		failed = actionErr.Index
+	} else if err != nil {
+		failed = 0
+	}
+	for i, a := range actions {
+		kind, _ := rules.ParseAction(a.Action)
+		if i < failed {
+			run.CountAction(kind, true)
+		} else if i == failed {
+			run.CountAction(kind, false)
+		}
+	}
+	if err != nil {
+		outcome.Status = database.OutcomeFailed
+		outcome.Error = err.Error()
+		run.Errors = append(run.Errors, err.Error())
+	}
+	run.Outcomes = append(run.Outcomes, outcome)
+}
+
+// recordPlanned adds a dry run's plan for one email to a run
+func recordPlanned(run *database.AutomationRun, emailID string, actions []rules.AppliedAction) {
+	outcome := database.EmailOutcome{EmailID: emailID, Status: database.OutcomePlanned}
+	for _, a := range actions {
+		outcome.Actions = append(outcome.Actions, a.Action)
+	}
+	run.Outcomes = append(run.Outcomes, outcome)
+}
+
+// LoadProtections fetches a user's allowlist in the rule engine's form.
+func LoadProtections(ctx context.Context, store Store, userEmail string) ([]rules.Protection, error) {
+	stored, err := store.ListProtectedSenders(ctx, userEmail)
+	if err != nil {
+		return nil, err
+	}
+	protections := make([]rules.Protection, len(stored))
+	for i, p := range stored {
+		protections[i] = p.EngineProtection()
+	}
+	return protections, nil
+}
+
+// liveProtect re-checks a plan against the email's current labels and drops
+// the actions that would remove it, quarantine included, if it is now
+// protected. It reports whether anything was dropped.
+func liveProtect(entry *Entry, labels []string, protections []rules.Protection) bool {
+	if !removesEmail(entry.Actions) {
+		return false
+	}
+	p, ok := rules.ProtectedBy(rules.Email{Sender: entry.Sender, Labels: labels}, protections)
+	if !ok {
+		return false
+	}
+	kept := make([]rules.AppliedAction, 0, len(entry.Actions))
+	for _, a := range entry.Actions {
+		if !rules.Destructive(a.Action) && a.Action != quarantineAction {
+			kept = append(kept, a)
+		}
+	}
+	entry.Actions = kept
+	entry.ProtectedBy = &p
+	if len(kept) == 0 {
+		entry.Action = "PROTECTED"
+		entry.Skipped = true
+		entry.Status = StatusProtected
+	} else {
+		entry.Action = kept[len(kept)-1].Action
+	}
+	return true
+}
+
+// removesEmail reports whether a plan trashes, archives or quarantines
+func removesEmail(actions []rules.AppliedAction) bool {
+	for _, a := range actions {
+		if rules.Destructive(a.Action) || a.Action == quarantineAction {
+			return true
+		}
+	}
+	return false
+}
+
+// protectsLabels reports whether any protection depends on labels
+func protectsLabels(protections []rules.Protection) bool {
+	for _, p := range protections {
+		if p.Kind == rules.ProtectLabel {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,386 @@
+// Package cleaner applies a user's rules to their mailbox. It is shared by
+// the clean endpoints, on-demand automation runs and the scheduler.
+package cleaner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"backend/internal/database"
+	"backend/internal/rules"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cleanBatchSize is how many candidate emails are planned and applied at a time
+const cleanBatchSize = 200
+
+// Store is the data the cleaner reads and writes.
+type Store interface {
+	ListRules(ctx context.Context, userEmail string) ([]database.Rule, error)
+	ListProtectedSenders(ctx context.Context, userID string) ([]database.ProtectedSender, error)
+	ListRuleMatches(ctx context.Context, userEmail string, ruleset []rules.Rule, after *database.RuleMatchCursor, limit int) ([]database.RuleMatch, *database.RuleMatchCursor, error)
+	DeleteEmail(ctx context.Context, id string) error
+	CreateCleaningHistory(ctx context.Context, userID string, entries []database.HistoryEntry) (database.CleaningHistory, error)
+	MarkCleaningUndone(ctx context.Context, id, userID string) error
+	SaveTrashOrigin(ctx context.Context, userID, emailID string, hadInbox bool) error
+	GetTrashOrigin(ctx context.Context, userID, emailID string) (bool, bool, error)
+	DeleteTrashOrigin(ctx context.Context, userID, emailID string) error
+	QuarantineEmail(ctx context.Context, q database.QuarantinedEmail) error
+	ListQuarantine(ctx context.Context, userID string) ([]database.QuarantinedEmail, error)
+	ReleaseQuarantine(ctx context.Context, userID, emailID string) error
+	DeleteQuarantine(ctx context.Context, userID, emailID string) error
+}
+
+// EmailService performs the rule actions on the mailbox and undoes them.
+type EmailService interface {
+	TrashMessage(userID, id string) error
+	UntrashMessage(userID, id string) error
+	DeleteMessagePermanently(userID, id string) error
+	ArchiveMessage(userID, id string) error
+	UnarchiveMessage(userID, id string) error
+	MarkRead(userID, id string) error
+	AddLabel(userID, id, labelName string) error
+	RemoveLabel(userID, id, labelName string) error
+	HasInboxLabel(userID, id string) (bool, error)
+	GetLabelIDs(userID, id string) ([]string, error)
+	AddLabelIDs(userID, id string, labelIDs []string) error
+}
+
+// Options control one clean.
+type Options struct {
+	DryRun          bool     // plan only; the EmailService is not used and may be nil
+	IDs             []string // only clean these matched emails; empty means all
+	PermanentDelete bool     // DELETE skips the trash
+	MaxActions      int      // act on at most this many emails; 0 means no limit
+
+	// QuarantineUntil, when set, replaces DELETE with the quarantine label;
+	// the email is trashed at that time unless the user releases it.
+	QuarantineUntil time.Time
+	// SkipQuarantined leaves emails that are or were in quarantine alone.
+	SkipQuarantined bool
+}
+
+// Entry statuses
+const (
+	StatusPlanned     = "planned"
+	StatusApplied     = "applied"
+	StatusFailed      = "failed"
+	StatusProtected   = "protected"
+	StatusQuarantined = "quarantined"
+	StatusSkipped     = "skipped" // over MaxActions or the run was cancelled
+)
+
+// Entry is what a clean planned and did for one matching email.
+type Entry struct {
+	ID          string                `json:"id"`
+	Sender      string                `json:"sender"`
+	Subject     string                `json:"subject"`
+	Date        time.Time             `json:"date"`
+	Actions     []rules.AppliedAction `json:"actions"`
+	Action      string                `json:"action"` // final action, PROTECTED if none are left
+	ProtectedBy *rules.Protection     `json:"protected_by,omitempty"`
+	Skipped     bool                  `json:"skipped,omitempty"` // protected, nothing to do
+	Status      string                `json:"status"`
+	Error       string                `json:"error,omitempty"`
+}
+
+// Report describes a finished clean.
+type Report struct {
+	DryRun         bool     `json:"dry_run"`
+	RulesEvaluated int      `json:"rules_evaluated"`
+	Matched        int      `json:"matched"` // before the IDs filter
+	Entries        []Entry  `json:"entries"`
+	AppliedIDs     []string `json:"applied_ids"`
+	ProtectedIDs   []string `json:"protected_ids"`
+	FailedIDs      []string `json:"failed_ids"`
+	SkippedIDs     []string `json:"skipped_ids"`
+	QuarantinedIDs []string `json:"quarantined_ids"`
+	Limited        bool     `json:"limited"` // MaxActions was reached
+}
+
+// Cleaner runs a user's rules with one set of options.
+type Cleaner struct {
+	store Store
+	svc   EmailService
+	opts  Options
+}
+
+// New creates a Cleaner. svc may be nil for dry runs.
+func New(store Store, svc EmailService, opts Options) *Cleaner {
+	return &Cleaner{store: store, svc: svc, opts: opts}
+}
+
+// Run evaluates the user's rules, plans the actions for each matching email
+// in priority order and, unless this is a dry run, applies them, newest
+// emails first and a batch at a time. When run is
+// not nil the totals and per-email outcomes are recorded in it; the caller
+// creates and finishes the run. A failure on one email does not stop the
+// others. The report is returned even when Run fails part way.
+func (c *Cleaner) Run(ctx context.Context, userEmail string, run *database.AutomationRun) (*Report, error) {
+	report := &Report{DryRun: c.opts.DryRun}
+
+	dbRules, err := c.store.ListRules(ctx, userEmail)
+	if err != nil {
+		return report, fmt.Errorf("could not fetch rules: %w", err)
+	}
+	if len(dbRules) == 0 {
+		return report, nil // No rules, nothing to do
+	}
+	engineRules := make([]rules.Rule, len(dbRules))
+	for i, dbRule := range dbRules {
+		engineRules[i] = dbRule.EngineRule()
+	}
+	report.RulesEvaluated = len(engineRules)
+
+	protections, err := LoadProtections(ctx, c.store, userEmail)
+	if err != nil {
+		return report, fmt.Errorf("could not fetch protected senders: %w", err)
+	}
+
+	var quarantined map[string]bool
+	if c.opts.SkipQuarantined {
+		list, err := c.store.ListQuarantine(ctx, userEmail)
+		if err != nil {
+			return report, fmt.Errorf("could not fetch quarantine: %w", err)
+		}
+		quarantined = make(map[string]bool, len(list))
+		for _, q := range list {
+			quarantined[q.EmailID] = true
+		}
+	}
+
+	var allowed map[string]bool
+	if len(c.opts.IDs) > 0 {
+		allowed = make(map[string]bool, len(c.opts.IDs))
+		for _, id := range c.opts.IDs {
+			allowed[id] = true
+		}
+	}
+
+	if !c.opts.DryRun && c.svc == nil {
+		return report, errors.New("no email service to apply actions with")
+	}
+	if run != nil {
+		run.RulesEvaluated = report.RulesEvaluated
+	}
+
+	// Matches are planned and applied a page at a time, so neither the plan
+	// nor a query is held for the whole mailbox during Gmail calls
+	acted := 0
+	var history []database.HistoryEntry
+	var after *database.RuleMatchCursor
+	for ctx.Err() == nil {
+		var page []database.RuleMatch
+		page, after, err = c.store.ListRuleMatches(ctx, userEmail, engineRules, after, cleanBatchSize)
+		if err != nil {
+			err = fmt.Errorf("could not evaluate rules: %w", err)
+			break
+		}
+		from := len(report.Entries)
+		for _, m := range page {
+			actions := rules.PlanMatched(engineRules, m.Matched)
+			if len(actions) == 0 {
+				continue
+			}
+			report.Matched++
+			if (allowed != nil && !allowed[m.Email.ID]) || quarantined[m.Email.ID] {
+				continue
+			}
+			report.Entries = append(report.Entries, c.entry(m.Email, actions, protections))
+		}
+		if run != nil {
+			run.EmailsMatched = len(report.Entries)
+		}
+		if c.opts.DryRun {
+			c.plan(report, run, from, &acted)
+		} else {
+			history = append(history, c.apply(ctx, userEmail, report, run, from, protections, &acted)...)
+		}
+		if after == nil {
+			break
+		}
+	}
+	if report.Limited && run != nil {
+		run.Errors = append(run.Errors, fmt.Sprintf("safety limit of %d emails per run reached; %d matching emails were left alone", c.opts.MaxActions, len(report.SkippedIDs)))
+	}
+
+	if len(report.AppliedIDs) > 0 {
+		// Log the cleaning event even when the clean was cancelled
+		if _, err := c.store.CreateCleaningHistory(context.WithoutCancel(ctx), userEmail, history); err != nil {
+			log.Errorf("Cleaner: failed to log cleaning history for user %s: %v", userEmail, err)
+		}
+		log.Infof("Cleaner: cleaned %d emails for user %s", len(report.AppliedIDs), userEmail)
+	}
+	if err != nil {
+		return report, err
+	}
+	return report, ctx.Err()
+}
+
+// entry plans one matching email, dropping actions its protections forbid
+func (c *Cleaner) entry(email database.Email, actions []rules.AppliedAction, protections []rules.Protection) Entry {
+	entry := Entry{
+		ID:      email.ID,
+		Sender:  email.Sender,
+		Subject: email.Subject,
+		Date:    email.Date,
+		Status:  StatusPlanned,
+	}
+	// Protected senders never lose mail to DELETE/ARCHIVE
+	entry.Actions, entry.ProtectedBy = rules.Protect(email.EngineEmail(), actions, protections)
+	if entry.ProtectedBy != nil {
+		log.Infof("Cleaner: email %s is protected by %s %q", email.ID, entry.ProtectedBy.Kind, entry.ProtectedBy.Value)
+	}
+	if !c.opts.QuarantineUntil.IsZero() {
+		entry.Actions = quarantineActions(entry.Actions)
+	}
+	if len(entry.Actions) == 0 {
+		entry.Action = "PROTECTED"
+		entry.Skipped = true
+		entry.Status = StatusProtected
+	} else {
+		entry.Action = entry.Actions[len(entry.Actions)-1].Action // Final action, shown in the preview
+	}
+	return entry
+}
+
+// apply performs the plan for the report's entries from index from on,
+// counting emails acted on in acted, and returns their undo history
+func (c *Cleaner) apply(ctx context.Context, userEmail string, report *Report, run *database.AutomationRun, from int, protections []rules.Protection, acted *int) []database.HistoryEntry {
+	var history []database.HistoryEntry
+	for i := from; i < len(report.Entries); i++ {
+		entry := &report.Entries[i]
+		if entry.Status == StatusProtected {
+			report.ProtectedIDs = append(report.ProtectedIDs, entry.ID)
+			if run != nil {
+				RecordOutcome(run, entry.ID, nil, nil)
+			}
+			continue
+		}
+		if ctx.Err() != nil || c.limitReached(*acted) {
+			report.Limited = report.Limited || ctx.Err() == nil
+			entry.Status = StatusSkipped
+			report.SkippedIDs = append(report.SkippedIDs, entry.ID)
+			continue
+		}
+		// Labels may have changed since the last sync, e.g. the user starred
+		// the email, so protections are checked again against Gmail
+		labels, err := c.svc.GetLabelIDs("me", entry.ID)
+		if err == nil && liveProtect(entry, labels, protections) && len(entry.Actions) == 0 {
+			log.Infof("Cleaner: email %s is now protected by %s %q", entry.ID, entry.ProtectedBy.Kind, entry.ProtectedBy.Value)
+			report.ProtectedIDs = append(report.ProtectedIDs, entry.ID)
+			if run != nil {
+				RecordOutcome(run, entry.ID, nil, nil)
+			}
+			continue
+		}
+		if err != nil && removesEmail(entry.Actions) && protectsLabels(protections) {
+			err = fmt.Errorf("could not check labels of email %s against protected labels: %w", entry.ID, err)
+			log.Errorf("Cleaner: %v", err)
+			if run != nil {
+				RecordOutcome(run, entry.ID, entry.Actions, err)
+			}
+			entry.Status = StatusFailed
+			entry.Error = err.Error()
+			report.FailedIDs = append(report.FailedIDs, entry.ID)
+			continue
+		}
+		*acted++
+		undo := c.snapshot(ctx, userEmail, entry, labels, err)
+		err = ApplyRuleActions(ctx, c.store, c.svc, entry.ID, entry.Actions, c.opts.PermanentDelete)
+		quarantinedBy, isQuarantined := quarantineIndex(entry.Actions)
+		if err == nil && isQuarantined {
+			err = c.store.QuarantineEmail(ctx, database.QuarantinedEmail{
+				UserID:     userEmail,
+				EmailID:    entry.ID,
+				RuleID:     entry.Actions[quarantinedBy].RuleID,
+				Sender:     entry.Sender,
+				Subject:    entry.Subject,
+				TrashAfter: c.opts.QuarantineUntil,
+			})
+			if err != nil {
+				err = &ActionError{EmailID: entry.ID, Action: quarantineAction, Index: quarantinedBy, Err: err}
+			}
+		}
+		if run != nil {
+			RecordOutcome(run, entry.ID, entry.Actions, err)
+		}
+		if err != nil {
+			log.Errorf("Cleaner: %v", err)
+			// Don't stop for one failed email, just continue
+			entry.Status = StatusFailed
+			entry.Error = err.Error()
+			report.FailedIDs = append(report.FailedIDs, entry.ID)
+			continue
+		}
+		entry.Status = StatusApplied
+		if isQuarantined {
+			entry.Status = StatusQuarantined
+			report.QuarantinedIDs = append(report.QuarantinedIDs, entry.ID)
+		}
+		report.AppliedIDs = append(report.AppliedIDs, entry.ID)
+		history = append(history, undo)
+	}
+	return history
+}
+
+// snapshot records an email's labels before its actions are applied, so the
+// clean can be undone, and remembers its inbox state if it is about to be
+// trashed. labels and labelErr are the result of reading its labels; an
+// email whose labels can't be read is still cleaned.
+func (c *Cleaner) snapshot(ctx context.Context, userEmail string, entry *Entry, labels []string, labelErr error) database.HistoryEntry {
+	h := database.HistoryEntry{EmailID: entry.ID}
+	deletes := false
+	for _, a := range entry.Actions {
+		h.Actions = append(h.Actions, a.Action)
+		if kind, _ := rules.ParseAction(a.Action); kind == rules.ActionDelete {
+			deletes = true
+		}
+	}
+	h.Permanent = deletes && c.opts.PermanentDelete
+
+	if labelErr != nil {
+		log.Warnf("Cleaner: could not read labels of email %s, it can only be partly undone: %v", entry.ID, labelErr)
+		return h
+	}
+	h.PriorLabels = labels
+	if labels == nil {
+		h.PriorLabels = []string{}
+	}
+	if deletes && !h.Permanent {
+		_ = c.store.SaveTrashOrigin(ctx, userEmail, entry.ID, hasLabel(labels, "INBOX"))
+	}
+	return h
+}
+
+// plan finishes a dry run for the report's entries from index from on,
+// marking emails past MaxActions as skipped
+func (c *Cleaner) plan(report *Report, run *database.AutomationRun, from int, acted *int) {
+	for i := from; i < len(report.Entries); i++ {
+		entry := &report.Entries[i]
+		switch {
+		case entry.Status == StatusProtected:
+			report.ProtectedIDs = append(report.ProtectedIDs, entry.ID)
+			if run != nil {
+				RecordOutcome(run, entry.ID, nil, nil)
+			}
+		case c.limitReached(*acted):
+			report.Limited = true
+			entry.Status = StatusSkipped
+			report.SkippedIDs = append(report.SkippedIDs, entry.ID)
+		default:
+			*acted++
+			if run != nil {
+				recordPlanned(run, entry.ID, entry.Actions)
+			}
+		}
+	}
+}
+
+// limitReached reports whether MaxActions emails have been acted on
+func (c *Cleaner) limitReached(acted int) bool {
+	return c.opts.MaxActions > 0 && acted >= c.opts.MaxActions
+}
@@ -0,0 +1,443 @@
+package cleaner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"backend/internal/database"
+	"backend/internal/rules"
+
+	"google.golang.org/api/googleapi"
+)
+
+// fakeStore keeps a mailbox in memory and evaluates rules with rules.Match
+type fakeStore struct {
+	rules      []database.Rule
+	protected  []database.ProtectedSender
+	emails     []database.Email
+	quarantine []database.QuarantinedEmail
+
+	pages       int
+	deleted     []string
+	history     [][]database.HistoryEntry
+	trashOrigin map[string]bool
+	undone      []string
+}
+
+func (s *fakeStore) ListRules(ctx context.Context, userEmail string) ([]database.Rule, error) {
+	return s.rules, nil
+}
+
+func (s *fakeStore) ListProtectedSenders(ctx context.Context, userID string) ([]database.ProtectedSender, error) {
+	return s.protected, nil
+}
+
+func (s *fakeStore) ListRuleMatches(ctx context.Context, userEmail string, ruleset []rules.Rule, after *database.RuleMatchCursor, limit int) ([]database.RuleMatch, *database.RuleMatchCursor, error) {
+	s.pages++
+	emails := append([]database.Email(nil), s.emails...)
+	sort.Slice(emails, func(i, j int) bool {
+		if !emails[i].Date.Equal(emails[j].Date) {
+			return emails[i].Date.After(emails[j].Date)
+		}
+		return emails[i].ID > emails[j].ID
+	})
+	var matches []database.RuleMatch
+	var last *database.RuleMatchCursor
+	n := 0
+	for _, e := range emails {
+		if after != nil && !e.Date.Before(after.Date) && !(e.Date.Equal(after.Date) && e.ID < after.ID) {
+			continue
+		}
+		if n == limit {
+			break
+		}
+		n++
+		m := database.RuleMatch{Email: e, Matched: make([]bool, len(ruleset))}
+		matchedAny := false
+		for i, r := range ruleset {
+			m.Matched[i] = rules.Match(e.EngineEmail(), r)
+			matchedAny = matchedAny || m.Matched[i]
+		}
+		if matchedAny {
+			matches = append(matches, m)
+		}
+		last = &database.RuleMatchCursor{Date: e.Date, ID: e.ID}
+	}
+	if n < limit {
+		return matches, nil, nil
+	}
+	return matches, last, nil
+}
+
+func (s *fakeStore) DeleteEmail(ctx context.Context, id string) error {
+	s.deleted = append(s.deleted, id)
+	for i, e := range s.emails {
+		if e.ID == id {
+			s.emails = append(s.emails[:i], s.emails[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (s *fakeStore) CreateCleaningHistory(ctx context.Context, userID string, entries []database.HistoryEntry) (database.CleaningHistory, error) {
+	s.history = append(s.history, entries)
+	return database.CleaningHistory{ID: fmt.Sprint(len(s.history)), UserID: userID, Entries: entries}, nil
+}
+
+func (s *fakeStore) MarkCleaningUndone(ctx context.Context, id, userID string) error {
+	s.undone = append(s.undone, id)
+	return nil
+}
+
+func (s *fakeStore) SaveTrashOrigin(ctx context.Context, userID, emailID string, hadInbox bool) error {
+	if s.trashOrigin == nil {
+		s.trashOrigin = make(map[string]bool)
+	}
+	s.trashOrigin[emailID] = hadInbox
+	return nil
+}
+
+func (s *fakeStore) GetTrashOrigin(ctx context.Context, userID, emailID string) (bool, bool, error) {
+	hadInbox, ok := s.trashOrigin[emailID]
+	return hadInbox, ok, nil
+}
+
+func (s *fakeStore) DeleteTrashOrigin(ctx context.Context, userID, emailID string) error {
+	delete(s.trashOrigin, emailID)
+	return nil
+}
+
+func (s *fakeStore) QuarantineEmail(ctx context.Context, q database.QuarantinedEmail) error {
+	s.quarantine = append(s.quarantine, q)
+	return nil
+}
+
+func (s *fakeStore) ListQuarantine(ctx context.Context, userID string) ([]database.QuarantinedEmail, error) {
+	return s.quarantine, nil
+}
+
+func (s *fakeStore) ReleaseQuarantine(ctx context.Context, userID, emailID string) error {
+	return nil
+}
+
+func (s *fakeStore) DeleteQuarantine(ctx context.Context, userID, emailID string) error {
+	for i, q := range s.quarantine {
+		if q.EmailID == emailID {
+			s.quarantine = append(s.quarantine[:i], s.quarantine[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("quarantined email not found")
+}
+
+// fakeService records Gmail calls as "action:id" and fails those in fail
+type fakeService struct {
+	labels map[string][]string
+	fail   map[string]error
+	calls  []string
+}
+
+func (f *fakeService) call(action, id string) error {
+	f.calls = append(f.calls, action+":"+id)
+	return f.fail[action+":"+id]
+}
+
+func (f *fakeService) TrashMessage(userID, id string) error { return f.call("trash", id) }
+
+func (f *fakeService) UntrashMessage(userID, id string) error { return f.call("untrash", id) }
+
+func (f *fakeService) DeleteMessagePermanently(userID, id string) error {
+	return f.call("delete", id)
+}
+
+func (f *fakeService) ArchiveMessage(userID, id string) error { return f.call("archive", id) }
+
+func (f *fakeService) UnarchiveMessage(userID, id string) error { return f.call("unarchive", id) }
+
+func (f *fakeService) MarkRead(userID, id string) error { return f.call("read", id) }
+
+func (f *fakeService) AddLabel(userID, id, labelName string) error {
+	return f.call("label "+labelName, id)
+}
+
+func (f *fakeService) RemoveLabel(userID, id, labelName string) error {
+	return f.call("unlabel "+labelName, id)
+}
+
+func (f *fakeService) HasInboxLabel(userID, id string) (bool, error) {
+	return hasLabel(f.labels[id], "INBOX"), nil
+}
+
+func (f *fakeService) GetLabelIDs(userID, id string) ([]string, error) {
+	return f.labels[id], f.fail["labels:"+id]
+}
+
+func (f *fakeService) AddLabelIDs(userID, id string, labelIDs []string) error {
+	return f.call("labels "+strings.Join(labelIDs, ","), id)
+}
+
+// mailbox returns emails from sender, the first one newest
+func mailbox(sender string, ids ...string) []database.Email {
+	now := time.Now()
+	emails := make([]database.Email, len(ids))
+	for i, id := range ids {
+		emails[i] = database.Email{ID: id, Sender: sender, Subject: "Offer " + id, Date: now.Add(-time.Duration(i) * time.Hour), Labels: []string{"INBOX"}}
+	}
+	return emails
+}
+
+func deleteRule(sender string) database.Rule {
+	return database.Rule{ID: "r-delete", Type: "sender", Value: sender, Action: rules.ActionDelete}
+}
+
+func TestRunDryRun(t *testing.T) {
+	store := &fakeStore{rules: []database.Rule{deleteRule("shop.example")}, emails: mailbox("deals@shop.example", "a", "b")}
+	run := &database.AutomationRun{}
+	report, err := New(store, nil, Options{DryRun: true}).Run(context.Background(), "user", run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Entries) != 2 || report.Entries[0].ID != "a" || report.Entries[1].ID != "b" {
+		t.Fatalf("entries = %+v, want a then b", report.Entries)
+	}
+	for _, e := range report.Entries {
+		if e.Status != StatusPlanned || e.Action != rules.ActionDelete {
+			t.Errorf("entry %s: status %s, action %s", e.ID, e.Status, e.Action)
+		}
+	}
+	if len(report.AppliedIDs) != 0 || len(store.deleted) != 0 || len(store.history) != 0 {
+		t.Errorf("dry run changed the mailbox: applied %v, deleted %v, history %v", report.AppliedIDs, store.deleted, store.history)
+	}
+	if run.EmailsMatched != 2 || len(run.Outcomes) != 2 || run.Outcomes[0].Status != database.OutcomePlanned {
+		t.Errorf("run = %+v, want 2 planned outcomes", run)
+	}
+}
+
+func TestRunOnlyCleansAllowedIDs(t *testing.T) {
+	store := &fakeStore{rules: []database.Rule{deleteRule("shop.example")}, emails: mailbox("deals@shop.example", "a", "b", "c")}
+	svc := &fakeService{}
+	report, err := New(store, svc, Options{IDs: []string{"b"}}).Run(context.Background(), "user", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Matched != 3 {
+		t.Errorf("matched = %d, want 3", report.Matched)
+	}
+	if strings.Join(report.AppliedIDs, ",") != "b" {
+		t.Errorf("applied = %v, want [b]", report.AppliedIDs)
+	}
+	if strings.Join(svc.calls, ",") != "trash:b" {
+		t.Errorf("calls = %v, want [trash:b]", svc.calls)
+	}
+}
+
+func TestRunTrashOrDeletePermanently(t *testing.T) {
+	tests := []struct {
+		name      string
+		permanent bool
+		call      string
+	}{
+		{"trash", false, "trash:a"},
+		{"permanent", true, "delete:a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeStore{rules: []database.Rule{deleteRule("shop.example")}, emails: mailbox("deals@shop.example", "a")}
+			svc := &fakeService{labels: map[string][]string{"a": {"INBOX", "UNREAD"}}}
+			report, err := New(store, svc, Options{PermanentDelete: tt.permanent}).Run(context.Background(), "user", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(svc.calls, ",") != tt.call {
+				t.Errorf("calls = %v, want [%s]", svc.calls, tt.call)
+			}
+			if len(report.AppliedIDs) != 1 || len(store.deleted) != 1 {
+				t.Errorf("applied %v, deleted from cache %v", report.AppliedIDs, store.deleted)
+			}
+			if len(store.history) != 1 || len(store.history[0]) != 1 {
+				t.Fatalf("history = %v, want one entry", store.history)
+			}
+			h := store.history[0][0]
+			if h.Permanent != tt.permanent || strings.Join(h.PriorLabels, ",") != "INBOX,UNREAD" {
+				t.Errorf("history entry = %+v", h)
+			}
+			if hadInbox, ok := store.trashOrigin["a"]; ok == tt.permanent || (ok && !hadInbox) {
+				t.Errorf("trash origin = %v, %v", hadInbox, ok)
+			}
+		})
+	}
+}
+
+func TestRunStopsAtMaxActions(t *testing.T) {
+	store := &fakeStore{rules: []database.Rule{deleteRule("shop.example")}, emails: mailbox("deals@shop.example", "a", "b", "c")}
+	svc := &fakeService{}
+	run := &database.AutomationRun{}
+	report, err := New(store, svc, Options{MaxActions: 2}).Run(context.Background(), "user", run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(report.AppliedIDs, ",") != "a,b" || strings.Join(report.SkippedIDs, ",") != "c" || !report.Limited {
+		t.Errorf("applied %v, skipped %v, limited %v", report.AppliedIDs, report.SkippedIDs, report.Limited)
+	}
+	if len(svc.calls) != 2 {
+		t.Errorf("calls = %v, want 2", svc.calls)
+	}
+	if len(run.Errors) != 1 || !strings.Contains(run.Errors[0], "safety limit of 2") {
+		t.Errorf("run errors = %v", run.Errors)
+	}
+}
+
+func TestRunSkipsProtectedEmails(t *testing.T) {
+	emails := append(mailbox("boss@work.example", "boss"), mailbox("deals@shop.example", "starred", "plain")...)
+	store := &fakeStore{
+		rules:  []database.Rule{{ID: "r-all", Type: "keyword", Value: "offer", Action: rules.ActionDelete}},
+		emails: emails,
+		protected: []database.ProtectedSender{
+			{Kind: rules.ProtectAddress, Value: "boss@work.example"},
+			{Kind: rules.ProtectLabel, Value: "STARRED"},
+		},
+	}
+	// Starred after the last sync: only Gmail knows
+	svc := &fakeService{labels: map[string][]string{"starred": {"INBOX", "STARRED"}, "plain": {"INBOX"}}}
+	run := &database.AutomationRun{}
+	report, err := New(store, svc, Options{}).Run(context.Background(), "user", run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(report.ProtectedIDs)
+	if strings.Join(report.ProtectedIDs, ",") != "boss,starred" {
+		t.Errorf("protected = %v, want [boss starred]", report.ProtectedIDs)
+	}
+	if strings.Join(report.AppliedIDs, ",") != "plain" {
+		t.Errorf("applied = %v, want [plain]", report.AppliedIDs)
+	}
+	for _, call := range svc.calls {
+		if call != "trash:plain" {
+			t.Errorf("unexpected call %s", call)
+		}
+	}
+	for _, e := range report.Entries {
+		if e.ID != "plain" && (e.Status != StatusProtected || e.ProtectedBy == nil) {
+			t.Errorf("entry %s: status %s, protected by %v", e.ID, e.Status, e.ProtectedBy)
+		}
+	}
+}
+
+func TestRunCountsPartialFailures(t *testing.T) {
+	store := &fakeStore{
+		rules: []database.Rule{
+			{ID: "r-label", Type: "sender", Value: "shop.example", Action: rules.ActionAddLabel + ":Shopping"},
+			deleteRule("shop.example"),
+		},
+		emails: mailbox("deals@shop.example", "a", "b"),
+	}
+	svc := &fakeService{fail: map[string]error{"trash:a": errors.New("gmail unavailable")}}
+	run := &database.AutomationRun{}
+	report, err := New(store, svc, Options{}).Run(context.Background(), "user", run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(report.FailedIDs, ",") != "a" || strings.Join(report.AppliedIDs, ",") != "b" {
+		t.Errorf("failed %v, applied %v", report.FailedIDs, report.AppliedIDs)
+	}
+	if e := report.Entries[0]; e.Status != StatusFailed || !strings.Contains(e.Error, "gmail unavailable") {
+		t.Errorf("entry a: status %s, error %q", e.Status, e.Error)
+	}
+	label, del := run.ActionCounts[rules.ActionAddLabel], run.ActionCounts[rules.ActionDelete]
+	if label == nil || label.Succeeded != 2 || label.Failed != 0 {
+		t.Errorf("ADD_LABEL counts = %+v, want 2 succeeded", label)
+	}
+	if del == nil || del.Succeeded != 1 || del.Failed != 1 {
+		t.Errorf("DELETE counts = %+v, want 1 succeeded, 1 failed", del)
+	}
+	if len(store.history) != 1 || len(store.history[0]) != 1 || store.history[0][0].EmailID != "b" {
+		t.Errorf("history = %v, want only b", store.history)
+	}
+}
+
+func TestRunAppliesInBatches(t *testing.T) {
+	ids := make([]string, 2*cleanBatchSize+5)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("m%04d", i)
+	}
+	store := &fakeStore{rules: []database.Rule{deleteRule("shop.example")}, emails: mailbox("deals@shop.example", ids...)}
+	svc := &fakeService{}
+	report, err := New(store, svc, Options{}).Run(context.Background(), "user", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.AppliedIDs) != len(ids) || len(svc.calls) != len(ids) {
+		t.Errorf("applied %d, calls %d, want %d", len(report.AppliedIDs), len(svc.calls), len(ids))
+	}
+	if store.pages != 3 {
+		t.Errorf("pages = %d, want 3", store.pages)
+	}
+	if len(store.history) != 1 || len(store.history[0]) != len(ids) {
+		t.Errorf("history not recorded as one clean")
+	}
+}
+
+func TestUndoOnlyMarksCleanUndoneWhenEveryEmailRestored(t *testing.T) {
+	history := database.CleaningHistory{ID: "h1", Entries: []database.HistoryEntry{
+		{EmailID: "a", Actions: []string{rules.ActionDelete}, PriorLabels: []string{"INBOX"}},
+		{EmailID: "b", Actions: []string{rules.ActionMarkRead, rules.ActionArchive}},
+	}}
+	store := &fakeStore{}
+	svc := &fakeService{fail: map[string]error{"untrash:a": errors.New("gmail unavailable")}}
+	report, err := Undo(context.Background(), store, svc, "user", history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(report.FailedIDs, ",") != "a" || strings.Join(report.RestoredIDs, ",") != "b" {
+		t.Errorf("failed %v, restored %v", report.FailedIDs, report.RestoredIDs)
+	}
+	if strings.Join(report.ReadStateLostIDs, ",") != "b" {
+		t.Errorf("read state lost for %v, want [b]", report.ReadStateLostIDs)
+	}
+	if report.Undone || len(store.undone) != 0 {
+		t.Errorf("clean marked undone with a failed email")
+	}
+
+	svc.fail = nil
+	if report, err = Undo(context.Background(), store, svc, "user", history); err != nil {
+		t.Fatal(err)
+	}
+	if !report.Undone || strings.Join(store.undone, ",") != "h1" {
+		t.Errorf("retried undo: undone %v, marked %v", report.Undone, store.undone)
+	}
+}
+
+func TestTrashQuarantinedForgetsMissingEmails(t *testing.T) {
+	notFound := &googleapi.Error{Code: http.StatusNotFound}
+	due := []database.QuarantinedEmail{
+		{EmailID: "gone", Sender: "deals@shop.example"},
+		{EmailID: "purged", Sender: "deals@shop.example"},
+		{EmailID: "kept", Sender: "deals@shop.example"},
+	}
+	store := &fakeStore{quarantine: append([]database.QuarantinedEmail(nil), due...)}
+	svc := &fakeService{fail: map[string]error{"labels:gone": notFound, "trash:purged": notFound}}
+	trashed, err := TrashQuarantined(context.Background(), store, svc, "user", due)
+	if err != nil {
+		t.Fatalf("missing emails reported as failures: %v", err)
+	}
+	if strings.Join(trashed, ",") != "kept" {
+		t.Errorf("trashed = %v, want [kept]", trashed)
+	}
+	if len(store.quarantine) != 0 {
+		t.Errorf("still quarantined: %v", store.quarantine)
+	}
+	sort.Strings(store.deleted)
+	if strings.Join(store.deleted, ",") != "gone,kept,purged" {
+		t.Errorf("deleted from cache %v", store.deleted)
+	}
+	if len(store.history) != 1 || len(store.history[0]) != 1 || store.history[0][0].EmailID != "kept" {
+		t.Errorf("history = %v, want only kept", store.history)
+	}
+}
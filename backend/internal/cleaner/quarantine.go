@@ -0,0 +1,116 @@
+package cleaner
+
+import (
+	"context"
+	"fmt"
+
+	"backend/internal/database"
+	"backend/internal/rules"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// QuarantineLabel marks emails an automated DELETE is holding back.
+const QuarantineLabel = "MailCleaner/Quarantine"
+
+const quarantineAction = rules.ActionAddLabel + ":" + QuarantineLabel
+
+// quarantineActions replaces DELETE with the quarantine label
+func quarantineActions(actions []rules.AppliedAction) []rules.AppliedAction {
+	out := make([]rules.AppliedAction, len(actions))
+	for i, a := range actions {
+		if kind, _ := rules.ParseAction(a.Action); kind == rules.ActionDelete {
+			a.Action = quarantineAction
+		}
+		out[i] = a
+	}
+	return out
+}
+
+// quarantineIndex finds the quarantine label in a plan
+func quarantineIndex(actions []rules.AppliedAction) (int, bool) {
+	for i, a := range actions {
+		if a.Action == quarantineAction {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// TrashQuarantined moves quarantined emails whose deadline has passed to the
+// trash and forgets them. Emails the user has since protected, e.g. by
+// starring them, are released instead, and emails gone from Gmail are
+// forgotten. It returns the IDs it trashed; an email that fails stays
+// quarantined and is tried again next time.
+func TrashQuarantined(ctx context.Context, store Store, svc EmailService, userEmail string, due []database.QuarantinedEmail) ([]string, error) {
+	protections, err := LoadProtections(ctx, store, userEmail)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch protected senders: %w", err)
+	}
+
+	var trashed []string
+	var history []database.HistoryEntry
+	var failed int
+	for _, q := range due {
+		if err := ctx.Err(); err != nil {
+			return trashed, err
+		}
+		labels, err := svc.GetLabelIDs("me", q.EmailID)
+		if isNotFound(err) {
+			forgetQuarantined(ctx, store, userEmail, q.EmailID)
+			continue
+		}
+		if err != nil {
+			log.Errorf("Quarantine: failed to read labels of email %s for user %s: %v", q.EmailID, userEmail, err)
+			failed++
+			continue
+		}
+		if p, ok := rules.ProtectedBy(rules.Email{Sender: q.Sender, Labels: labels}, protections); ok {
+			log.Infof("Quarantine: releasing email %s for user %s, now protected by %s %q", q.EmailID, userEmail, p.Kind, p.Value)
+			if err := store.ReleaseQuarantine(ctx, userEmail, q.EmailID); err != nil {
+				log.Errorf("Quarantine: failed to release email %s for user %s: %v", q.EmailID, userEmail, err)
+			}
+			_ = svc.RemoveLabel("me", q.EmailID, QuarantineLabel)
+			continue
+		}
+
+		// Undoing this takes the email out of quarantine as well as the
+		// trash; its inbox state comes from trash_state
+		entry := database.HistoryEntry{EmailID: q.EmailID, Actions: []string{quarantineAction, rules.ActionDelete}}
+		_ = store.SaveTrashOrigin(ctx, userEmail, q.EmailID, hasLabel(labels, "INBOX"))
+		if err := svc.TrashMessage("me", q.EmailID); isNotFound(err) {
+			_ = store.DeleteTrashOrigin(ctx, userEmail, q.EmailID)
+			forgetQuarantined(ctx, store, userEmail, q.EmailID)
+			continue
+		} else if err != nil {
+			log.Errorf("Quarantine: failed to trash email %s for user %s: %v", q.EmailID, userEmail, err)
+			failed++
+			continue
+		}
+		_ = store.DeleteEmail(ctx, q.EmailID)
+		if err := store.DeleteQuarantine(ctx, userEmail, q.EmailID); err != nil {
+			log.Errorf("Quarantine: failed to clear email %s for user %s: %v", q.EmailID, userEmail, err)
+		}
+		trashed = append(trashed, q.EmailID)
+		history = append(history, entry)
+	}
+	if len(trashed) > 0 {
+		if _, err := store.CreateCleaningHistory(context.WithoutCancel(ctx), userEmail, history); err != nil {
+			log.Errorf("Quarantine: failed to log cleaning history for user %s: %v", userEmail, err)
+		}
+	}
+	if failed > 0 {
+		return trashed, fmt.Errorf("%d of %d quarantined emails could not be trashed", failed, len(due))
+	}
+	return trashed, nil
+}
+
+// forgetQuarantined drops an email Gmail no longer has, so it isn't swept
+// again
+func forgetQuarantined(ctx context.Context, store Store, userEmail, emailID string) {
+	log.Infof("Quarantine: email %s for user %s no longer exists, forgetting it", emailID, userEmail)
+	_ = store.DeleteEmail(ctx, emailID)
+	if err := store.DeleteQuarantine(ctx, userEmail, emailID); err != nil {
+		log.Errorf("Quarantine: failed to clear email %s for user %s: %v", emailID, userEmail, err)
+	}
+}
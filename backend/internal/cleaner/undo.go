@@ -0,0 +1,168 @@
+package cleaner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"backend/internal/database"
+	"backend/internal/rules"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+)
+
+// UndoReport describes a finished undo.
+type UndoReport struct {
+	HistoryID   string   `json:"history_id"`
+	RestoredIDs []string `json:"restored_ids"`
+	PurgedIDs   []string `json:"purged_ids"` // permanently deleted or gone from the trash
+	FailedIDs   []string `json:"failed_ids"`
+	// Restored except for being marked read: the clean could not record
+	// whether they were unread, so they are left as they are
+	ReadStateLostIDs []string `json:"read_state_lost_ids,omitempty"`
+	Errors           []string `json:"errors,omitempty"`
+	Undone           bool     `json:"undone"` // false while some emails failed
+}
+
+// Undo reverses a clean: trashed emails are untrashed, labels the clean added
+// are removed and labels it removed, including INBOX and UNREAD, are put
+// back. Cleans recorded without prior labels are restored from trash_state
+// as far as it goes. Emails that no longer exist are reported as purged. The
+// clean is only marked undone once no email failed, so the undo can be run
+// again to retry them.
+func Undo(ctx context.Context, store Store, svc EmailService, userEmail string, history database.CleaningHistory) (*UndoReport, error) {
+	report := &UndoReport{HistoryID: history.ID}
+
+	entries := history.Entries
+	if len(entries) == 0 {
+		// Older cleans only recorded which emails they touched
+		for _, id := range history.AffectedEmails {
+			entries = append(entries, database.HistoryEntry{EmailID: id})
+		}
+	}
+
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if entry.Permanent {
+			report.PurgedIDs = append(report.PurgedIDs, entry.EmailID)
+			continue
+		}
+		err := undoEntry(ctx, store, svc, userEmail, entry)
+		switch {
+		case isNotFound(err):
+			report.PurgedIDs = append(report.PurgedIDs, entry.EmailID)
+		case err != nil:
+			log.Errorf("Undo: failed to restore email %s for user %s: %v", entry.EmailID, userEmail, err)
+			report.FailedIDs = append(report.FailedIDs, entry.EmailID)
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to restore %s: %v", entry.EmailID, err))
+		default:
+			report.RestoredIDs = append(report.RestoredIDs, entry.EmailID)
+			if entry.PriorLabels == nil && hasAction(entry.Actions, rules.ActionMarkRead) {
+				report.ReadStateLostIDs = append(report.ReadStateLostIDs, entry.EmailID)
+			}
+		}
+	}
+
+	if len(report.FailedIDs) > 0 {
+		log.Warnf("Undo: %d emails could not be restored for user %s, leaving clean %s to be undone again", len(report.FailedIDs), userEmail, history.ID)
+		return report, nil
+	}
+	if err := store.MarkCleaningUndone(context.WithoutCancel(ctx), history.ID, userEmail); err != nil {
+		return report, fmt.Errorf("could not mark cleaning as undone: %w", err)
+	}
+	report.Undone = true
+	log.Infof("Undo: restored %d emails for user %s, %d purged, %d failed", len(report.RestoredIDs), userEmail, len(report.PurgedIDs), len(report.FailedIDs))
+	return report, nil
+}
+
+// undoEntry restores one email
+func undoEntry(ctx context.Context, store Store, svc EmailService, userEmail string, entry database.HistoryEntry) error {
+	legacy := entry.Actions == nil
+	trashed := legacy // older cleans were mostly deletes; untrashing anything else is harmless
+	for _, action := range entry.Actions {
+		kind, label := rules.ParseAction(action)
+		switch kind {
+		case rules.ActionDelete:
+			trashed = true
+		case rules.ActionAddLabel:
+			if err := svc.RemoveLabel("me", entry.EmailID, label); err != nil {
+				return err
+			}
+			if action == quarantineAction {
+				if err := store.ReleaseQuarantine(ctx, userEmail, entry.EmailID); err != nil && err.Error() != "quarantined email not found" {
+					return err
+				}
+			}
+		}
+	}
+	if trashed {
+		if err := svc.UntrashMessage("me", entry.EmailID); err != nil {
+			return err
+		}
+	}
+
+	if entry.PriorLabels != nil {
+		current, err := svc.GetLabelIDs("me", entry.EmailID)
+		if err != nil {
+			return err
+		}
+		var missing []string
+		for _, id := range entry.PriorLabels {
+			if !hasLabel(current, id) {
+				missing = append(missing, id)
+			}
+		}
+		if err := svc.AddLabelIDs("me", entry.EmailID, missing); err != nil {
+			return err
+		}
+	} else if trashed {
+		// Without the labels, put the email back where it was trashed from
+		if hadInbox, ok, _ := store.GetTrashOrigin(ctx, userEmail, entry.EmailID); ok && hadInbox {
+			if err := svc.UnarchiveMessage("me", entry.EmailID); err != nil {
+				return err
+			}
+		}
+	} else {
+		for _, action := range entry.Actions {
+			if kind, _ := rules.ParseAction(action); kind == rules.ActionArchive {
+				if err := svc.UnarchiveMessage("me", entry.EmailID); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if trashed {
+		_ = store.DeleteTrashOrigin(ctx, userEmail, entry.EmailID)
+	}
+	return nil
+}
+
+// hasAction reports whether a recorded clean did an action of this kind
+func hasAction(actions []string, kind string) bool {
+	for _, action := range actions {
+		if k, _ := rules.ParseAction(action); k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// isNotFound reports whether Gmail no longer has the email
+func isNotFound(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusNotFound
+}
+
+// hasLabel reports whether labels contains the label ID
+func hasLabel(labels []string, id string) bool {
+	for _, l := range labels {
+		if l == id {
+			return true
+		}
+	}
+	return false
+}
@@ -1,10 +1,19 @@
 package config
 
 import (
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// defaultSyncHeaders are the message headers persisted during sync in
+// addition to From/Subject/Date.
+const defaultSyncHeaders = "List-Id,List-Unsubscribe,To,Cc,Reply-To,X-Mailer,Precedence"
+
 // Config holds runtime configuration.
 type Config struct {
 	HttpAddr           string
@@ -12,6 +21,21 @@ type Config struct {
 	RedisURL           string // Changed from RedisAddr
 	GoogleClientID     string
 	GoogleClientSecret string
+	SyncHeaders        []string // Extra headers stored with each synced email
+
+	SchedulerConcurrency int           // Users cleaned in parallel by the scheduler
+	SchedulerJobTimeout  time.Duration // Limit on one user's scheduled clean
+
+	JobConcurrency int           // Background jobs (sync, clean, bulk) run in parallel
+	JobTimeout     time.Duration // Limit on one attempt of a background job
+
+	TokenKeys  map[string][]byte // OAuth token encryption keys by ID; empty stores tokens unencrypted
+	TokenKeyID string            // Key new tokens are encrypted with
+
+	SessionTTL time.Duration // How long a login lasts
+
+	FrontendURL   string   // Where users land after logging in
+	ReturnOrigins []string // Origins a login may return to besides FrontendURL
 }
 
 // Load loads from environment variables or .env.
@@ -22,6 +46,39 @@ func Load() (*Config, error) {
 		RedisURL:           os.Getenv("REDIS_URL"),
 		GoogleClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
 		GoogleClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
+		SyncHeaders:        splitList(getEnv("SYNC_HEADERS", defaultSyncHeaders)),
+		FrontendURL:        strings.TrimRight(getEnv("FRONTEND_URL", "http://localhost:3000"), "/"),
+		ReturnOrigins:      splitList(os.Getenv("RETURN_TO_ORIGINS")),
+	}
+
+	var err error
+	if cfg.SchedulerConcurrency, err = strconv.Atoi(getEnv("SCHEDULER_CONCURRENCY", "4")); err != nil || cfg.SchedulerConcurrency < 1 {
+		return nil, fmt.Errorf("SCHEDULER_CONCURRENCY must be a positive integer")
+	}
+	if cfg.SchedulerJobTimeout, err = time.ParseDuration(getEnv("SCHEDULER_JOB_TIMEOUT", "10m")); err != nil || cfg.SchedulerJobTimeout <= 0 {
+		return nil, fmt.Errorf("SCHEDULER_JOB_TIMEOUT must be a positive duration such as 10m")
+	}
+	if cfg.JobConcurrency, err = strconv.Atoi(getEnv("JOB_CONCURRENCY", "4")); err != nil || cfg.JobConcurrency < 1 {
+		return nil, fmt.Errorf("JOB_CONCURRENCY must be a positive integer")
+	}
+	if cfg.JobTimeout, err = time.ParseDuration(getEnv("JOB_TIMEOUT", "30m")); err != nil || cfg.JobTimeout <= 0 {
+		return nil, fmt.Errorf("JOB_TIMEOUT must be a positive duration such as 30m")
+	}
+
+	if cfg.SessionTTL, err = time.ParseDuration(getEnv("SESSION_TTL", "24h")); err != nil || cfg.SessionTTL <= 0 {
+		return nil, fmt.Errorf("SESSION_TTL must be a positive duration such as 24h")
+	}
+	if cfg.TokenKeys, err = parseKeys(os.Getenv("TOKEN_ENCRYPTION_KEYS")); err != nil {
+		return nil, fmt.Errorf("TOKEN_ENCRYPTION_KEYS: %w", err)
+	}
+	cfg.TokenKeyID = os.Getenv("TOKEN_ENCRYPTION_KEY_ID")
+	if cfg.TokenKeyID == "" && len(cfg.TokenKeys) == 1 {
+		for id := range cfg.TokenKeys {
+			cfg.TokenKeyID = id
+		}
+	}
+	if len(cfg.TokenKeys) > 0 && cfg.TokenKeys[cfg.TokenKeyID] == nil {
+		return nil, fmt.Errorf("TOKEN_ENCRYPTION_KEY_ID must name one of the TOKEN_ENCRYPTION_KEYS")
 	}
 
 	// Validate required fields
@@ -38,3 +95,35 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+// splitList parses a comma separated list, dropping empty entries.
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// parseKeys parses a comma separated list of id:base64 keys, each 32 bytes
+// for AES-256.
+func parseKeys(v string) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	for _, item := range splitList(v) {
+		id, encoded, ok := strings.Cut(item, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("%q is not an id:key pair", item)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("key %q must be 32 bytes, base64 encoded", id)
+		}
+		if keys[id] != nil {
+			return nil, fmt.Errorf("key %q is listed twice", id)
+		}
+		keys[id] = key
+	}
+	return keys, nil
+}
@@ -3,11 +3,14 @@ package database
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
 	"time"
 
+	"backend/internal/rules"
+
 	"github.com/lib/pq"
 	log "github.com/sirupsen/logrus"
 )
@@ -101,6 +104,176 @@ func Migrate(db *sql.DB) {
     ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS automation_time TEXT DEFAULT '00:00';
     ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS automation_runs_per_day INT NOT NULL DEFAULT 1;
     ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS last_history_id BIGINT;
+    -- IANA zone for automation times; existing schedules were on IST
+    ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS timezone TEXT NOT NULL DEFAULT 'Asia/Kolkata';
+
+    -- Cron schedules replace frequency + time; convert existing settings once
+    ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS automation_day_of_week TEXT NOT NULL DEFAULT 'sunday';
+    ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS automation_cron TEXT;
+    UPDATE user_settings SET automation_cron = CASE automation_frequency
+            WHEN 'hourly' THEN split_part(automation_time, ':', 2)::INT || ' * * * *'
+            WHEN 'weekly' THEN split_part(automation_time, ':', 2)::INT || ' ' || split_part(automation_time, ':', 1)::INT || ' * * 0'
+            ELSE split_part(automation_time, ':', 2)::INT || ' ' || split_part(automation_time, ':', 1)::INT || ' * * *'
+        END
+        WHERE automation_cron IS NULL AND automation_time ~ '^([01]?[0-9]|2[0-3]):[0-5][0-9]$';
+    -- Times out of range, like 25:99, would give a cron that never parses;
+    -- crons converted from them before this check are reset too
+    UPDATE user_settings SET automation_cron = '0 0 * * *' WHERE automation_cron IS NULL
+        OR (automation_cron ~ '^[0-9]{1,4} ' AND split_part(automation_cron, ' ', 1)::INT > 59)
+        OR (automation_cron ~ '^[0-9]{1,4} [0-9]{1,4} ' AND split_part(automation_cron, ' ', 2)::INT > 23);
+    -- The scheduler skips a user until this time
+    ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS paused_until TIMESTAMPTZ;
+    -- Safety limits for automated runs; 0 disables a limit. Existing users
+    -- keep running unlimited, new users get the defaults
+    ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS max_emails_per_run INT;
+    ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS max_mailbox_percent INT;
+    UPDATE user_settings SET max_emails_per_run = 0 WHERE max_emails_per_run IS NULL;
+    UPDATE user_settings SET max_mailbox_percent = 0 WHERE max_mailbox_percent IS NULL;
+    ALTER TABLE user_settings ALTER COLUMN max_emails_per_run SET DEFAULT 500, ALTER COLUMN max_emails_per_run SET NOT NULL;
+    ALTER TABLE user_settings ALTER COLUMN max_mailbox_percent SET DEFAULT 25, ALTER COLUMN max_mailbox_percent SET NOT NULL;
+    ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS quarantine_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+    ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS quarantine_days INT NOT NULL DEFAULT 7;
+
+    -- Slot of the last scheduled run, so restarts and other replicas skip it
+    ALTER TABLE user_settings ADD COLUMN IF NOT EXISTS last_scheduled_run TIMESTAMPTZ;
+
+	-- Condition trees for rules; flat rules become single-predicate trees
+	ALTER TABLE rules ADD COLUMN IF NOT EXISTS conditions JSONB;
+	UPDATE rules SET conditions = jsonb_build_object('type', type, 'value', value) WHERE conditions IS NULL;
+
+	-- Match operator for rule values (contains, equals, prefix, suffix, glob, regex)
+	ALTER TABLE rules ADD COLUMN IF NOT EXISTS match_op TEXT NOT NULL DEFAULT 'contains';
+
+	-- Extra headers kept from sync (List-Id, List-Unsubscribe, To, ...)
+	ALTER TABLE emails ADD COLUMN IF NOT EXISTS headers JSONB;
+
+	-- Gmail label IDs at sync time, for label rule conditions
+	ALTER TABLE emails ADD COLUMN IF NOT EXISTS label_ids TEXT[];
+
+	-- Explicit rule ordering (lower runs first) and stop-processing flag
+	ALTER TABLE rules ADD COLUMN IF NOT EXISTS priority INT;
+	ALTER TABLE rules ADD COLUMN IF NOT EXISTS stop BOOLEAN NOT NULL DEFAULT FALSE;
+	-- Seed priorities from the old newest-first order. Only the run that adds
+	-- the column sees NULLs, so explicit priorities are never overwritten
+	WITH ranked AS (
+		SELECT id, ROW_NUMBER() OVER (PARTITION BY user_id ORDER BY created_at DESC) AS rn FROM rules WHERE priority IS NULL
+	)
+	UPDATE rules SET priority = ranked.rn FROM ranked WHERE rules.id = ranked.id;
+	ALTER TABLE rules ALTER COLUMN priority SET DEFAULT 0, ALTER COLUMN priority SET NOT NULL;
+
+	-- Senders, domains and labels that destructive actions must never touch
+	CREATE TABLE IF NOT EXISTS protected_senders (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		user_id TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		value TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		UNIQUE (user_id, kind, value)
+	);
+
+	-- One row per manual or scheduled clean, with its outcome
+	CREATE TABLE IF NOT EXISTS automation_runs (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		user_id TEXT NOT NULL,
+		trigger TEXT NOT NULL,
+		status TEXT NOT NULL,
+		started_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		finished_at TIMESTAMPTZ,
+		rules_evaluated INT NOT NULL DEFAULT 0,
+		emails_matched INT NOT NULL DEFAULT 0,
+		action_counts JSONB NOT NULL DEFAULT '{}',
+		errors TEXT[] NOT NULL DEFAULT '{}',
+		outcomes JSONB NOT NULL DEFAULT '[]'
+	);
+	CREATE INDEX IF NOT EXISTS automation_runs_user_started ON automation_runs (user_id, started_at DESC);
+
+	-- Background jobs (sync, clean, bulk actions) run outside the request
+	CREATE TABLE IF NOT EXISTS jobs (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		user_id TEXT NOT NULL,
+		type TEXT NOT NULL,
+		payload JSONB NOT NULL DEFAULT '{}',
+		status TEXT NOT NULL,
+		attempts INT NOT NULL DEFAULT 0,
+		max_attempts INT NOT NULL DEFAULT 3,
+		run_after TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		lease_until TIMESTAMPTZ,
+		cancel_requested BOOLEAN NOT NULL DEFAULT FALSE,
+		last_error TEXT NOT NULL DEFAULT '',
+		result JSONB,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		finished_at TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS jobs_claimable ON jobs (run_after) WHERE status IN ('queued', 'running');
+	-- Every claim gets a new lease token, so a worker whose lease lapsed
+	-- can't touch the job once another worker holds it
+	ALTER TABLE jobs ADD COLUMN IF NOT EXISTS lease_token UUID;
+	-- Jobs with a dedup key run one at a time per user and key
+	ALTER TABLE jobs ADD COLUMN IF NOT EXISTS dedup_key TEXT;
+	CREATE UNIQUE INDEX IF NOT EXISTS jobs_dedup ON jobs (user_id, dedup_key) WHERE status IN ('queued', 'running');
+
+	-- Emails an automated DELETE labelled instead of trashing, until trash_after
+	-- or until the user releases them
+	CREATE TABLE IF NOT EXISTS quarantine (
+		user_id TEXT NOT NULL,
+		email_id TEXT NOT NULL,
+		rule_id TEXT NOT NULL DEFAULT '',
+		sender TEXT NOT NULL DEFAULT '',
+		subject TEXT NOT NULL DEFAULT '',
+		quarantined_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		trash_after TIMESTAMPTZ NOT NULL,
+		released_at TIMESTAMPTZ, -- kept so automation leaves the email alone
+		PRIMARY KEY (user_id, email_id)
+	);
+	CREATE INDEX IF NOT EXISTS quarantine_trash_after ON quarantine (trash_after);
+	-- A replica sweeping due emails claims them until then, so others skip them
+	ALTER TABLE quarantine ADD COLUMN IF NOT EXISTS claimed_until TIMESTAMPTZ;
+
+	-- What each clean did to every email and the labels it had, for undo
+	ALTER TABLE cleaning_history ADD COLUMN IF NOT EXISTS entries JSONB NOT NULL DEFAULT '[]';
+	ALTER TABLE cleaning_history ADD COLUMN IF NOT EXISTS undone_at TIMESTAMPTZ;
+
+	-- Accounts with one or more linked Gmail mailboxes. Every user_id column
+	-- above holds a mailbox ID.
+	CREATE TABLE IF NOT EXISTS users (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		email TEXT NOT NULL UNIQUE, -- the address the account signed up with
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+	CREATE TABLE IF NOT EXISTS mailboxes (
+		id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+		user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		email TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS mailboxes_user ON mailboxes (user_id, created_at);
+
+	-- Data used to be keyed by the Gmail address: give each address an
+	-- account and mailbox and move its rows to the mailbox ID. Moved rows
+	-- hold a UUID, so later runs change nothing.
+	INSERT INTO users (email)
+		SELECT user_id FROM user_settings WHERE user_id LIKE '%@%'
+		UNION SELECT user_id FROM rules WHERE user_id LIKE '%@%'
+		UNION SELECT user_id FROM emails WHERE user_id LIKE '%@%'
+		UNION SELECT user_id FROM cleaning_history WHERE user_id LIKE '%@%'
+		UNION SELECT user_id FROM protected_senders WHERE user_id LIKE '%@%'
+		UNION SELECT user_id FROM automation_runs WHERE user_id LIKE '%@%'
+	ON CONFLICT (email) DO NOTHING;
+	INSERT INTO mailboxes (user_id, email)
+		SELECT u.id, u.email FROM users u
+		WHERE NOT EXISTS (SELECT 1 FROM mailboxes m WHERE m.user_id = u.id)
+	ON CONFLICT (email) DO NOTHING;
+	UPDATE rules t SET user_id = m.id::text FROM mailboxes m WHERE t.user_id = m.email;
+	UPDATE emails t SET user_id = m.id::text FROM mailboxes m WHERE t.user_id = m.email;
+	UPDATE cleaning_history t SET user_id = m.id::text FROM mailboxes m WHERE t.user_id = m.email;
+	UPDATE user_settings t SET user_id = m.id::text FROM mailboxes m WHERE t.user_id = m.email;
+	UPDATE trash_state t SET user_id = m.id::text FROM mailboxes m WHERE t.user_id = m.email;
+	UPDATE protected_senders t SET user_id = m.id::text FROM mailboxes m WHERE t.user_id = m.email;
+	UPDATE automation_runs t SET user_id = m.id::text FROM mailboxes m WHERE t.user_id = m.email;
+	UPDATE jobs t SET user_id = m.id::text FROM mailboxes m WHERE t.user_id = m.email;
+	UPDATE quarantine t SET user_id = m.id::text FROM mailboxes m WHERE t.user_id = m.email;
 
 	`
 	_, err := db.Exec(migrationSQL)
@@ -161,14 +334,16 @@ func upsertEmailBatch(ctx context.Context, db *sql.DB, emails []Email) error {
 	defer tx.Rollback()
 
 	stmt, err := tx.PrepareContext(dbCtx, `
-		INSERT INTO emails (id, user_id, sender, subject, snippet, date, read)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		INSERT INTO emails (id, user_id, sender, subject, snippet, date, read, headers, label_ids)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 		ON CONFLICT (id) DO UPDATE SET
 			sender = EXCLUDED.sender,
 			subject = EXCLUDED.subject,
 			snippet = EXCLUDED.snippet,
 			date = EXCLUDED.date,
 			read = EXCLUDED.read,
+			headers = EXCLUDED.headers,
+			label_ids = EXCLUDED.label_ids,
 			updated_at = NOW();
 	`)
 	if err != nil {
@@ -177,7 +352,13 @@ func upsertEmailBatch(ctx context.Context, db *sql.DB, emails []Email) error {
 	defer stmt.Close()
 
 	for _, email := range emails {
-		if _, err := stmt.ExecContext(dbCtx, email.ID, email.UserID, email.Sender, email.Subject, email.Snippet, email.Date, email.Read); err != nil {
+		var headers []byte
+		if len(email.Headers) > 0 {
+			if headers, err = json.Marshal(email.Headers); err != nil {
+				return fmt.Errorf("failed to encode headers for email ID %s: %w", email.ID, err)
+			}
+		}
+		if _, err := stmt.ExecContext(dbCtx, email.ID, email.UserID, email.Sender, email.Subject, email.Snippet, email.Date, email.Read, headers, pq.Array(email.Labels)); err != nil {
 			log.Errorf("Database error on email ID %s: %v", email.ID, err)
 			return fmt.Errorf("failed to execute insert for email ID %s: %w", email.ID, err)
 		}
@@ -197,42 +378,70 @@ type User struct {
 	UpdatedAt time.Time `json:"updated_at"`
 }
 type Email struct {
-	ID        string    `json:"id"`
-	UserID    string    `json:"user_id"`
-	Sender    string    `json:"sender"`
-	Subject   string    `json:"subject"`
-	Snippet   string    `json:"snippet"`
-	Date      time.Time `json:"date"`
-	Read      bool      `json:"read"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID        string            `json:"id"`
+	UserID    string            `json:"user_id"`
+	Sender    string            `json:"sender"`
+	Subject   string            `json:"subject"`
+	Snippet   string            `json:"snippet"`
+	Date      time.Time         `json:"date"`
+	Read      bool              `json:"read"`
+	Headers   map[string]string `json:"headers,omitempty"` // extra synced headers, canonical names
+	Labels    []string          `json:"labels,omitempty"`  // Gmail label IDs at sync time
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
 }
 type Rule struct {
-	ID        string    `json:"id"`
-	UserID    string    `json:"user_id"`
-	Type      string    `json:"type"`
-	Value     string    `json:"value"`
-	Action    string    `json:"action"`
-	AgeDays   int       `json:"age_days"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID         string           `json:"id"`
+	UserID     string           `json:"user_id"`
+	Type       string           `json:"type"`
+	Value      string           `json:"value"`
+	Conditions *rules.Condition `json:"conditions"`
+	MatchOp    string           `json:"match_op"`
+	Action     string           `json:"action"`
+	AgeDays    int              `json:"age_days"`
+	Priority   int              `json:"priority"`
+	Stop       bool             `json:"stop"`
+	CreatedAt  time.Time        `json:"created_at"`
+	UpdatedAt  time.Time        `json:"updated_at"`
 }
+// CleaningHistory is one clean. Entries is only loaded by
+// GetCleaningHistory and is empty for cleans recorded before it existed.
 type CleaningHistory struct {
-	ID             string    `json:"id"`
-	UserID         string    `json:"user_id"`
-	Timestamp      time.Time `json:"timestamp"`
-	AffectedEmails []string  `json:"affected_emails"`
-	CreatedAt      time.Time `json:"created_at"`
-	UpdatedAt      time.Time `json:"updated_at"`
+	ID             string         `json:"id"`
+	UserID         string         `json:"user_id"`
+	Timestamp      time.Time      `json:"timestamp"`
+	AffectedEmails []string       `json:"affected_emails"`
+	Entries        []HistoryEntry `json:"entries,omitempty"`
+	UndoneAt       *time.Time     `json:"undone_at,omitempty"`
+	CreatedAt      time.Time      `json:"created_at"`
+	UpdatedAt      time.Time      `json:"updated_at"`
+}
+
+// HistoryEntry is what a clean did to one email and the Gmail labels the
+// email had before, so the clean can be undone.
+type HistoryEntry struct {
+	EmailID     string   `json:"email_id"`
+	Actions     []string `json:"actions"`
+	PriorLabels []string `json:"prior_labels,omitempty"` // label IDs; nil if they could not be read
+	Permanent   bool     `json:"permanent,omitempty"`    // deleted without the trash
 }
 type UserSettings struct {
-	UserID              string    `json:"user_id"`
-	AutomationEnabled   bool      `json:"automation_enabled"`
-	AutomationFrequency string    `json:"automation_frequency"`
-	AutomationTime      string    `json:"automation_time"`
-	LastHistoryID       uint64    `json:"last_history_id,omitempty"`
-	CreatedAt           time.Time `json:"created_at"`
-	UpdatedAt           time.Time `json:"updated_at"`
+	UserID              string     `json:"user_id"`
+	AutomationEnabled   bool       `json:"automation_enabled"`
+	AutomationFrequency string     `json:"automation_frequency"`
+	AutomationTime      string     `json:"automation_time"`
+	AutomationDayOfWeek string     `json:"automation_day_of_week"`
+	AutomationCron      string     `json:"automation_cron"`
+	Timezone            string     `json:"timezone"`
+	LastHistoryID       uint64     `json:"last_history_id,omitempty"`
+	LastScheduledRun    *time.Time `json:"last_scheduled_run,omitempty"`
+	PausedUntil         *time.Time `json:"paused_until,omitempty"`
+	MaxEmailsPerRun     int        `json:"max_emails_per_run"`  // 0 means no limit
+	MaxMailboxPercent   int        `json:"max_mailbox_percent"` // 0 means no limit
+	QuarantineEnabled   bool       `json:"quarantine_enabled"`
+	QuarantineDays      int        `json:"quarantine_days"`
+	CreatedAt           time.Time  `json:"created_at"`
+	UpdatedAt           time.Time  `json:"updated_at"`
 }
 
 type TrashState struct {
@@ -242,18 +451,84 @@ type TrashState struct {
     CreatedAt time.Time `json:"created_at"`
 }
 
+type ProtectedSender struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Kind      string    `json:"kind"`
+	Value     string    `json:"value"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// EngineProtection converts a stored allowlist entry for the rule engine.
+func (p ProtectedSender) EngineProtection() rules.Protection {
+	return rules.Protection{ID: p.ID, Kind: p.Kind, Value: p.Value}
+}
+
 type SenderAnalytic struct {
 	Sender string `json:"sender"`
 	Count  int    `json:"count"`
 }
 
 type CreateRuleParams struct {
-	ID      string `json:"id"`
-	UserID  string `json:"user_id"`
-	Type    string `json:"type"`
-	Value   string `json:"value"`
-	Action  string `json:"action"`
-	AgeDays int    `json:"age_days"`
+	ID         string           `json:"id"`
+	UserID     string           `json:"user_id"`
+	Type       string           `json:"type"`
+	Value      string           `json:"value"`
+	Conditions *rules.Condition `json:"conditions"`
+	MatchOp    string           `json:"match_op"`
+	Action     string           `json:"action"`
+	AgeDays    int              `json:"age_days"`
+	Priority   *int             `json:"priority"` // nil appends after the user's existing rules
+	Stop       bool             `json:"stop"`
+}
+
+type UpdateRuleParams struct {
+	ID         string           `json:"id"`
+	UserID     string           `json:"user_id"`
+	Type       string           `json:"type"`
+	Value      string           `json:"value"`
+	Conditions *rules.Condition `json:"conditions"`
+	MatchOp    string           `json:"match_op"`
+	Action     string           `json:"action"`
+	AgeDays    int              `json:"age_days"`
+	Priority   *int             `json:"priority"` // nil keeps the current priority
+	Stop       bool             `json:"stop"`
+}
+
+// EngineRule converts a stored rule into the rule engine's representation.
+func (r Rule) EngineRule() rules.Rule {
+	return rules.Rule{ID: r.ID, Type: r.Type, Value: r.Value, Condition: r.Conditions, MatchOp: r.MatchOp, Action: r.Action, AgeDays: r.AgeDays, Priority: r.Priority, Stop: r.Stop}
+}
+
+// EngineEmail converts a cached email into the rule engine's representation.
+func (e Email) EngineEmail() rules.Email {
+	return rules.Email{Sender: e.Sender, Subject: e.Subject, Snippet: e.Snippet, Date: e.Date, Read: e.Read, Headers: e.Headers, Labels: e.Labels}
+}
+
+const emailColumns = `id, user_id, sender, subject, snippet, date, read, headers, label_ids, created_at, updated_at`
+
+// scanEmail reads a row selected with emailColumns
+func scanEmail(row interface{ Scan(...interface{}) error }) (Email, error) {
+	var e Email
+	var headers []byte
+	if err := row.Scan(&e.ID, &e.UserID, &e.Sender, &e.Subject, &e.Snippet, &e.Date, &e.Read, &headers, pq.Array(&e.Labels), &e.CreatedAt, &e.UpdatedAt); err != nil {
+		return Email{}, err
+	}
+	if err := decodeHeaders(&e, headers); err != nil {
+		return Email{}, err
+	}
+	return e, nil
+}
+
+// decodeHeaders fills an email's headers from the JSONB column
+func decodeHeaders(e *Email, headers []byte) error {
+	if len(headers) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(headers, &e.Headers); err != nil {
+		return fmt.Errorf("invalid headers for email %s: %w", e.ID, err)
+	}
+	return nil
 }
 
 func DeleteEmail(ctx context.Context, id string) error {
@@ -274,7 +549,7 @@ func DeleteEmail(ctx context.Context, id string) error {
 func ListEmails(ctx context.Context, db *sql.DB, userEmail string, page, pageSize int, filter string) ([]Email, int, error) {
 	offset := (page - 1) * pageSize
 	listArgs := []interface{}{userEmail, pageSize, offset}
-	listQuery := `SELECT id, user_id, sender, subject, snippet, date, read, created_at, updated_at FROM emails WHERE user_id=$1`
+	listQuery := `SELECT ` + emailColumns + ` FROM emails WHERE user_id=$1`
 	if filter != "" {
 		listQuery += " AND (subject ILIKE $4 OR sender ILIKE $4)"
 		listArgs = append(listArgs, "%"+filter+"%")
@@ -287,8 +562,8 @@ func ListEmails(ctx context.Context, db *sql.DB, userEmail string, page, pageSiz
 	defer rows.Close()
 	var emails []Email
 	for rows.Next() {
-		var e Email
-		if err := rows.Scan(&e.ID, &e.UserID, &e.Sender, &e.Subject, &e.Snippet, &e.Date, &e.Read, &e.CreatedAt, &e.UpdatedAt); err != nil {
+		e, err := scanEmail(rows)
+		if err != nil {
 			return nil, 0, err
 		}
 		emails = append(emails, e)
@@ -309,7 +584,7 @@ func ListEmails(ctx context.Context, db *sql.DB, userEmail string, page, pageSiz
 	return emails, total, nil
 }
 func ListAllEmailsForUser(ctx context.Context, db *sql.DB, userEmail string) ([]Email, error) {
-	query := `SELECT id, user_id, sender, subject, snippet, date, read, created_at, updated_at
+	query := `SELECT ` + emailColumns + `
 			  FROM emails WHERE user_id=$1 ORDER BY date DESC`
 	rows, err := db.QueryContext(ctx, query, userEmail)
 	if err != nil {
@@ -318,8 +593,7 @@ func ListAllEmailsForUser(ctx context.Context, db *sql.DB, userEmail string) ([]
 	defer rows.Close()
 	var emails []Email
 	for rows.Next() {
-		var e Email
-		err := rows.Scan(&e.ID, &e.UserID, &e.Sender, &e.Subject, &e.Snippet, &e.Date, &e.Read, &e.CreatedAt, &e.UpdatedAt)
+		e, err := scanEmail(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -328,8 +602,63 @@ func ListAllEmailsForUser(ctx context.Context, db *sql.DB, userEmail string) ([]
 	return emails, nil
 }
 
+// GetEmailsByIDs returns the user's cached emails with the given IDs,
+// newest first. Unknown IDs are ignored.
+func GetEmailsByIDs(ctx context.Context, db *sql.DB, userEmail string, ids []string) ([]Email, error) {
+	rows, err := db.QueryContext(ctx, `SELECT `+emailColumns+`
+			  FROM emails WHERE user_id=$1 AND id = ANY($2) ORDER BY date DESC`, userEmail, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var emails []Email
+	for rows.Next() {
+		e, err := scanEmail(rows)
+		if err != nil {
+			return nil, err
+		}
+		emails = append(emails, e)
+	}
+	return emails, rows.Err()
+}
+
+const ruleColumns = `id, user_id, type, value, conditions, match_op, action, age_days, priority, stop, created_at, updated_at`
+
+// scanRule reads a row selected with ruleColumns
+func scanRule(row interface{ Scan(...interface{}) error }) (Rule, error) {
+	var r Rule
+	var conditions []byte
+	if err := row.Scan(&r.ID, &r.UserID, &r.Type, &r.Value, &conditions, &r.MatchOp, &r.Action, &r.AgeDays, &r.Priority, &r.Stop, &r.CreatedAt, &r.UpdatedAt); err != nil {
+		return Rule{}, err
+	}
+	if len(conditions) > 0 {
+		var cond rules.Condition
+		if err := json.Unmarshal(conditions, &cond); err != nil {
+			return Rule{}, fmt.Errorf("invalid conditions for rule %s: %w", r.ID, err)
+		}
+		r.Conditions = &cond
+	}
+	return r, nil
+}
+
+// marshalConditions falls back to a single-predicate tree for flat rules
+func marshalConditions(cond *rules.Condition, ruleType, value string) ([]byte, error) {
+	if cond == nil {
+		cond = rules.Predicate(ruleType, value)
+	}
+	return json.Marshal(cond)
+}
+
+// defaultMatchOp keeps callers that predate match operators on "contains"
+func defaultMatchOp(op string) string {
+	if op == "" {
+		return rules.MatchContains
+	}
+	return op
+}
+
 func ListRules(ctx context.Context, db *sql.DB, userEmail string) ([]Rule, error) {
-	query := `SELECT id, user_id, type, value, action, age_days, created_at, updated_at FROM rules WHERE user_id=$1 ORDER BY created_at DESC`
+	query := `SELECT ` + ruleColumns + ` FROM rules WHERE user_id=$1 ORDER BY priority ASC, created_at DESC`
 	rows, err := db.QueryContext(ctx, query, userEmail)
 	if err != nil {
 		return nil, err
@@ -337,8 +666,8 @@ func ListRules(ctx context.Context, db *sql.DB, userEmail string) ([]Rule, error
 	defer rows.Close()
 	var rules []Rule
 	for rows.Next() {
-		var r Rule
-		if err := rows.Scan(&r.ID, &r.UserID, &r.Type, &r.Value, &r.Action, &r.AgeDays, &r.CreatedAt, &r.UpdatedAt); err != nil {
+		r, err := scanRule(rows)
+		if err != nil {
 			return nil, err
 		}
 		rules = append(rules, r)
@@ -349,30 +678,73 @@ func ListRules(ctx context.Context, db *sql.DB, userEmail string) ([]Rule, error
 	return rules, nil
 }
 
+func GetRule(ctx context.Context, db *sql.DB, ruleID, userEmail string) (Rule, error) {
+	query := `SELECT ` + ruleColumns + ` FROM rules WHERE id=$1 AND user_id=$2`
+	rule, err := scanRule(db.QueryRowContext(ctx, query, ruleID, userEmail))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Rule{}, errors.New("rule not found or not owned by user")
+		}
+		return Rule{}, err
+	}
+	return rule, nil
+}
+
 func CreateRule(ctx context.Context, db *sql.DB, arg CreateRuleParams) (Rule, error) {
+	return insertRule(ctx, db, arg)
+}
+
+// CreateRules saves several rules in order, each appended after the last
+// unless it has a priority. Either all of them are saved or none.
+func CreateRules(ctx context.Context, db *sql.DB, args []CreateRuleParams) ([]Rule, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	created := make([]Rule, 0, len(args))
+	for _, arg := range args {
+		rule, err := insertRule(ctx, tx, arg)
+		if err != nil {
+			return nil, err
+		}
+		created = append(created, rule)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return created, nil
+}
+
+// insertRule runs CreateRule's insert on a database or transaction
+func insertRule(ctx context.Context, db interface {
+	QueryRowContext(context.Context, string, ...interface{}) *sql.Row
+}, arg CreateRuleParams) (Rule, error) {
+	conditions, err := marshalConditions(arg.Conditions, arg.Type, arg.Value)
+	if err != nil {
+		return Rule{}, err
+	}
 	query := `
-		INSERT INTO rules (id, user_id, type, value, action, age_days)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		RETURNING id, user_id, type, value, action, age_days, created_at, updated_at
-	`
-	var rule Rule
-	err := db.QueryRowContext(ctx, query, arg.ID, arg.UserID, arg.Type, arg.Value, arg.Action, arg.AgeDays).Scan(
-		&rule.ID, &rule.UserID, &rule.Type, &rule.Value, &rule.Action, &rule.AgeDays, &rule.CreatedAt, &rule.UpdatedAt,
-	)
-	return rule, err
+		INSERT INTO rules (id, user_id, type, value, conditions, match_op, action, age_days, priority, stop)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8,
+			COALESCE($9, (SELECT COALESCE(MAX(priority), 0) + 1 FROM rules WHERE user_id = $2)), $10)
+		RETURNING ` + ruleColumns
+	return scanRule(db.QueryRowContext(ctx, query, arg.ID, arg.UserID, arg.Type, arg.Value, conditions, defaultMatchOp(arg.MatchOp), arg.Action, arg.AgeDays, arg.Priority, arg.Stop))
 }
 
-func UpdateRule(ctx context.Context, db *sql.DB, ruleID, userEmail, ruleType, value, action string, ageDays int) (Rule, error) {
+func UpdateRule(ctx context.Context, db *sql.DB, arg UpdateRuleParams) (Rule, error) {
+	conditions, err := marshalConditions(arg.Conditions, arg.Type, arg.Value)
+	if err != nil {
+		return Rule{}, err
+	}
 	query := `
 		UPDATE rules
-		SET type = $3, value = $4, action = $5, age_days = $6, updated_at = NOW()
+		SET type = $3, value = $4, conditions = $5, match_op = $6, action = $7, age_days = $8,
+			priority = COALESCE($9, priority), stop = $10, updated_at = NOW()
 		WHERE id = $1 AND user_id = $2
-		RETURNING id, user_id, type, value, action, age_days, created_at, updated_at
-	`
-	var rule Rule
-	err := db.QueryRowContext(ctx, query, ruleID, userEmail, ruleType, value, action, ageDays).Scan(
-		&rule.ID, &rule.UserID, &rule.Type, &rule.Value, &rule.Action, &rule.AgeDays, &rule.CreatedAt, &rule.UpdatedAt,
-	)
+		RETURNING ` + ruleColumns
+	rule, err := scanRule(db.QueryRowContext(ctx, query, arg.ID, arg.UserID, arg.Type, arg.Value, conditions, defaultMatchOp(arg.MatchOp), arg.Action, arg.AgeDays, arg.Priority, arg.Stop))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return Rule{}, errors.New("rule not found or not owned by user")
@@ -382,6 +754,50 @@ func UpdateRule(ctx context.Context, db *sql.DB, ruleID, userEmail, ruleType, va
 	return rule, nil
 }
 
+// ReorderRules assigns priorities 1..n in the order given. ruleIDs must list
+// every rule the user owns exactly once.
+func ReorderRules(ctx context.Context, db *sql.DB, userEmail string, ruleIDs []string) ([]Rule, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var owned int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM rules WHERE user_id = $1`, userEmail).Scan(&owned); err != nil {
+		return nil, err
+	}
+	if owned != len(ruleIDs) {
+		return nil, errors.New("rule order must list every rule exactly once")
+	}
+
+	for i, id := range ruleIDs {
+		res, err := tx.ExecContext(ctx, `UPDATE rules SET priority = $3, updated_at = NOW() WHERE id = $1 AND user_id = $2`, id, userEmail, i+1)
+		if err != nil {
+			return nil, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return nil, err
+		} else if n == 0 {
+			return nil, errors.New("rule not found or not owned by user")
+		}
+	}
+
+	// Duplicated IDs would leave some rule with a stale priority
+	var distinct int
+	if err := tx.QueryRowContext(ctx, `SELECT COUNT(DISTINCT id) FROM rules WHERE user_id = $1 AND id = ANY($2)`, userEmail, pq.Array(ruleIDs)).Scan(&distinct); err != nil {
+		return nil, err
+	}
+	if distinct != len(ruleIDs) {
+		return nil, errors.New("rule order must list every rule exactly once")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return ListRules(ctx, db, userEmail)
+}
+
 func DeleteRule(ctx context.Context, db *sql.DB, ruleID, userEmail string) error {
 	query := `DELETE FROM rules WHERE id = $1 AND user_id = $2`
 	res, err := db.ExecContext(ctx, query, ruleID, userEmail)
@@ -398,22 +814,60 @@ func DeleteRule(ctx context.Context, db *sql.DB, ruleID, userEmail string) error
 	return nil
 }
 
-func CreateCleaningHistory(ctx context.Context, db *sql.DB, userID string, affectedEmails []string) (CleaningHistory, error) {
+func CreateCleaningHistory(ctx context.Context, db *sql.DB, userID string, entries []HistoryEntry) (CleaningHistory, error) {
+	affectedEmails := make([]string, len(entries))
+	for i, e := range entries {
+		affectedEmails[i] = e.EmailID
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return CleaningHistory{}, err
+	}
 	query := `
-		INSERT INTO cleaning_history (user_id, affected_emails, timestamp)
-		VALUES ($1, $2, NOW())
+		INSERT INTO cleaning_history (user_id, affected_emails, entries, timestamp)
+		VALUES ($1, $2, $3, NOW())
 		RETURNING id, user_id, timestamp, affected_emails, created_at, updated_at
 	`
-	var history CleaningHistory
-	err := db.QueryRowContext(ctx, query, userID, pq.Array(affectedEmails)).Scan(
+	history := CleaningHistory{Entries: entries}
+	err = db.QueryRowContext(ctx, query, userID, pq.Array(affectedEmails), data).Scan(
 		&history.ID, &history.UserID, &history.Timestamp, pq.Array(&history.AffectedEmails), &history.CreatedAt, &history.UpdatedAt,
 	)
 	return history, err
 }
 
+// GetCleaningHistory returns one clean with its per-email entries.
+func GetCleaningHistory(ctx context.Context, db *sql.DB, id, userID string) (CleaningHistory, error) {
+	var h CleaningHistory
+	var entries []byte
+	err := db.QueryRowContext(ctx, `
+		SELECT id, user_id, timestamp, affected_emails, entries, undone_at, created_at, updated_at
+		FROM cleaning_history
+		WHERE id = $1 AND user_id = $2
+	`, id, userID).Scan(&h.ID, &h.UserID, &h.Timestamp, pq.Array(&h.AffectedEmails), &entries, &h.UndoneAt, &h.CreatedAt, &h.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return h, errors.New("cleaning history not found")
+		}
+		return h, err
+	}
+	if err := json.Unmarshal(entries, &h.Entries); err != nil {
+		return h, err
+	}
+	return h, nil
+}
+
+// MarkCleaningUndone records that a clean was undone.
+func MarkCleaningUndone(ctx context.Context, db *sql.DB, id, userID string) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE cleaning_history SET undone_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND user_id = $2
+	`, id, userID)
+	return err
+}
+
 func ListCleaningHistory(ctx context.Context, db *sql.DB, userID string) ([]CleaningHistory, error) {
 	query := `
-		SELECT id, user_id, timestamp, affected_emails, created_at, updated_at
+		SELECT id, user_id, timestamp, affected_emails, undone_at, created_at, updated_at
 		FROM cleaning_history
 		WHERE user_id = $1
 		ORDER BY timestamp DESC
@@ -428,7 +882,7 @@ func ListCleaningHistory(ctx context.Context, db *sql.DB, userID string) ([]Clea
 	var histories []CleaningHistory
 	for rows.Next() {
 		var h CleaningHistory
-		if err := rows.Scan(&h.ID, &h.UserID, &h.Timestamp, pq.Array(&h.AffectedEmails), &h.CreatedAt, &h.UpdatedAt); err != nil {
+		if err := rows.Scan(&h.ID, &h.UserID, &h.Timestamp, pq.Array(&h.AffectedEmails), &h.UndoneAt, &h.CreatedAt, &h.UpdatedAt); err != nil {
 			return nil, err
 		}
 		histories = append(histories, h)
@@ -436,6 +890,57 @@ func ListCleaningHistory(ctx context.Context, db *sql.DB, userID string) ([]Clea
 	return histories, rows.Err()
 }
 
+func ListProtectedSenders(ctx context.Context, db *sql.DB, userID string) ([]ProtectedSender, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, user_id, kind, value, created_at
+		FROM protected_senders WHERE user_id = $1
+		ORDER BY kind, value
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []ProtectedSender
+	for rows.Next() {
+		var p ProtectedSender
+		if err := rows.Scan(&p.ID, &p.UserID, &p.Kind, &p.Value, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+
+func CreateProtectedSender(ctx context.Context, db *sql.DB, userID, kind, value string) (ProtectedSender, error) {
+	var p ProtectedSender
+	err := db.QueryRowContext(ctx, `
+		INSERT INTO protected_senders (user_id, kind, value)
+		VALUES ($1, $2, $3)
+		RETURNING id, user_id, kind, value, created_at
+	`, userID, kind, value).Scan(&p.ID, &p.UserID, &p.Kind, &p.Value, &p.CreatedAt)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return p, errors.New("sender already protected")
+	}
+	return p, err
+}
+
+func DeleteProtectedSender(ctx context.Context, db *sql.DB, id, userID string) error {
+	res, err := db.ExecContext(ctx, `DELETE FROM protected_senders WHERE id::text = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return errors.New("protected sender not found")
+	}
+	return nil
+}
+
 func GetTopSenders(ctx context.Context, db *sql.DB, userID string) ([]SenderAnalytic, error) {
 	query := `
 		SELECT sender, COUNT(*) as email_count
@@ -462,8 +967,16 @@ func GetTopSenders(ctx context.Context, db *sql.DB, userID string) ([]SenderAnal
 	return analytics, rows.Err()
 }
 
+const settingsColumns = `user_id, automation_enabled, automation_frequency, automation_time, automation_day_of_week, COALESCE(automation_cron, ''), timezone, COALESCE(last_history_id, 0), last_scheduled_run, paused_until, max_emails_per_run, max_mailbox_percent, quarantine_enabled, quarantine_days, created_at, updated_at`
+
+// scanSettings reads a row selected with settingsColumns
+func scanSettings(row interface{ Scan(...interface{}) error }) (UserSettings, error) {
+	var s UserSettings
+	err := row.Scan(&s.UserID, &s.AutomationEnabled, &s.AutomationFrequency, &s.AutomationTime, &s.AutomationDayOfWeek, &s.AutomationCron, &s.Timezone, &s.LastHistoryID, &s.LastScheduledRun, &s.PausedUntil, &s.MaxEmailsPerRun, &s.MaxMailboxPercent, &s.QuarantineEnabled, &s.QuarantineDays, &s.CreatedAt, &s.UpdatedAt)
+	return s, err
+}
+
 func GetUserSettings(ctx context.Context, db *sql.DB, userID string) (UserSettings, error) {
-	var settings UserSettings
 	// Upsert followed by Select to ensure a settings row always exists for a user.
 	upsertQuery := `INSERT INTO user_settings (user_id) VALUES ($1) ON CONFLICT (user_id) DO NOTHING;`
 	_, err := db.ExecContext(ctx, upsertQuery, userID)
@@ -471,14 +984,8 @@ func GetUserSettings(ctx context.Context, db *sql.DB, userID string) (UserSettin
 		return UserSettings{}, err
 	}
 
-	selectQuery := `
-        SELECT user_id, automation_enabled, automation_frequency, automation_time, COALESCE(last_history_id, 0), created_at, updated_at
-        FROM user_settings WHERE user_id = $1;
-    `
-	err = db.QueryRowContext(ctx, selectQuery, userID).Scan(
-		&settings.UserID, &settings.AutomationEnabled, &settings.AutomationFrequency, &settings.AutomationTime, &settings.LastHistoryID, &settings.CreatedAt, &settings.UpdatedAt,
-	)
-	return settings, err
+	selectQuery := `SELECT ` + settingsColumns + ` FROM user_settings WHERE user_id = $1;`
+	return scanSettings(db.QueryRowContext(ctx, selectQuery, userID))
 }
 
 func SaveTrashOrigin(ctx context.Context, db *sql.DB, userID, emailID string, hadInbox bool) error {
@@ -507,23 +1014,75 @@ func DeleteTrashOrigin(ctx context.Context, db *sql.DB, userID, emailID string)
     return err
 }
 
-func UpdateUserSettings(ctx context.Context, db *sql.DB, userID string, enabled bool, frequency string, timeOfDay string) (UserSettings, error) {
-	var settings UserSettings
+// UpdateUserSettingsParams holds the automation settings a user can change.
+// Cron is the schedule the scheduler runs; Frequency, TimeOfDay and DayOfWeek
+// are kept for display. An empty Timezone or DayOfWeek, or a nil safety
+// setting, keeps the stored value.
+type UpdateUserSettingsParams struct {
+	UserID    string
+	Enabled   bool
+	Frequency string
+	TimeOfDay string
+	DayOfWeek string
+	Cron      string
+	Timezone  string
+
+	MaxEmailsPerRun   *int
+	MaxMailboxPercent *int
+	QuarantineEnabled *bool
+	QuarantineDays    *int
+}
+
+func UpdateUserSettings(ctx context.Context, db *sql.DB, arg UpdateUserSettingsParams) (UserSettings, error) {
 	query := `
         UPDATE user_settings
-        SET automation_enabled = $2, automation_frequency = $3, automation_time = $4, updated_at = NOW()
+        SET automation_enabled = $2, automation_frequency = $3, automation_time = $4,
+            timezone = COALESCE(NULLIF($5, ''), timezone), automation_cron = $6,
+            automation_day_of_week = COALESCE(NULLIF($7, ''), automation_day_of_week),
+            max_emails_per_run = COALESCE($8, max_emails_per_run), max_mailbox_percent = COALESCE($9, max_mailbox_percent),
+            quarantine_enabled = COALESCE($10, quarantine_enabled), quarantine_days = COALESCE($11, quarantine_days), updated_at = NOW()
         WHERE user_id = $1
-        RETURNING user_id, automation_enabled, automation_frequency, automation_time, COALESCE(last_history_id, 0), created_at, updated_at
-	`
-	err := db.QueryRowContext(ctx, query, userID, enabled, frequency, timeOfDay).Scan(
-		&settings.UserID, &settings.AutomationEnabled, &settings.AutomationFrequency, &settings.AutomationTime, &settings.LastHistoryID, &settings.CreatedAt, &settings.UpdatedAt,
-	)
-	return settings, err
+        RETURNING ` + settingsColumns
+	return scanSettings(db.QueryRowContext(ctx, query, arg.UserID, arg.Enabled, arg.Frequency, arg.TimeOfDay, arg.Timezone, arg.Cron, arg.DayOfWeek,
+		arg.MaxEmailsPerRun, arg.MaxMailboxPercent, arg.QuarantineEnabled, arg.QuarantineDays))
+}
+
+// ClaimScheduledRun records slot as the user's last scheduled run. It
+// returns false when that slot, or a later one, was already recorded.
+func ClaimScheduledRun(ctx context.Context, db *sql.DB, userID string, slot time.Time) (bool, error) {
+	result, err := db.ExecContext(ctx, `
+        UPDATE user_settings SET last_scheduled_run = $2
+        WHERE user_id = $1 AND (last_scheduled_run IS NULL OR last_scheduled_run < $2)
+    `, userID, slot)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// ReleaseScheduledRun gives back a slot claimed with ClaimScheduledRun
+// whose run never started. Later slots are left alone.
+func ReleaseScheduledRun(ctx context.Context, db *sql.DB, userID string, slot time.Time) error {
+	_, err := db.ExecContext(ctx, `
+        UPDATE user_settings SET last_scheduled_run = NULL
+        WHERE user_id = $1 AND last_scheduled_run = $2
+    `, userID, slot)
+	return err
+}
+
+// SetAutomationPause makes the scheduler skip the user until the given
+// time. A nil until resumes automation.
+func SetAutomationPause(ctx context.Context, db *sql.DB, userID string, until *time.Time) (UserSettings, error) {
+	return scanSettings(db.QueryRowContext(ctx, `
+        INSERT INTO user_settings (user_id, paused_until) VALUES ($1, $2)
+        ON CONFLICT (user_id) DO UPDATE SET paused_until = EXCLUDED.paused_until, updated_at = NOW()
+        RETURNING `+settingsColumns, userID, until))
 }
 
 func ListAutomatedUsers(ctx context.Context, db *sql.DB) ([]UserSettings, error) {
 	rows, err := db.QueryContext(ctx, `
-        SELECT user_id, automation_enabled, automation_frequency, automation_time, COALESCE(last_history_id, 0), created_at, updated_at
+        SELECT ` + settingsColumns + `
         FROM user_settings WHERE automation_enabled = TRUE
     `)
 	if err != nil {
@@ -533,8 +1092,8 @@ func ListAutomatedUsers(ctx context.Context, db *sql.DB) ([]UserSettings, error)
 
 	var settingsList []UserSettings
 	for rows.Next() {
-		var s UserSettings
-		if err := rows.Scan(&s.UserID, &s.AutomationEnabled, &s.AutomationFrequency, &s.AutomationTime, &s.LastHistoryID, &s.CreatedAt, &s.UpdatedAt); err != nil {
+		s, err := scanSettings(rows)
+		if err != nil {
 			return nil, err
 		}
 		settingsList = append(settingsList, s)
@@ -546,6 +1105,12 @@ func ResetDB(ctx context.Context, db *sql.DB) error {
 	// The order matters here due to foreign key constraints if they existed.
 	// It's good practice to drop tables in the reverse order of creation.
     tables := []string{
+		"mailboxes",
+		"users",
+		"quarantine",
+		"jobs",
+		"automation_runs",
+		"protected_senders",
 		"user_settings",
         "trash_state",
 		"cleaning_history",
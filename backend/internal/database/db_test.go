@@ -0,0 +1,46 @@
+package database
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// TestMigrateKeepsRulePriorities checks that re-running migrations leaves
+// explicit priorities alone, including 0. It needs a Postgres database.
+func TestMigrateKeepsRulePriorities(t *testing.T) {
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TEST_POSTGRES_DSN not set")
+	}
+	db, err := ConnectDB(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	Migrate(db)
+
+	ctx := context.Background()
+	userID := "migrate-" + uuid.NewString()
+	defer db.ExecContext(context.Background(), `DELETE FROM rules WHERE user_id = $1`, userID)
+
+	zero := 0
+	for _, value := range []string{"older", "newer"} {
+		if _, err := CreateRule(ctx, db, CreateRuleParams{ID: uuid.NewString(), UserID: userID, Type: "sender", Value: value, Action: "DELETE", Priority: &zero}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	Migrate(db)
+
+	ruleset, err := ListRules(ctx, db, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range ruleset {
+		if r.Priority != 0 {
+			t.Errorf("rule %s has priority %d after migrating again, want 0", r.Value, r.Priority)
+		}
+	}
+}
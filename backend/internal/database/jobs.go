@@ -0,0 +1,207 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Job types
+const (
+	JobSync  = "sync"
+	JobClean = "clean"
+	JobBulk  = "bulk"
+
+	JobAutomation = "automation" // the scheduled clean, run on demand
+	JobUndo       = "undo"       // reverse a clean from cleaning_history
+)
+
+// Job statuses
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// Job is a unit of background work. Payload and Result are the JSON the job
+// handler reads and writes.
+type Job struct {
+	ID              string          `json:"id"`
+	UserID          string          `json:"user_id"`
+	Type            string          `json:"type"`
+	Payload         json.RawMessage `json:"payload"`
+	Status          string          `json:"status"`
+	Attempts        int             `json:"attempts"`
+	MaxAttempts     int             `json:"max_attempts"`
+	RunAfter        time.Time       `json:"run_after"`
+	CancelRequested bool            `json:"cancel_requested"`
+	LastError       string          `json:"last_error,omitempty"`
+	Result          json.RawMessage `json:"result,omitempty"`
+	CreatedAt       time.Time       `json:"created_at"`
+	UpdatedAt       time.Time       `json:"updated_at"`
+	FinishedAt      *time.Time      `json:"finished_at,omitempty"`
+	LeaseToken      string          `json:"-"` // set while claimed by a worker
+}
+
+// Finished reports whether the job has reached a final status.
+func (j Job) Finished() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed || j.Status == JobCancelled
+}
+
+const jobColumns = `id, user_id, type, payload, status, attempts, max_attempts, run_after, cancel_requested, last_error, result, created_at, updated_at, finished_at, lease_token`
+
+// scanJob reads a row selected with jobColumns
+func scanJob(row interface{ Scan(...interface{}) error }) (Job, error) {
+	var j Job
+	var payload, result []byte
+	var leaseToken sql.NullString
+	if err := row.Scan(&j.ID, &j.UserID, &j.Type, &payload, &j.Status, &j.Attempts, &j.MaxAttempts, &j.RunAfter, &j.CancelRequested, &j.LastError, &result, &j.CreatedAt, &j.UpdatedAt, &j.FinishedAt, &leaseToken); err != nil {
+		return Job{}, err
+	}
+	j.LeaseToken = leaseToken.String
+	j.Payload = payload
+	if result != nil {
+		j.Result = result
+	}
+	return j, nil
+}
+
+// EnqueueJob stores a new job that runs as soon as a worker is free.
+func EnqueueJob(ctx context.Context, db *sql.DB, userID, jobType string, payload interface{}, maxAttempts int) (Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Job{}, err
+	}
+	return scanJob(db.QueryRowContext(ctx, `
+		INSERT INTO jobs (user_id, type, payload, status, max_attempts)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+jobColumns, userID, jobType, data, JobQueued, maxAttempts))
+}
+
+// EnqueueUniqueJob is EnqueueJob for jobs that must not run concurrently:
+// while one of the user's jobs with the same dedup key is queued or
+// running, no other is queued.
+func EnqueueUniqueJob(ctx context.Context, db *sql.DB, userID, jobType, dedupKey string, payload interface{}, maxAttempts int) (Job, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Job{}, err
+	}
+	j, err := scanJob(db.QueryRowContext(ctx, `
+		INSERT INTO jobs (user_id, type, payload, status, max_attempts, dedup_key)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id, dedup_key) WHERE status IN ('queued', 'running') DO NOTHING
+		RETURNING `+jobColumns, userID, jobType, data, JobQueued, maxAttempts, dedupKey))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Job{}, errors.New("job already queued")
+	}
+	return j, err
+}
+
+// GetJob returns one of the user's jobs.
+func GetJob(ctx context.Context, db *sql.DB, id, userID string) (Job, error) {
+	j, err := scanJob(db.QueryRowContext(ctx, `
+		SELECT `+jobColumns+`
+		FROM jobs WHERE id::text = $1 AND user_id = $2
+	`, id, userID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Job{}, errors.New("job not found")
+	}
+	return j, err
+}
+
+// CancelJob cancels a queued job at once and asks the worker running a
+// running job to stop it.
+func CancelJob(ctx context.Context, db *sql.DB, id, userID string) (Job, error) {
+	j, err := scanJob(db.QueryRowContext(ctx, `
+		UPDATE jobs
+		SET status = CASE WHEN status = $3 THEN $4 ELSE status END,
+		    finished_at = CASE WHEN status = $3 THEN NOW() ELSE finished_at END,
+		    cancel_requested = TRUE,
+		    updated_at = NOW()
+		WHERE id::text = $1 AND user_id = $2 AND status IN ($3, $5)
+		RETURNING `+jobColumns, id, userID, JobQueued, JobCancelled, JobRunning))
+	if errors.Is(err, sql.ErrNoRows) {
+		// Either it doesn't exist or it has already finished
+		if existing, gerr := GetJob(ctx, db, id, userID); gerr != nil {
+			return Job{}, gerr
+		} else if existing.Finished() {
+			return Job{}, errors.New("job already finished")
+		}
+	}
+	return j, err
+}
+
+// ClaimJobs moves up to limit due jobs to running and leases them to the
+// caller under a fresh lease token. Running jobs whose lease has lapsed
+// belonged to a worker that died and are claimed again.
+func ClaimJobs(ctx context.Context, db *sql.DB, limit int, lease time.Duration) ([]Job, error) {
+	rows, err := db.QueryContext(ctx, `
+		UPDATE jobs
+		SET status = $2, attempts = attempts + 1, lease_until = NOW() + make_interval(secs => $3),
+		    lease_token = gen_random_uuid(), updated_at = NOW()
+		WHERE id IN (
+			SELECT id FROM jobs
+			WHERE (status = $4 AND run_after <= NOW())
+			   OR (status = $2 AND lease_until < NOW())
+			ORDER BY run_after
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+jobColumns, limit, JobRunning, lease.Seconds(), JobQueued)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// HeartbeatJob extends a running job's lease and reports whether the user
+// has asked for it to be cancelled.
+func HeartbeatJob(ctx context.Context, db *sql.DB, id, leaseToken string, lease time.Duration) (bool, error) {
+	var cancelRequested bool
+	err := db.QueryRowContext(ctx, `
+		UPDATE jobs SET lease_until = NOW() + make_interval(secs => $2), updated_at = NOW()
+		WHERE id = $1 AND status = $3 AND lease_token::text = $4
+		RETURNING cancel_requested
+	`, id, lease.Seconds(), JobRunning, leaseToken).Scan(&cancelRequested)
+	if errors.Is(err, sql.ErrNoRows) {
+		// The job was finished or re-leased elsewhere; stop working on it
+		return true, nil
+	}
+	return cancelRequested, err
+}
+
+// FinishJob stores a running job's final status, result and error. It does
+// nothing if the lease has passed to another worker.
+func FinishJob(ctx context.Context, db *sql.DB, id, leaseToken, status string, result []byte, lastErr string) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE jobs
+		SET status = $2, result = $3, last_error = $4, lease_until = NULL, lease_token = NULL, finished_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND status = $5 AND lease_token::text = $6
+	`, id, status, result, lastErr, JobRunning, leaseToken)
+	return err
+}
+
+// RetryJob puts a failed running job back in the queue until runAfter. It
+// does nothing if the lease has passed to another worker.
+func RetryJob(ctx context.Context, db *sql.DB, id, leaseToken, lastErr string, runAfter time.Time) error {
+	_, err := db.ExecContext(ctx, `
+		UPDATE jobs
+		SET status = $2, last_error = $3, run_after = $4, lease_until = NULL, lease_token = NULL, updated_at = NOW()
+		WHERE id = $1 AND status = $5 AND lease_token::text = $6
+	`, id, JobQueued, lastErr, runAfter, JobRunning, leaseToken)
+	return err
+}
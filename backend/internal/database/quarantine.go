@@ -0,0 +1,110 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// QuarantinedEmail is an email an automated DELETE labelled instead of
+// trashing. It is trashed after TrashAfter unless the user releases it;
+// released emails are remembered so automation does not quarantine them
+// again.
+type QuarantinedEmail struct {
+	UserID        string     `json:"user_id"`
+	EmailID       string     `json:"email_id"`
+	RuleID        string     `json:"rule_id"`
+	Sender        string     `json:"sender"`
+	Subject       string     `json:"subject"`
+	QuarantinedAt time.Time  `json:"quarantined_at"`
+	TrashAfter    time.Time  `json:"trash_after"`
+	ReleasedAt    *time.Time `json:"released_at,omitempty"`
+}
+
+const quarantineColumns = `user_id, email_id, rule_id, sender, subject, quarantined_at, trash_after, released_at`
+
+// scanQuarantined reads a row selected with quarantineColumns
+func scanQuarantined(row interface{ Scan(...interface{}) error }) (QuarantinedEmail, error) {
+	var q QuarantinedEmail
+	err := row.Scan(&q.UserID, &q.EmailID, &q.RuleID, &q.Sender, &q.Subject, &q.QuarantinedAt, &q.TrashAfter, &q.ReleasedAt)
+	return q, err
+}
+
+// QuarantineEmail records a quarantined email. Quarantining it again keeps
+// the original deadline and release.
+func QuarantineEmail(ctx context.Context, db *sql.DB, q QuarantinedEmail) error {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO quarantine (user_id, email_id, rule_id, sender, subject, trash_after)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (user_id, email_id) DO NOTHING
+	`, q.UserID, q.EmailID, q.RuleID, q.Sender, q.Subject, q.TrashAfter)
+	return err
+}
+
+// ListQuarantine returns a user's quarantined and released emails, soonest
+// deadline first.
+func ListQuarantine(ctx context.Context, db *sql.DB, userID string) ([]QuarantinedEmail, error) {
+	return queryQuarantine(ctx, db, `
+		SELECT `+quarantineColumns+` FROM quarantine
+		WHERE user_id = $1 ORDER BY trash_after
+	`, userID)
+}
+
+// ClaimDueQuarantine returns every user's quarantined emails whose deadline
+// has passed and claims them for the lease, so a sweep running at the same
+// time on another replica skips them. Emails still quarantined when the
+// claim runs out, because trashing them failed, are returned again.
+func ClaimDueQuarantine(ctx context.Context, db *sql.DB, now time.Time, lease time.Duration) ([]QuarantinedEmail, error) {
+	return queryQuarantine(ctx, db, `
+		UPDATE quarantine SET claimed_until = $1::TIMESTAMPTZ + make_interval(secs => $2)
+		WHERE (user_id, email_id) IN (
+			SELECT user_id, email_id FROM quarantine
+			WHERE released_at IS NULL AND trash_after <= $1 AND (claimed_until IS NULL OR claimed_until <= $1)
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+quarantineColumns, now, lease.Seconds())
+}
+
+func queryQuarantine(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]QuarantinedEmail, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []QuarantinedEmail
+	for rows.Next() {
+		q, err := scanQuarantined(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, q)
+	}
+	return list, rows.Err()
+}
+
+// ReleaseQuarantine keeps an email the user wants out of quarantine.
+func ReleaseQuarantine(ctx context.Context, db *sql.DB, userID, emailID string) error {
+	return changeQuarantine(ctx, db, `UPDATE quarantine SET released_at = NOW() WHERE user_id = $1 AND email_id = $2 AND released_at IS NULL`, userID, emailID)
+}
+
+// DeleteQuarantine forgets an email once it has been trashed.
+func DeleteQuarantine(ctx context.Context, db *sql.DB, userID, emailID string) error {
+	return changeQuarantine(ctx, db, `DELETE FROM quarantine WHERE user_id = $1 AND email_id = $2`, userID, emailID)
+}
+
+func changeQuarantine(ctx context.Context, db *sql.DB, query, userID, emailID string) error {
+	result, err := db.ExecContext(ctx, query, userID, emailID)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("quarantined email not found")
+	}
+	return nil
+}
@@ -0,0 +1,351 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/internal/rules"
+
+	"github.com/lib/pq"
+)
+
+// ruleFetchSize is how many matching emails are pulled from the cursor at a time
+const ruleFetchSize = 500
+
+// RuleMatch is a cached email together with which rules it matched.
+// Matched[i] corresponds to the i-th rule passed to StreamRuleMatches or
+// ListRuleMatches.
+type RuleMatch struct {
+	Email   Email
+	Matched []bool
+}
+
+// StreamRuleMatches evaluates rules inside Postgres and calls fn for every
+// email that matches at least one of them, newest first. Rules are compiled
+// into parameterised SQL with the same semantics as rules.Match, which stays
+// the reference implementation; rules using regex operators, whose syntax
+// differs between Go and Postgres, are evaluated with rules.Match on the
+// streamed rows instead. Rows are read through a cursor in batches so large
+// mailboxes are never held in memory.
+func StreamRuleMatches(ctx context.Context, db *sql.DB, userEmail string, ruleset []rules.Rule, fn func(RuleMatch) error) error {
+	if len(ruleset) == 0 {
+		return nil
+	}
+	query, args, fallback := compileRuleQuery(userEmail, ruleset, time.Now())
+	query += ` ORDER BY date DESC`
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DECLARE rule_matches NO SCROLL CURSOR FOR `+query, args...); err != nil {
+		return fmt.Errorf("failed to evaluate rules: %w", err)
+	}
+	for {
+		n, err := fetchRuleMatches(ctx, tx, ruleset, fallback, fn)
+		if err != nil {
+			return err
+		}
+		if n < ruleFetchSize {
+			break
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `CLOSE rule_matches`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// fetchRuleMatches reads one batch from the cursor and returns the row count
+func fetchRuleMatches(ctx context.Context, tx *sql.Tx, ruleset []rules.Rule, fallback []bool, fn func(RuleMatch) error) (int, error) {
+	rows, err := tx.QueryContext(ctx, `FETCH FORWARD `+strconv.Itoa(ruleFetchSize)+` FROM rule_matches`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		n++
+		m, ok, err := scanRuleMatch(rows, ruleset, fallback)
+		if err != nil {
+			return n, err
+		}
+		if !ok {
+			continue
+		}
+		if err := fn(m); err != nil {
+			return n, err
+		}
+	}
+	return n, rows.Err()
+}
+
+// RuleMatchCursor is the last email of a page of rule matches.
+type RuleMatchCursor struct {
+	Date time.Time
+	ID   string
+}
+
+// ListRuleMatches is StreamRuleMatches one page at a time: it evaluates up
+// to limit candidate emails older than after, or the newest if after is nil,
+// and returns those matching a rule along with the cursor for the next
+// page, which is nil once every email has been seen. A page can hold fewer
+// than limit matches, even none, while more follow. Pages are keyed on date
+// and ID rather than offset, so deleting matched emails between pages does
+// not skip any.
+func ListRuleMatches(ctx context.Context, db *sql.DB, userEmail string, ruleset []rules.Rule, after *RuleMatchCursor, limit int) ([]RuleMatch, *RuleMatchCursor, error) {
+	if len(ruleset) == 0 {
+		return nil, nil, nil
+	}
+	query, args, fallback := compileRuleQuery(userEmail, ruleset, time.Now())
+	query = `SELECT * FROM (` + query + `) AS page`
+	if after != nil {
+		args = append(args, after.Date, after.ID)
+		query += fmt.Sprintf(` WHERE (date, id) < ($%d::TIMESTAMPTZ, $%d::TEXT)`, len(args)-1, len(args))
+	}
+	args = append(args, limit)
+	query += fmt.Sprintf(` ORDER BY date DESC, id DESC LIMIT $%d`, len(args))
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to evaluate rules: %w", err)
+	}
+	defer rows.Close()
+
+	var matches []RuleMatch
+	var last RuleMatchCursor
+	n := 0
+	for rows.Next() {
+		n++
+		m, ok, err := scanRuleMatch(rows, ruleset, fallback)
+		if err != nil {
+			return nil, nil, err
+		}
+		last = RuleMatchCursor{Date: m.Email.Date, ID: m.Email.ID}
+		if ok {
+			matches = append(matches, m)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if n < limit {
+		return matches, nil, nil
+	}
+	return matches, &last, nil
+}
+
+// scanRuleMatch reads one candidate row, evaluates the fallback rules on it
+// and reports whether it matched any rule
+func scanRuleMatch(rows *sql.Rows, ruleset []rules.Rule, fallback []bool) (RuleMatch, bool, error) {
+	var m RuleMatch
+	var matched pq.BoolArray
+	var headers []byte
+	e := &m.Email
+	if err := rows.Scan(&e.ID, &e.UserID, &e.Sender, &e.Subject, &e.Snippet, &e.Date, &e.Read, &headers, pq.Array(&e.Labels), &e.CreatedAt, &e.UpdatedAt, &matched); err != nil {
+		return m, false, err
+	}
+	if err := decodeHeaders(e, headers); err != nil {
+		return m, false, err
+	}
+
+	m.Matched = []bool(matched)
+	matchedAny := false
+	for i := range ruleset {
+		if fallback[i] {
+			m.Matched[i] = rules.Match(e.EngineEmail(), ruleset[i])
+		}
+		matchedAny = matchedAny || m.Matched[i]
+	}
+	return m, matchedAny, nil
+}
+
+// compileRuleQuery builds the unordered candidate query. Each row carries a boolean
+// array with one entry per rule. fallback marks rules left to Go, whose
+// entries are always false in SQL. Those rules still narrow the candidates:
+// their regex predicates are assumed to match, or not, whichever lets the
+// most emails through, so an email is only fetched if the rule's other
+// conditions allow it to match. A rule that is only a regex makes every
+// email a candidate.
+func compileRuleQuery(userEmail string, ruleset []rules.Rule, now time.Time) (string, []interface{}, []bool) {
+	c := &ruleCompiler{args: []interface{}{userEmail}}
+	fallback := make([]bool, len(ruleset))
+	exprs := make([]string, len(ruleset))
+	candidates := []string{"TRUE = ANY(matched)"}
+	everyEmail := false
+	for i, r := range ruleset {
+		cond := r.Condition
+		if cond == nil {
+			cond = rules.Predicate(r.Type, r.Value)
+		}
+		if !c.compilable(*cond, r.MatchOp) {
+			fallback[i] = true
+			exprs[i] = "FALSE"
+			bound := c.bound(*cond, r.MatchOp, true)
+			if bound == "TRUE" && r.AgeDays <= 0 {
+				everyEmail = true
+			}
+			candidates = append(candidates, c.withAge(bound, r, now))
+			continue
+		}
+		exprs[i] = c.withAge(c.condition(*cond, r.MatchOp), r, now)
+	}
+
+	query := `SELECT ` + emailColumns + `, matched FROM (
+		SELECT ` + emailColumns + `, ARRAY[` + strings.Join(exprs, ", ") + `]::BOOLEAN[] AS matched
+		FROM emails WHERE user_id=$1
+	) AS candidates`
+	if !everyEmail {
+		query += ` WHERE ` + strings.Join(candidates, " OR ")
+	}
+	return query, c.args, fallback
+}
+
+// ruleCompiler turns condition trees into SQL, collecting bind parameters.
+// Every expression it produces is non-NULL so NOT behaves as in Go.
+type ruleCompiler struct {
+	args []interface{}
+}
+
+// param binds a value and returns its placeholder
+func (c *ruleCompiler) param(v interface{}) string {
+	c.args = append(c.args, v)
+	return "$" + strconv.Itoa(len(c.args))
+}
+
+// compilable reports whether a condition tree can be evaluated in SQL
+func (c *ruleCompiler) compilable(cond rules.Condition, defaultOp string) bool {
+	if cond.IsGroup() {
+		for _, child := range cond.Children {
+			if !c.compilable(child, defaultOp) {
+				return false
+			}
+		}
+		return true
+	}
+	op := cond.Match
+	if op == "" {
+		op = defaultOp
+	}
+	return op != rules.MatchRegex
+}
+
+// withAge adds the rule's age condition to a compiled condition tree
+func (c *ruleCompiler) withAge(expr string, r rules.Rule, now time.Time) string {
+	if r.AgeDays > 0 {
+		cutoff := now.Add(-time.Duration(r.AgeDays) * 24 * time.Hour)
+		expr = "(" + expr + " AND COALESCE(date, '-infinity') < " + c.param(cutoff) + "::TIMESTAMPTZ)"
+	}
+	return expr
+}
+
+// bound compiles a condition tree that cannot be evaluated in SQL into a
+// looser one that can: with upper set it holds for every email the tree
+// matches, otherwise only for emails the tree matches. Regex predicates
+// become TRUE or FALSE accordingly, flipping under NOT.
+func (c *ruleCompiler) bound(cond rules.Condition, defaultOp string, upper bool) string {
+	switch cond.Op {
+	case rules.OpAnd, rules.OpOr:
+		if len(cond.Children) == 0 {
+			return "FALSE"
+		}
+		parts := make([]string, len(cond.Children))
+		for i, child := range cond.Children {
+			parts[i] = c.bound(child, defaultOp, upper)
+		}
+		return "(" + strings.Join(parts, " "+cond.Op+" ") + ")"
+	case rules.OpNot:
+		if len(cond.Children) != 1 {
+			return "FALSE"
+		}
+		return "(NOT " + c.bound(cond.Children[0], defaultOp, !upper) + ")"
+	case "":
+		if c.compilable(cond, defaultOp) {
+			return c.condition(cond, defaultOp)
+		}
+		if upper {
+			return "TRUE"
+		}
+		return "FALSE"
+	}
+	return "FALSE"
+}
+
+// condition mirrors rules.Condition.evaluate
+func (c *ruleCompiler) condition(cond rules.Condition, defaultOp string) string {
+	switch cond.Op {
+	case rules.OpAnd, rules.OpOr:
+		if len(cond.Children) == 0 {
+			return "FALSE"
+		}
+		parts := make([]string, len(cond.Children))
+		for i, child := range cond.Children {
+			parts[i] = c.condition(child, defaultOp)
+		}
+		return "(" + strings.Join(parts, " "+cond.Op+" ") + ")"
+	case rules.OpNot:
+		if len(cond.Children) != 1 {
+			return "FALSE"
+		}
+		return "(NOT " + c.condition(cond.Children[0], defaultOp) + ")"
+	case "":
+		op := cond.Match
+		if op == "" {
+			op = defaultOp
+		}
+		return c.predicate(cond, op)
+	}
+	return "FALSE"
+}
+
+// predicate mirrors rules.Condition.matchPredicate
+func (c *ruleCompiler) predicate(cond rules.Condition, op string) string {
+	switch cond.Type {
+	case "sender":
+		return c.match("COALESCE(sender, '')", op, cond.Value)
+	case "subject":
+		return c.match("COALESCE(subject, '')", op, cond.Value)
+	case "keyword":
+		return "(" + c.match("COALESCE(subject, '')", op, cond.Value) + " OR " + c.match("COALESCE(snippet, '')", op, cond.Value) + ")"
+	case "header":
+		name := c.param(textproto.CanonicalMIMEHeaderKey(cond.Header))
+		present := "COALESCE(headers ? " + name + "::TEXT, FALSE)"
+		if cond.Value == "" {
+			return present
+		}
+		return "(" + present + " AND " + c.match("COALESCE(headers->>"+name+"::TEXT, '')", op, cond.Value) + ")"
+	case "label":
+		return "EXISTS (SELECT 1 FROM UNNEST(label_ids) AS l(name) WHERE " + c.match("COALESCE(l.name, '')", op, cond.Value) + ")"
+	case "read":
+		return "COALESCE(read, FALSE)"
+	}
+	return "FALSE"
+}
+
+// match mirrors rules.matchValue for every operator but regex
+func (c *ruleCompiler) match(field, op, value string) string {
+	switch op {
+	case "", rules.MatchContains:
+		return "(STRPOS(LOWER(" + field + "), LOWER(" + c.param(value) + "::TEXT)) > 0)"
+	case rules.MatchEquals:
+		return "(LOWER(" + field + ") = LOWER(" + c.param(value) + "::TEXT))"
+	case rules.MatchPrefix:
+		v := c.param(value)
+		return "(LEFT(LOWER(" + field + "), CHAR_LENGTH(" + v + "::TEXT)) = LOWER(" + v + "::TEXT))"
+	case rules.MatchSuffix:
+		v := c.param(value)
+		return "(RIGHT(LOWER(" + field + "), CHAR_LENGTH(" + v + "::TEXT)) = LOWER(" + v + "::TEXT))"
+	case rules.MatchGlob:
+		// (?p) stops . from matching newlines, as in Go
+		return "(" + field + " ~* " + c.param("(?p)^"+rules.GlobToRegex(value)+"$") + "::TEXT)"
+	}
+	return "FALSE"
+}
@@ -0,0 +1,358 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"backend/internal/rules"
+
+	"github.com/google/uuid"
+)
+
+// parityRules covers every predicate and operator, groups, age conditions
+// and regex rules, which are evaluated in Go after a narrowed fetch.
+var parityRules = []rules.Rule{
+	// sender
+	{Type: "sender", Value: "ALICE@example.com"},
+	{Type: "sender", Value: "bob@shop.test", MatchOp: rules.MatchEquals},
+	{Type: "sender", Value: "alice smith", MatchOp: rules.MatchPrefix},
+	{Type: "sender", Value: "EXAMPLE.COM>", MatchOp: rules.MatchSuffix},
+	{Type: "sender", Value: "*@*.example.com", MatchOp: rules.MatchGlob},
+	{Type: "sender", Value: "ÉLODIE <élodie@ÉCOLE.fr>", MatchOp: rules.MatchEquals},
+	{Type: "sender", Value: "é", MatchOp: rules.MatchPrefix},
+	// subject
+	{Type: "subject", Value: "invoice"},
+	{Type: "subject", Value: "weekly deals", MatchOp: rules.MatchEquals},
+	{Type: "subject", Value: "école réunion", MatchOp: rules.MatchEquals},
+	{Type: "subject", Value: "%"},
+	{Type: "subject", Value: "a_b"},
+	{Type: "subject", Value: "100% [promo]*", MatchOp: rules.MatchGlob},
+	{Type: "subject", Value: "*a?b\\*c*", MatchOp: rules.MatchGlob},
+	{Type: "subject", Value: "DUE", MatchOp: rules.MatchSuffix},
+	// keyword searches subject and snippet
+	{Type: "keyword", Value: "pay"},
+	{Type: "keyword", Value: "STRASSE"},
+	{Type: "keyword", Value: "STRAßE"},
+	{Type: "keyword", Value: "50%", MatchOp: rules.MatchPrefix},
+	{Type: "keyword", Value: "*off?everything", MatchOp: rules.MatchGlob},
+	// header, present or with a value, names in any case
+	{Condition: &rules.Condition{Type: "header", Header: "list-id"}},
+	{Condition: &rules.Condition{Type: "header", Header: "List-Unsubscribe"}},
+	{Condition: &rules.Condition{Type: "header", Header: "LIST-ID", Value: "news"}},
+	{Condition: &rules.Condition{Type: "header", Header: "x-tag", Value: "ÇA VA", Match: rules.MatchEquals}},
+	{Condition: &rules.Condition{Type: "header", Header: "X-Priority", Value: "1", Match: rules.MatchEquals}},
+	{Condition: &rules.Condition{Type: "header", Header: "List-Unsubscribe", Value: "", Match: rules.MatchEquals}},
+	// label
+	{Type: "label", Value: "inbox", MatchOp: rules.MatchEquals},
+	{Type: "label", Value: "CATEGORY_", MatchOp: rules.MatchPrefix},
+	{Type: "label", Value: "été"},
+	{Type: "label", Value: "*", MatchOp: rules.MatchGlob},
+	// read
+	{Type: "read"},
+	// groups
+	{Condition: &rules.Condition{Op: rules.OpAnd, Children: []rules.Condition{
+		{Type: "keyword", Value: "e"},
+		{Op: rules.OpNot, Children: []rules.Condition{{Type: "read"}}},
+	}}},
+	{Condition: &rules.Condition{Op: rules.OpOr, Children: []rules.Condition{
+		{Type: "label", Value: "IMPORTANT", Match: rules.MatchEquals},
+		{Type: "sender", Value: "shop.test", Match: rules.MatchSuffix},
+	}}},
+	{Condition: &rules.Condition{Op: rules.OpNot, Children: []rules.Condition{
+		{Op: rules.OpOr, Children: []rules.Condition{
+			{Type: "label", Value: "INBOX", Match: rules.MatchEquals},
+			{Op: rules.OpAnd, Children: []rules.Condition{
+				{Type: "header", Header: "X-Tag"},
+				{Op: rules.OpNot, Children: []rules.Condition{{Type: "subject", Value: "réunion"}}},
+			}},
+		}},
+	}}},
+	{Condition: &rules.Condition{Op: rules.OpNot, Children: []rules.Condition{{Type: "label", Value: "SPAM"}}}},
+	{Condition: &rules.Condition{Op: rules.OpNot, Children: []rules.Condition{{Type: "header", Header: "List-Id"}}}},
+	{Condition: &rules.Condition{Op: rules.OpAnd}},
+	{Condition: &rules.Condition{Op: rules.OpOr}},
+	{Condition: &rules.Condition{Op: rules.OpNot, Children: []rules.Condition{{Type: "read"}, {Type: "read"}}}},
+	// age
+	{Type: "keyword", Value: "e", AgeDays: 30},
+	{Type: "read", AgeDays: 30},
+	{Condition: &rules.Condition{Op: rules.OpNot, Children: []rules.Condition{{Type: "read"}}}, AgeDays: 5},
+	// regex, evaluated in Go
+	{Type: "sender", Value: "^alice", MatchOp: rules.MatchRegex},
+	{Type: "subject", Value: "deal", MatchOp: rules.MatchRegex, AgeDays: 30},
+	{Condition: &rules.Condition{Op: rules.OpAnd, Children: []rules.Condition{
+		{Type: "subject", Value: "^week", Match: rules.MatchRegex},
+		{Type: "read"},
+	}}},
+	{Condition: &rules.Condition{Op: rules.OpNot, Children: []rules.Condition{
+		{Op: rules.OpAnd, Children: []rules.Condition{
+			{Type: "label", Value: "^INBOX$", Match: rules.MatchRegex},
+			{Type: "sender", Value: "example"},
+		}},
+	}}},
+	{Condition: &rules.Condition{Op: rules.OpOr, Children: []rules.Condition{
+		{Type: "keyword", Value: "straße$", Match: rules.MatchRegex},
+		{Type: "label", Value: "IMPORTANT", Match: rules.MatchEquals},
+	}}},
+}
+
+// parityEmails exercises empty, NULL and non-ASCII values
+func parityEmails(now time.Time) []Email {
+	day := 24 * time.Hour
+	return []Email{
+		{
+			Sender:  "Alice Smith <alice@example.com>",
+			Subject: "Invoice #42 due",
+			Snippet: "Please pay the invoice",
+			Date:    now.Add(-2 * day),
+			Headers: map[string]string{"List-Id": "<news.example.com>", "X-Priority": "1"},
+			Labels:  []string{"INBOX", "CATEGORY_PROMOTIONS"},
+		},
+		{
+			Sender:  "bob@shop.test",
+			Subject: "Weekly deals",
+			Snippet: "50% off_everything",
+			Date:    now.Add(-90 * day),
+			Read:    true,
+			// Headers and labels stay NULL, as on rows synced before they existed
+		},
+		{
+			Sender:  "Élodie <élodie@école.fr>",
+			Subject: "ÉCOLE Réunion",
+			Snippet: "Ünïcödé straße",
+			Date:    now.Add(-40 * day),
+			Headers: map[string]string{"X-Tag": "Ça Va"},
+			Labels:  []string{"Label_Été"},
+		},
+		{
+			// Empty strings, empty label list and a zero date
+			Labels: []string{},
+		},
+		{
+			Sender:  "noreply@news.example.com",
+			Subject: "100% [promo] a_b*c?d",
+			Snippet: "",
+			Date:    now.Add(-10 * day),
+			Read:    true,
+			Headers: map[string]string{"List-Unsubscribe": ""},
+			Labels:  []string{"IMPORTANT", "SPAM"},
+		},
+	}
+}
+
+// TestRuleSQLParity checks that rules compiled to SQL select exactly the
+// emails rules.Match does. It needs a Postgres database to write to.
+func TestRuleSQLParity(t *testing.T) {
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TEST_POSTGRES_DSN not set")
+	}
+	db, err := ConnectDB(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	Migrate(db)
+
+	ctx := context.Background()
+	userID := "parity-" + uuid.NewString()
+	defer db.ExecContext(context.Background(), `DELETE FROM emails WHERE user_id = $1`, userID)
+
+	emails := parityEmails(time.Now())
+	ids := make([]string, len(emails))
+	for i := range emails {
+		emails[i].ID = userID + "-" + string(rune('a'+i))
+		emails[i].UserID = userID
+		ids[i] = emails[i].ID
+	}
+	if err := UpsertEmails(ctx, db, emails); err != nil {
+		t.Fatal(err)
+	}
+	// Compare against the emails as stored, e.g. with empty headers as NULL
+	stored, err := GetEmailsByIDs(ctx, db, userID, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != len(emails) {
+		t.Fatalf("stored %d emails, want %d", len(stored), len(emails))
+	}
+
+	for _, r := range parityRules {
+		r := r
+		t.Run(describeRule(r), func(t *testing.T) {
+			var want []string
+			for _, e := range stored {
+				if rules.Match(e.EngineEmail(), r) {
+					want = append(want, e.ID)
+				}
+			}
+			var got []string
+			err := StreamRuleMatches(ctx, db, userID, []rules.Rule{r}, func(m RuleMatch) error {
+				if !m.Matched[0] {
+					t.Errorf("email %s streamed without matching", m.Email.ID)
+				}
+				got = append(got, m.Email.ID)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(want)
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("SQL matched %v, rules.Match matched %v", got, want)
+			}
+		})
+	}
+
+	// All rules at once, checking every entry of the matched array
+	seen := make(map[string]bool)
+	err = StreamRuleMatches(ctx, db, userID, parityRules, func(m RuleMatch) error {
+		seen[m.Email.ID] = true
+		for i, r := range parityRules {
+			if want := rules.Match(m.Email.EngineEmail(), r); m.Matched[i] != want {
+				t.Errorf("email %s, rule %s: SQL %v, rules.Match %v", m.Email.ID, describeRule(r), m.Matched[i], want)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range stored {
+		if seen[e.ID] {
+			continue
+		}
+		for _, r := range parityRules {
+			if rules.Match(e.EngineEmail(), r) {
+				t.Errorf("email %s not streamed but matches rule %s", e.ID, describeRule(r))
+			}
+		}
+	}
+
+	// Small pages see the same emails, each once
+	paged := make(map[string]bool)
+	var after *RuleMatchCursor
+	for {
+		var page []RuleMatch
+		page, after, err = ListRuleMatches(ctx, db, userID, parityRules, after, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range page {
+			if paged[m.Email.ID] {
+				t.Errorf("email %s listed twice", m.Email.ID)
+			}
+			paged[m.Email.ID] = true
+		}
+		if after == nil {
+			break
+		}
+	}
+	if len(paged) != len(seen) {
+		t.Errorf("paging listed %d emails, streaming %d", len(paged), len(seen))
+	}
+	for id := range seen {
+		if !paged[id] {
+			t.Errorf("email %s streamed but not listed", id)
+		}
+	}
+}
+
+// TestCompileRuleQueryNarrowsRegexRules checks which emails are fetched
+// when some rules are left to Go.
+func TestCompileRuleQueryNarrowsRegexRules(t *testing.T) {
+	regexOnly := rules.Rule{Type: "subject", Value: "^re:", MatchOp: rules.MatchRegex}
+	regexAndSender := rules.Rule{Condition: &rules.Condition{Op: rules.OpAnd, Children: []rules.Condition{
+		{Type: "subject", Value: "^re:", Match: rules.MatchRegex},
+		{Type: "sender", Value: "example.com"},
+	}}}
+	notRegex := rules.Rule{Condition: &rules.Condition{Op: rules.OpNot, Children: []rules.Condition{
+		{Type: "subject", Value: "^re:", Match: rules.MatchRegex},
+	}}}
+	plain := rules.Rule{Type: "sender", Value: "example.com"}
+
+	tests := []struct {
+		name       string
+		ruleset    []rules.Rule
+		fallback   []bool
+		everyEmail bool
+	}{
+		{"compiled rules only", []rules.Rule{plain}, []bool{false}, false},
+		{"regex rule", []rules.Rule{plain, regexOnly}, []bool{false, true}, true},
+		{"regex ANDed with a compiled predicate", []rules.Rule{plain, regexAndSender}, []bool{false, true}, false},
+		{"negated regex", []rules.Rule{notRegex}, []bool{true}, false},
+		{"regex with an age", []rules.Rule{{Type: "subject", Value: "x", MatchOp: rules.MatchRegex, AgeDays: 7}}, []bool{true}, false},
+	}
+	placeholder := regexp.MustCompile(`\$(\d+)`)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, args, fallback := compileRuleQuery("user", tt.ruleset, time.Now())
+			for i := range tt.fallback {
+				if fallback[i] != tt.fallback[i] {
+					t.Errorf("fallback[%d] = %v, want %v", i, fallback[i], tt.fallback[i])
+				}
+			}
+			if filtered := strings.Contains(query, ") AS candidates WHERE"); filtered == tt.everyEmail {
+				t.Errorf("query filters candidates = %v, want %v:\n%s", filtered, !tt.everyEmail, query)
+			}
+			max := 0
+			for _, m := range placeholder.FindAllStringSubmatch(query, -1) {
+				if n, _ := strconv.Atoi(m[1]); n > max {
+					max = n
+				}
+			}
+			if max != len(args) {
+				t.Errorf("query uses %d placeholders but binds %d args", max, len(args))
+			}
+		})
+	}
+}
+
+// describeRule names a rule for test output
+func describeRule(r rules.Rule) string {
+	cond := r.Condition
+	if cond == nil {
+		cond = rules.Predicate(r.Type, r.Value)
+	}
+	var b strings.Builder
+	writeCondition(&b, *cond, r.MatchOp)
+	if r.AgeDays > 0 {
+		fmt.Fprintf(&b, " older than %dd", r.AgeDays)
+	}
+	return b.String()
+}
+
+func writeCondition(b *strings.Builder, c rules.Condition, defaultOp string) {
+	if c.IsGroup() {
+		b.WriteString(c.Op + "(")
+		for i, child := range c.Children {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			writeCondition(b, child, defaultOp)
+		}
+		b.WriteString(")")
+		return
+	}
+	op := c.Match
+	if op == "" {
+		op = defaultOp
+	}
+	if op == "" {
+		op = rules.MatchContains
+	}
+	b.WriteString(c.Type)
+	if c.Header != "" {
+		b.WriteString("[" + c.Header + "]")
+	}
+	if c.Type != "read" {
+		b.WriteString(" " + op + " " + c.Value)
+	}
+}
@@ -0,0 +1,212 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// What started an automation run
+const (
+	TriggerScheduled = "scheduled"
+	TriggerManual    = "manual"
+)
+
+// Automation run statuses
+const (
+	RunRunning   = "running"
+	RunSucceeded = "succeeded"
+	RunPartial   = "partial" // some actions failed
+	RunFailed    = "failed"  // the run could not complete
+)
+
+// Per-email outcomes
+const (
+	OutcomeApplied   = "applied"
+	OutcomeFailed    = "failed"
+	OutcomeProtected = "protected"
+	OutcomePlanned   = "planned" // dry run: the actions were not applied
+)
+
+// ActionCount tallies how often an action kind succeeded or failed in a run.
+type ActionCount struct {
+	Succeeded int `json:"succeeded"`
+	Failed    int `json:"failed"`
+}
+
+// EmailOutcome is what a run did to one matched email.
+type EmailOutcome struct {
+	EmailID string   `json:"email_id"`
+	Actions []string `json:"actions,omitempty"`
+	Status  string   `json:"status"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// AutomationRun records one manual or scheduled clean. Outcomes is only
+// loaded by GetAutomationRun.
+type AutomationRun struct {
+	ID             string                  `json:"id"`
+	UserID         string                  `json:"user_id"`
+	Trigger        string                  `json:"trigger"`
+	Status         string                  `json:"status"`
+	StartedAt      time.Time               `json:"started_at"`
+	FinishedAt     *time.Time              `json:"finished_at,omitempty"`
+	RulesEvaluated int                     `json:"rules_evaluated"`
+	EmailsMatched  int                     `json:"emails_matched"`
+	ActionCounts   map[string]*ActionCount `json:"action_counts"`
+	Errors         []string                `json:"errors"`
+	Outcomes       []EmailOutcome          `json:"outcomes,omitempty"`
+}
+
+// CountAction adds one success or failure for an action kind.
+func (r *AutomationRun) CountAction(kind string, ok bool) {
+	if r.ActionCounts == nil {
+		r.ActionCounts = make(map[string]*ActionCount)
+	}
+	c := r.ActionCounts[kind]
+	if c == nil {
+		c = &ActionCount{}
+		r.ActionCounts[kind] = c
+	}
+	if ok {
+		c.Succeeded++
+	} else {
+		c.Failed++
+	}
+}
+
+// Fail records an error that stopped the run.
+func (r *AutomationRun) Fail(err error) {
+	r.Errors = append(r.Errors, err.Error())
+	r.Status = RunFailed
+}
+
+// finalStatus derives the status of a finished run
+func (r *AutomationRun) finalStatus() string {
+	if r.Status == RunFailed {
+		return RunFailed
+	}
+	for _, c := range r.ActionCounts {
+		if c.Failed > 0 {
+			return RunPartial
+		}
+	}
+	if len(r.Errors) > 0 {
+		return RunPartial
+	}
+	return RunSucceeded
+}
+
+const runColumns = `id, user_id, trigger, status, started_at, finished_at, rules_evaluated, emails_matched, action_counts, errors`
+
+// scanRun reads a row selected with runColumns
+func scanRun(row interface{ Scan(...interface{}) error }) (AutomationRun, error) {
+	var r AutomationRun
+	var counts []byte
+	if err := row.Scan(&r.ID, &r.UserID, &r.Trigger, &r.Status, &r.StartedAt, &r.FinishedAt, &r.RulesEvaluated, &r.EmailsMatched, &counts, pq.Array(&r.Errors)); err != nil {
+		return AutomationRun{}, err
+	}
+	if err := json.Unmarshal(counts, &r.ActionCounts); err != nil {
+		return AutomationRun{}, err
+	}
+	return r, nil
+}
+
+// CreateAutomationRun inserts a run in the running state.
+func CreateAutomationRun(ctx context.Context, db *sql.DB, userID, trigger string) (*AutomationRun, error) {
+	run, err := scanRun(db.QueryRowContext(ctx, `
+		INSERT INTO automation_runs (user_id, trigger, status)
+		VALUES ($1, $2, $3)
+		RETURNING `+runColumns, userID, trigger, RunRunning))
+	if err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// FinishAutomationRun stores the run's totals, outcomes and final status.
+func FinishAutomationRun(ctx context.Context, db *sql.DB, run *AutomationRun) error {
+	run.Status = run.finalStatus()
+	now := time.Now()
+	run.FinishedAt = &now
+
+	counts, err := json.Marshal(run.ActionCounts)
+	if err != nil {
+		return err
+	}
+	if run.ActionCounts == nil {
+		counts = []byte("{}")
+	}
+	outcomes, err := json.Marshal(run.Outcomes)
+	if err != nil {
+		return err
+	}
+	if run.Outcomes == nil {
+		outcomes = []byte("[]")
+	}
+	errs := run.Errors
+	if errs == nil {
+		errs = []string{}
+	}
+
+	_, err = db.ExecContext(ctx, `
+		UPDATE automation_runs
+		SET status = $2, finished_at = $3, rules_evaluated = $4, emails_matched = $5,
+		    action_counts = $6, errors = $7, outcomes = $8
+		WHERE id = $1
+	`, run.ID, run.Status, now, run.RulesEvaluated, run.EmailsMatched, counts, pq.Array(errs), outcomes)
+	return err
+}
+
+// ListAutomationRuns returns a user's most recent runs without outcomes.
+func ListAutomationRuns(ctx context.Context, db *sql.DB, userID string, limit int) ([]AutomationRun, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT `+runColumns+`
+		FROM automation_runs WHERE user_id = $1
+		ORDER BY started_at DESC
+		LIMIT $2
+	`, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []AutomationRun
+	for rows.Next() {
+		r, err := scanRun(rows)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+// GetAutomationRun returns one run with its per-email outcomes.
+func GetAutomationRun(ctx context.Context, db *sql.DB, id, userID string) (AutomationRun, error) {
+	var outcomes []byte
+	row := db.QueryRowContext(ctx, `
+		SELECT `+runColumns+`, outcomes
+		FROM automation_runs WHERE id::text = $1 AND user_id = $2
+	`, id, userID)
+	var r AutomationRun
+	var counts []byte
+	err := row.Scan(&r.ID, &r.UserID, &r.Trigger, &r.Status, &r.StartedAt, &r.FinishedAt, &r.RulesEvaluated, &r.EmailsMatched, &counts, pq.Array(&r.Errors), &outcomes)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return AutomationRun{}, errors.New("automation run not found")
+		}
+		return AutomationRun{}, err
+	}
+	if err := json.Unmarshal(counts, &r.ActionCounts); err != nil {
+		return AutomationRun{}, err
+	}
+	if err := json.Unmarshal(outcomes, &r.Outcomes); err != nil {
+		return AutomationRun{}, err
+	}
+	return r, nil
+}
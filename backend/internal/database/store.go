@@ -3,6 +3,9 @@ package database
 import (
 	"context"
 	"database/sql"
+	"time"
+
+	"backend/internal/rules"
 )
 
 // PostgresStore wraps a sql.DB and exposes methods matching api.DataStore
@@ -17,11 +20,20 @@ func (s *PostgresStore) Migrate() { Migrate(s.db) }
 func (s *PostgresStore) ListRules(ctx context.Context, userEmail string) ([]Rule, error) {
 	return ListRules(ctx, s.db, userEmail)
 }
+func (s *PostgresStore) GetRule(ctx context.Context, ruleID, userEmail string) (Rule, error) {
+	return GetRule(ctx, s.db, ruleID, userEmail)
+}
 func (s *PostgresStore) CreateRule(ctx context.Context, arg CreateRuleParams) (Rule, error) {
 	return CreateRule(ctx, s.db, arg)
 }
-func (s *PostgresStore) UpdateRule(ctx context.Context, ruleID, userEmail, ruleType, value, action string, ageDays int) (Rule, error) {
-	return UpdateRule(ctx, s.db, ruleID, userEmail, ruleType, value, action, ageDays)
+func (s *PostgresStore) CreateRules(ctx context.Context, args []CreateRuleParams) ([]Rule, error) {
+	return CreateRules(ctx, s.db, args)
+}
+func (s *PostgresStore) UpdateRule(ctx context.Context, arg UpdateRuleParams) (Rule, error) {
+	return UpdateRule(ctx, s.db, arg)
+}
+func (s *PostgresStore) ReorderRules(ctx context.Context, userEmail string, ruleIDs []string) ([]Rule, error) {
+	return ReorderRules(ctx, s.db, userEmail, ruleIDs)
 }
 func (s *PostgresStore) DeleteRule(ctx context.Context, ruleID, userEmail string) error {
 	return DeleteRule(ctx, s.db, ruleID, userEmail)
@@ -33,6 +45,15 @@ func (s *PostgresStore) ListEmails(ctx context.Context, userEmail string, page,
 func (s *PostgresStore) ListAllEmailsForUser(ctx context.Context, userEmail string) ([]Email, error) {
 	return ListAllEmailsForUser(ctx, s.db, userEmail)
 }
+func (s *PostgresStore) GetEmailsByIDs(ctx context.Context, userEmail string, ids []string) ([]Email, error) {
+	return GetEmailsByIDs(ctx, s.db, userEmail, ids)
+}
+func (s *PostgresStore) StreamRuleMatches(ctx context.Context, userEmail string, ruleset []rules.Rule, fn func(RuleMatch) error) error {
+	return StreamRuleMatches(ctx, s.db, userEmail, ruleset, fn)
+}
+func (s *PostgresStore) ListRuleMatches(ctx context.Context, userEmail string, ruleset []rules.Rule, after *RuleMatchCursor, limit int) ([]RuleMatch, *RuleMatchCursor, error) {
+	return ListRuleMatches(ctx, s.db, userEmail, ruleset, after, limit)
+}
 func (s *PostgresStore) DeleteEmail(ctx context.Context, id string) error {
 	return DeleteEmail(ctx, id)
 }
@@ -40,13 +61,29 @@ func (s *PostgresStore) UpsertEmails(ctx context.Context, emails []Email) error
 	return UpsertEmails(ctx, s.db, emails)
 }
 
-func (s *PostgresStore) CreateCleaningHistory(ctx context.Context, userID string, affectedEmails []string) (CleaningHistory, error) {
-	return CreateCleaningHistory(ctx, s.db, userID, affectedEmails)
+func (s *PostgresStore) CreateCleaningHistory(ctx context.Context, userID string, entries []HistoryEntry) (CleaningHistory, error) {
+	return CreateCleaningHistory(ctx, s.db, userID, entries)
+}
+func (s *PostgresStore) GetCleaningHistory(ctx context.Context, id, userID string) (CleaningHistory, error) {
+	return GetCleaningHistory(ctx, s.db, id, userID)
+}
+func (s *PostgresStore) MarkCleaningUndone(ctx context.Context, id, userID string) error {
+	return MarkCleaningUndone(ctx, s.db, id, userID)
 }
 func (s *PostgresStore) ListCleaningHistory(ctx context.Context, userID string) ([]CleaningHistory, error) {
 	return ListCleaningHistory(ctx, s.db, userID)
 }
 
+func (s *PostgresStore) ListProtectedSenders(ctx context.Context, userID string) ([]ProtectedSender, error) {
+	return ListProtectedSenders(ctx, s.db, userID)
+}
+func (s *PostgresStore) CreateProtectedSender(ctx context.Context, userID, kind, value string) (ProtectedSender, error) {
+	return CreateProtectedSender(ctx, s.db, userID, kind, value)
+}
+func (s *PostgresStore) DeleteProtectedSender(ctx context.Context, id, userID string) error {
+	return DeleteProtectedSender(ctx, s.db, id, userID)
+}
+
 func (s *PostgresStore) GetTopSenders(ctx context.Context, userID string) ([]SenderAnalytic, error) {
 	return GetTopSenders(ctx, s.db, userID)
 }
@@ -54,10 +91,85 @@ func (s *PostgresStore) GetTopSenders(ctx context.Context, userID string) ([]Sen
 func (s *PostgresStore) GetUserSettings(ctx context.Context, userID string) (UserSettings, error) {
 	return GetUserSettings(ctx, s.db, userID)
 }
-func (s *PostgresStore) UpdateUserSettings(ctx context.Context, userID string, enabled bool, frequency string, timeOfDay string) (UserSettings, error) {
-    return UpdateUserSettings(ctx, s.db, userID, enabled, frequency, timeOfDay)
+func (s *PostgresStore) UpdateUserSettings(ctx context.Context, arg UpdateUserSettingsParams) (UserSettings, error) {
+    return UpdateUserSettings(ctx, s.db, arg)
 }
 
+func (s *PostgresStore) SetAutomationPause(ctx context.Context, userID string, until *time.Time) (UserSettings, error) {
+	return SetAutomationPause(ctx, s.db, userID, until)
+}
+func (s *PostgresStore) ClaimScheduledRun(ctx context.Context, userID string, slot time.Time) (bool, error) {
+	return ClaimScheduledRun(ctx, s.db, userID, slot)
+}
+func (s *PostgresStore) ReleaseScheduledRun(ctx context.Context, userID string, slot time.Time) error {
+	return ReleaseScheduledRun(ctx, s.db, userID, slot)
+}
+func (s *PostgresStore) CreateAutomationRun(ctx context.Context, userID, trigger string) (*AutomationRun, error) {
+	return CreateAutomationRun(ctx, s.db, userID, trigger)
+}
+func (s *PostgresStore) FinishAutomationRun(ctx context.Context, run *AutomationRun) error {
+	return FinishAutomationRun(ctx, s.db, run)
+}
+func (s *PostgresStore) ListAutomationRuns(ctx context.Context, userID string, limit int) ([]AutomationRun, error) {
+	return ListAutomationRuns(ctx, s.db, userID, limit)
+}
+func (s *PostgresStore) GetAutomationRun(ctx context.Context, id, userID string) (AutomationRun, error) {
+	return GetAutomationRun(ctx, s.db, id, userID)
+}
+func (s *PostgresStore) EnqueueJob(ctx context.Context, userID, jobType string, payload interface{}, maxAttempts int) (Job, error) {
+	return EnqueueJob(ctx, s.db, userID, jobType, payload, maxAttempts)
+}
+func (s *PostgresStore) EnqueueUniqueJob(ctx context.Context, userID, jobType, dedupKey string, payload interface{}, maxAttempts int) (Job, error) {
+	return EnqueueUniqueJob(ctx, s.db, userID, jobType, dedupKey, payload, maxAttempts)
+}
+func (s *PostgresStore) GetJob(ctx context.Context, id, userID string) (Job, error) {
+	return GetJob(ctx, s.db, id, userID)
+}
+func (s *PostgresStore) CancelJob(ctx context.Context, id, userID string) (Job, error) {
+	return CancelJob(ctx, s.db, id, userID)
+}
+func (s *PostgresStore) ClaimJobs(ctx context.Context, limit int, lease time.Duration) ([]Job, error) {
+	return ClaimJobs(ctx, s.db, limit, lease)
+}
+func (s *PostgresStore) HeartbeatJob(ctx context.Context, id, leaseToken string, lease time.Duration) (bool, error) {
+	return HeartbeatJob(ctx, s.db, id, leaseToken, lease)
+}
+func (s *PostgresStore) FinishJob(ctx context.Context, id, leaseToken, status string, result []byte, lastErr string) error {
+	return FinishJob(ctx, s.db, id, leaseToken, status, result, lastErr)
+}
+func (s *PostgresStore) RetryJob(ctx context.Context, id, leaseToken, lastErr string, runAfter time.Time) error {
+	return RetryJob(ctx, s.db, id, leaseToken, lastErr, runAfter)
+}
+func (s *PostgresStore) QuarantineEmail(ctx context.Context, q QuarantinedEmail) error {
+	return QuarantineEmail(ctx, s.db, q)
+}
+func (s *PostgresStore) ListQuarantine(ctx context.Context, userID string) ([]QuarantinedEmail, error) {
+	return ListQuarantine(ctx, s.db, userID)
+}
+func (s *PostgresStore) ClaimDueQuarantine(ctx context.Context, now time.Time, lease time.Duration) ([]QuarantinedEmail, error) {
+	return ClaimDueQuarantine(ctx, s.db, now, lease)
+}
+func (s *PostgresStore) ReleaseQuarantine(ctx context.Context, userID, emailID string) error {
+	return ReleaseQuarantine(ctx, s.db, userID, emailID)
+}
+func (s *PostgresStore) DeleteQuarantine(ctx context.Context, userID, emailID string) error {
+	return DeleteQuarantine(ctx, s.db, userID, emailID)
+}
+func (s *PostgresStore) SignInMailbox(ctx context.Context, email string) (User, Mailbox, error) {
+	return SignInMailbox(ctx, s.db, email)
+}
+func (s *PostgresStore) LinkMailbox(ctx context.Context, userID, email string) (Mailbox, error) {
+	return LinkMailbox(ctx, s.db, userID, email)
+}
+func (s *PostgresStore) GetUser(ctx context.Context, id string) (User, error) {
+	return GetUser(ctx, s.db, id)
+}
+func (s *PostgresStore) ListMailboxes(ctx context.Context, userID string) ([]Mailbox, error) {
+	return ListMailboxes(ctx, s.db, userID)
+}
+func (s *PostgresStore) ListAllMailboxes(ctx context.Context) ([]Mailbox, error) {
+	return ListAllMailboxes(ctx, s.db)
+}
 func (s *PostgresStore) ListAutomatedUsers(ctx context.Context) ([]UserSettings, error) {
 	return ListAutomatedUsers(ctx, s.db)
 }
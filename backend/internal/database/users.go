@@ -0,0 +1,121 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Mailbox is a Gmail account linked to a MailCleaner user. Rules, synced
+// emails, settings and tokens are all kept per mailbox, under its ID.
+type Mailbox struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const userColumns = `id, email, created_at, updated_at`
+
+func scanUser(row interface{ Scan(...interface{}) error }) (User, error) {
+	var u User
+	err := row.Scan(&u.ID, &u.Email, &u.CreatedAt, &u.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return u, errors.New("user not found")
+	}
+	return u, err
+}
+
+const mailboxColumns = `id, user_id, email, created_at`
+
+func scanMailbox(row interface{ Scan(...interface{}) error }) (Mailbox, error) {
+	var m Mailbox
+	err := row.Scan(&m.ID, &m.UserID, &m.Email, &m.CreatedAt)
+	if err == sql.ErrNoRows {
+		return m, errors.New("mailbox not found")
+	}
+	return m, err
+}
+
+// SignInMailbox returns the user a Gmail address signs in as, creating a
+// user with this address as its first mailbox if the address is new. An
+// address linked to another user signs in as that user.
+func SignInMailbox(ctx context.Context, db *sql.DB, email string) (User, Mailbox, error) {
+	mailbox, err := GetMailboxByEmail(ctx, db, email)
+	if err == nil {
+		user, err := GetUser(ctx, db, mailbox.UserID)
+		return user, mailbox, err
+	}
+	if err.Error() != "mailbox not found" {
+		return User{}, Mailbox{}, err
+	}
+
+	// Conflicts mean a concurrent sign-in created them first
+	if _, err := db.ExecContext(ctx, `INSERT INTO users (email) VALUES ($1) ON CONFLICT (email) DO NOTHING`, email); err != nil {
+		return User{}, Mailbox{}, err
+	}
+	user, err := scanUser(db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE email = $1`, email))
+	if err != nil {
+		return User{}, Mailbox{}, err
+	}
+	mailbox, err = LinkMailbox(ctx, db, user.ID, email)
+	return user, mailbox, err
+}
+
+// LinkMailbox adds a Gmail address to a user's mailboxes. Linking an address
+// the user already has returns it.
+func LinkMailbox(ctx context.Context, db *sql.DB, userID, email string) (Mailbox, error) {
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO mailboxes (user_id, email) VALUES ($1, $2)
+		ON CONFLICT (email) DO NOTHING
+	`, userID, email)
+	if err != nil {
+		return Mailbox{}, err
+	}
+	mailbox, err := GetMailboxByEmail(ctx, db, email)
+	if err != nil {
+		return mailbox, err
+	}
+	if mailbox.UserID != userID {
+		return mailbox, errors.New("mailbox is linked to another user")
+	}
+	return mailbox, nil
+}
+
+func GetUser(ctx context.Context, db *sql.DB, id string) (User, error) {
+	return scanUser(db.QueryRowContext(ctx, `SELECT `+userColumns+` FROM users WHERE id = $1`, id))
+}
+
+func GetMailboxByEmail(ctx context.Context, db *sql.DB, email string) (Mailbox, error) {
+	return scanMailbox(db.QueryRowContext(ctx, `SELECT `+mailboxColumns+` FROM mailboxes WHERE email = $1`, email))
+}
+
+// ListMailboxes returns a user's mailboxes, the one they signed up with
+// first.
+func ListMailboxes(ctx context.Context, db *sql.DB, userID string) ([]Mailbox, error) {
+	return queryMailboxes(ctx, db, `SELECT `+mailboxColumns+` FROM mailboxes WHERE user_id = $1 ORDER BY created_at`, userID)
+}
+
+// ListAllMailboxes returns every linked mailbox.
+func ListAllMailboxes(ctx context.Context, db *sql.DB) ([]Mailbox, error) {
+	return queryMailboxes(ctx, db, `SELECT `+mailboxColumns+` FROM mailboxes ORDER BY created_at`)
+}
+
+func queryMailboxes(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]Mailbox, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mailboxes []Mailbox
+	for rows.Next() {
+		m, err := scanMailbox(rows)
+		if err != nil {
+			return nil, err
+		}
+		mailboxes = append(mailboxes, m)
+	}
+	return mailboxes, rows.Err()
+}
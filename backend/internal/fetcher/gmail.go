@@ -14,6 +14,9 @@ import (
 
 type GmailFetcher struct {
 	srv *gmail.Service
+
+	labelMu  sync.Mutex
+	labelIDs map[string]string // lower-cased label name -> label ID
 }
 
 func NewGmailFetcher(ctx context.Context, tokenSource option.ClientOption) (*GmailFetcher, error) {
@@ -116,6 +119,71 @@ func (g *GmailFetcher) ArchiveMessage(userID, id string) error {
 	return err
 }
 
+// AddLabel applies a label by name, creating the label on first use.
+func (g *GmailFetcher) AddLabel(userID, id, labelName string) error {
+	labelID, err := g.resolveLabel(userID, labelName, true)
+	if err != nil {
+		return err
+	}
+	_, err = g.srv.Users.Messages.Modify(userID, id, &gmail.ModifyMessageRequest{
+		AddLabelIds: []string{labelID},
+	}).Do()
+	return err
+}
+
+// RemoveLabel removes a label by name. A label that does not exist is
+// treated as already removed.
+func (g *GmailFetcher) RemoveLabel(userID, id, labelName string) error {
+	labelID, err := g.resolveLabel(userID, labelName, false)
+	if err != nil || labelID == "" {
+		return err
+	}
+	_, err = g.srv.Users.Messages.Modify(userID, id, &gmail.ModifyMessageRequest{
+		RemoveLabelIds: []string{labelID},
+	}).Do()
+	return err
+}
+
+// resolveLabel maps a label name (or system label ID such as STARRED) to its
+// ID. Labels are listed once per fetcher and created through the Labels API
+// when create is set.
+func (g *GmailFetcher) resolveLabel(userID, labelName string, create bool) (string, error) {
+	g.labelMu.Lock()
+	defer g.labelMu.Unlock()
+
+	if g.labelIDs == nil {
+		resp, err := g.srv.Users.Labels.List(userID).Do()
+		if err != nil {
+			return "", err
+		}
+		g.labelIDs = make(map[string]string, len(resp.Labels)*2)
+		for _, l := range resp.Labels {
+			g.labelIDs[strings.ToLower(l.Name)] = l.Id
+			g.labelIDs[strings.ToLower(l.Id)] = l.Id
+		}
+	}
+
+	key := strings.ToLower(labelName)
+	if id, ok := g.labelIDs[key]; ok {
+		return id, nil
+	}
+	if !create {
+		return "", nil
+	}
+
+	label, err := g.srv.Users.Labels.Create(userID, &gmail.Label{
+		Name:                  labelName,
+		LabelListVisibility:   "labelShow",
+		MessageListVisibility: "show",
+	}).Do()
+	if err != nil {
+		return "", err
+	}
+	log.Infof("Created Gmail label %q (%s)", labelName, label.Id)
+	g.labelIDs[key] = label.Id
+	return label.Id, nil
+}
+
 // GetFullMessage fetches a single message with its full payload (body).
 func (g *GmailFetcher) GetFullMessage(userID, messageID string) (*gmail.Message, error) {
 	msg, err := g.srv.Users.Messages.Get(userID, messageID).Format("full").Do()
@@ -265,6 +333,26 @@ func (g *GmailFetcher) HasInboxLabel(userID, id string) (bool, error) {
     return false, nil
 }
 
+// GetLabelIDs returns the IDs of the labels the message currently has.
+func (g *GmailFetcher) GetLabelIDs(userID, id string) ([]string, error) {
+	msg, err := g.srv.Users.Messages.Get(userID, id).Format("minimal").Do()
+	if err != nil {
+		return nil, err
+	}
+	return msg.LabelIds, nil
+}
+
+// AddLabelIDs adds labels by ID, e.g. to restore the labels a message had.
+func (g *GmailFetcher) AddLabelIDs(userID, id string, labelIDs []string) error {
+	if len(labelIDs) == 0 {
+		return nil
+	}
+	_, err := g.srv.Users.Messages.Modify(userID, id, &gmail.ModifyMessageRequest{
+		AddLabelIds: labelIDs,
+	}).Do()
+	return err
+}
+
 // Add these new functions to internal/fetcher/gmail.go
 
 func (g *GmailFetcher) GetLabelMessageCount(userID string, labelID string) (int, error) {
@@ -0,0 +1,266 @@
+// Package jobs runs the background jobs stored in the jobs table on a
+// worker pool, with leases so a crashed process's jobs are picked up again,
+// retries with exponential backoff and cancellation.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"backend/internal/database"
+	"backend/internal/worker"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// pollInterval is how often the runner looks for due jobs when nothing
+	// wakes it sooner.
+	pollInterval = 2 * time.Second
+	// lease is how long a claimed job stays ours without a heartbeat.
+	lease = time.Minute
+
+	backoffBase = 30 * time.Second
+	backoffMax  = 15 * time.Minute
+)
+
+// Store is the persistence the runner needs.
+type Store interface {
+	ClaimJobs(ctx context.Context, limit int, lease time.Duration) ([]database.Job, error)
+	HeartbeatJob(ctx context.Context, id, leaseToken string, lease time.Duration) (bool, error)
+	FinishJob(ctx context.Context, id, leaseToken, status string, result []byte, lastErr string) error
+	RetryJob(ctx context.Context, id, leaseToken, lastErr string, runAfter time.Time) error
+}
+
+// Handler performs one job. The returned value is stored as the job's
+// result, also when the job fails or is cancelled part way.
+type Handler func(ctx context.Context, job database.Job) (interface{}, error)
+
+// permanentError marks a failure that retrying cannot fix.
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so the job fails without further attempts.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// Backoff returns how long to wait before the next attempt after the given
+// number of failed attempts: 30s, 1m, 2m, ... capped at 15m.
+func Backoff(attempts int) time.Duration {
+	d := backoffBase
+	for i := 1; i < attempts && d < backoffMax; i++ {
+		d *= 2
+	}
+	if d > backoffMax {
+		d = backoffMax
+	}
+	return d
+}
+
+// Runner claims due jobs and executes them on a worker pool.
+type Runner struct {
+	store    Store
+	size     int
+	pool     *worker.Pool
+	handlers map[string]Handler
+	wake     chan struct{}
+
+	mu      sync.Mutex
+	running int
+}
+
+// NewRunner creates a runner executing up to size jobs at once, each limited
+// to timeout.
+func NewRunner(store Store, size int, timeout time.Duration) *Runner {
+	if size < 1 {
+		size = 1
+	}
+	r := &Runner{
+		store:    store,
+		size:     size,
+		handlers: make(map[string]Handler),
+		wake:     make(chan struct{}, 1),
+	}
+	r.pool = worker.New(size,
+		worker.WithTimeout(timeout),
+		worker.WithResultHandler(func(res worker.Result) {
+			if res.Err != nil {
+				log.Errorf("Jobs: job %s failed after %s: %v", res.JobID, res.Duration.Round(time.Millisecond), res.Err)
+			} else {
+				log.Infof("Jobs: job %s finished in %s", res.JobID, res.Duration.Round(time.Millisecond))
+			}
+		}),
+	)
+	return r
+}
+
+// Register sets the handler for a job type. Call it before Run.
+func (r *Runner) Register(jobType string, h Handler) {
+	r.handlers[jobType] = h
+}
+
+// Notify makes the runner look for jobs now instead of at the next poll,
+// so a freshly enqueued job starts right away.
+func (r *Runner) Notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run starts the workers and the polling loop. Both stop when ctx is
+// cancelled; jobs interrupted that way are retried later.
+func (r *Runner) Run(ctx context.Context) {
+	r.pool.Run(ctx)
+	go func() {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			r.claim(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-r.wake:
+			}
+		}
+	}()
+}
+
+// claim leases as many due jobs as there are idle workers and submits them
+func (r *Runner) claim(ctx context.Context) {
+	r.mu.Lock()
+	free := r.size - r.running
+	r.mu.Unlock()
+	if free <= 0 {
+		return
+	}
+
+	claimed, err := r.store.ClaimJobs(ctx, free, lease)
+	if err != nil {
+		log.Errorf("Jobs: could not claim jobs: %v", err)
+		return
+	}
+	for _, job := range claimed {
+		job := job
+		r.mu.Lock()
+		r.running++
+		r.mu.Unlock()
+
+		err := r.pool.Submit(worker.Job{
+			ID:      job.ID,
+			Execute: func(ctx context.Context) error { return r.execute(ctx, job) },
+		})
+		if err == nil {
+			continue
+		}
+		r.mu.Lock()
+		r.running--
+		r.mu.Unlock()
+		if errors.Is(err, worker.ErrDuplicate) {
+			// Our lease lapsed while the job was still running here; the
+			// running copy keeps it
+			continue
+		}
+		if rerr := r.store.RetryJob(ctx, job.ID, job.LeaseToken, err.Error(), time.Now()); rerr != nil {
+			log.Errorf("Jobs: could not requeue job %s: %v", job.ID, rerr)
+		}
+	}
+}
+
+// execute runs one claimed job, keeps its lease alive and records how it ended
+func (r *Runner) execute(ctx context.Context, job database.Job) error {
+	defer func() {
+		r.mu.Lock()
+		r.running--
+		r.mu.Unlock()
+		r.Notify()
+	}()
+
+	handler, ok := r.handlers[job.Type]
+	if !ok {
+		err := fmt.Errorf("unknown job type %q", job.Type)
+		r.finish(ctx, job, database.JobFailed, nil, err)
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var cancelled bool
+	var cancelMu sync.Mutex
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				stop, err := r.store.HeartbeatJob(ctx, job.ID, job.LeaseToken, lease)
+				if err != nil {
+					log.Warnf("Jobs: heartbeat for job %s failed: %v", job.ID, err)
+					continue
+				}
+				if stop {
+					cancelMu.Lock()
+					cancelled = true
+					cancelMu.Unlock()
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	result, err := handler(ctx, job)
+	close(done)
+	cancelMu.Lock()
+	wasCancelled := cancelled
+	cancelMu.Unlock()
+
+	var perm *permanentError
+	switch {
+	case wasCancelled:
+		r.finish(ctx, job, database.JobCancelled, result, errors.New("cancelled"))
+		return nil
+	case err == nil:
+		r.finish(ctx, job, database.JobSucceeded, result, nil)
+	case errors.As(err, &perm) || job.Attempts >= job.MaxAttempts:
+		r.finish(ctx, job, database.JobFailed, result, err)
+	default:
+		retryAt := time.Now().Add(Backoff(job.Attempts))
+		if rerr := r.store.RetryJob(context.WithoutCancel(ctx), job.ID, job.LeaseToken, err.Error(), retryAt); rerr != nil {
+			log.Errorf("Jobs: could not schedule retry of job %s: %v", job.ID, rerr)
+		}
+	}
+	return err
+}
+
+// finish stores a job's final status, even when its context has ended
+func (r *Runner) finish(ctx context.Context, job database.Job, status string, result interface{}, jobErr error) {
+	var data []byte
+	if result != nil {
+		var err error
+		if data, err = json.Marshal(result); err != nil {
+			log.Errorf("Jobs: could not encode result of job %s: %v", job.ID, err)
+		}
+	}
+	var lastErr string
+	if jobErr != nil {
+		lastErr = jobErr.Error()
+	}
+	if err := r.store.FinishJob(context.WithoutCancel(ctx), job.ID, job.LeaseToken, status, data, lastErr); err != nil {
+		log.Errorf("Jobs: could not record job %s as %s: %v", job.ID, status, err)
+	}
+}
@@ -0,0 +1,40 @@
+package rules
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Actions a rule can take on a matching email
+const (
+	ActionDelete      = "DELETE"
+	ActionArchive     = "ARCHIVE"
+	ActionMarkRead    = "MARK_READ"
+	ActionAddLabel    = "ADD_LABEL"
+	ActionRemoveLabel = "REMOVE_LABEL"
+)
+
+// ParseAction splits an action such as "ADD_LABEL:Receipts" into its kind
+// and argument. Actions without an argument return an empty arg.
+func ParseAction(action string) (kind, arg string) {
+	kind, arg, _ = strings.Cut(action, ":")
+	return strings.ToUpper(strings.TrimSpace(kind)), strings.TrimSpace(arg)
+}
+
+// ValidateAction checks that an action is known and has the argument it needs.
+func ValidateAction(action string) error {
+	kind, arg := ParseAction(action)
+	switch kind {
+	case ActionDelete, ActionArchive, ActionMarkRead:
+		if arg != "" {
+			return fmt.Errorf("action %s does not take an argument", kind)
+		}
+	case ActionAddLabel, ActionRemoveLabel:
+		if arg == "" {
+			return fmt.Errorf("action %s requires a label name, e.g. %s:Receipts", kind, kind)
+		}
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+	return nil
+}
@@ -1,50 +1,231 @@
 package rules
 
 import (
+	"errors"
+	"fmt"
+	"net/textproto"
 	"strings"
 	"time"
 )
 
-// Rule struct now includes action and age
+// Group operators for a condition tree
+const (
+	OpAnd = "AND"
+	OpOr  = "OR"
+	OpNot = "NOT"
+)
+
+// maxConditionDepth keeps user supplied trees from nesting without bound
+const maxConditionDepth = 10
+
+// Condition is a node in a rule's condition tree. A node is either a group
+// (Op set, with Children) or a single predicate (Type and Value set).
+// Match overrides the rule's match operator for a single predicate.
+// Header names the header tested by a "header" predicate.
+type Condition struct {
+	Op       string      `json:"op,omitempty"`
+	Children []Condition `json:"children,omitempty"`
+	Type     string      `json:"type,omitempty"`
+	Header   string      `json:"header,omitempty"`
+	Value    string      `json:"value,omitempty"`
+	Match    string      `json:"match,omitempty"`
+}
+
+// Rule struct now includes action and age.
+// Condition takes precedence over Type/Value when set.
+// MatchOp is the default match operator for the rule's predicates.
+// Stop ends evaluation for an email once this rule has matched.
 type Rule struct {
-	Type    string
-	Value   string
-	Action  string
-	AgeDays int
+	ID        string
+	Type      string
+	Value     string
+	Condition *Condition
+	MatchOp   string
+	Action    string
+	AgeDays   int
+	Priority  int
+	Stop      bool
 }
 
-// Email struct now includes the date for age checking
+// Email struct now includes the date for age checking.
+// Headers holds the stored headers keyed by canonical header name and
+// Labels the Gmail label IDs the message had when it was synced.
 type Email struct {
 	Sender  string
 	Subject string
 	Snippet string
 	Date    time.Time
+	Read    bool
+	Headers map[string]string
+	Labels  []string
 }
 
-// Match checks if an email matches a rule, including the new age condition
-func Match(email Email, rule Rule) bool {
-	contentMatch := false
-	switch rule.Type {
+// Header returns the value of a stored header, matching the name
+// case-insensitively.
+func (e Email) Header(name string) (string, bool) {
+	v, ok := e.Headers[textproto.CanonicalMIMEHeaderKey(name)]
+	return v, ok
+}
+
+// Predicate builds a single-predicate condition, which is how flat
+// Type/Value rules are represented as a tree.
+func Predicate(ruleType, value string) *Condition {
+	return &Condition{Type: ruleType, Value: value}
+}
+
+// IsGroup reports whether the node is an AND/OR/NOT group.
+func (c Condition) IsGroup() bool {
+	return c.Op != ""
+}
+
+// condition returns the rule's tree, building one for flat rules
+func (r Rule) condition() *Condition {
+	if r.Condition != nil {
+		return r.Condition
+	}
+	return Predicate(r.Type, r.Value)
+}
+
+// Validate checks that the rule's condition tree is well formed and that
+// every pattern it uses compiles.
+func (r Rule) Validate() error {
+	if !ValidMatchOp(r.MatchOp) {
+		return fmt.Errorf("unknown match operator %q", r.MatchOp)
+	}
+	return r.condition().validate(r.MatchOp, 0)
+}
+
+func (c Condition) validate(defaultOp string, depth int) error {
+	if depth > maxConditionDepth {
+		return fmt.Errorf("conditions nested deeper than %d levels", maxConditionDepth)
+	}
+	if !c.IsGroup() {
+		switch c.Type {
+		case "sender", "subject", "keyword", "label":
+			if c.Value == "" {
+				return fmt.Errorf("%s predicate requires a value", c.Type)
+			}
+			return validateValue(c.matchOp(defaultOp), c.Value)
+		case "header":
+			if c.Header == "" {
+				return errors.New("header predicate requires a header name")
+			}
+			// An empty value only tests that the header is present
+			if c.Value == "" {
+				return nil
+			}
+			return validateValue(c.matchOp(defaultOp), c.Value)
+		case "read":
+		case "":
+			return errors.New("condition must have either an op or a type")
+		default:
+			return fmt.Errorf("unknown predicate type %q", c.Type)
+		}
+		return nil
+	}
+
+	switch c.Op {
+	case OpAnd, OpOr:
+		if len(c.Children) == 0 {
+			return fmt.Errorf("%s group requires at least one child", c.Op)
+		}
+	case OpNot:
+		if len(c.Children) != 1 {
+			return errors.New("NOT group requires exactly one child")
+		}
+	default:
+		return fmt.Errorf("unknown group operator %q", c.Op)
+	}
+	for _, child := range c.Children {
+		if err := child.validate(defaultOp, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchOp resolves the operator for a predicate
+func (c Condition) matchOp(defaultOp string) string {
+	if c.Match != "" {
+		return c.Match
+	}
+	return defaultOp
+}
+
+// evaluate reports whether the email satisfies the condition tree.
+func (c Condition) evaluate(email Email, rule Rule) bool {
+	switch c.Op {
+	case OpAnd:
+		for _, child := range c.Children {
+			if !child.evaluate(email, rule) {
+				return false
+			}
+		}
+		return len(c.Children) > 0
+	case OpOr:
+		for _, child := range c.Children {
+			if child.evaluate(email, rule) {
+				return true
+			}
+		}
+		return false
+	case OpNot:
+		if len(c.Children) != 1 {
+			return false
+		}
+		return !c.Children[0].evaluate(email, rule)
+	case "":
+		return c.matchPredicate(email, rule.ID, c.matchOp(rule.MatchOp))
+	default:
+		return false
+	}
+}
+
+// matchPredicate evaluates a single leaf of the condition tree
+func (c Condition) matchPredicate(email Email, ruleID, op string) bool {
+	switch c.Type {
 	case "sender":
-		// Use Contains for partial matches e.g. "John Doe <john@example.com>"
-		contentMatch = strings.Contains(strings.ToLower(email.Sender), strings.ToLower(rule.Value))
+		// The default contains operator allows partial matches e.g. "John Doe <john@example.com>"
+		return matchValue(ruleID, op, email.Sender, c.Value)
 	case "subject":
-		contentMatch = strings.Contains(strings.ToLower(email.Subject), strings.ToLower(rule.Value))
+		return matchValue(ruleID, op, email.Subject, c.Value)
 	case "keyword":
-		contentMatch = strings.Contains(strings.ToLower(email.Subject), strings.ToLower(rule.Value)) || strings.Contains(strings.ToLower(email.Snippet), strings.ToLower(rule.Value))
+		return matchValue(ruleID, op, email.Subject, c.Value) || matchValue(ruleID, op, email.Snippet, c.Value)
+	case "header":
+		v, ok := email.Header(c.Header)
+		if !ok {
+			return false
+		}
+		if c.Value == "" {
+			return true
+		}
+		return matchValue(ruleID, op, v, c.Value)
+	case "label":
+		for _, label := range email.Labels {
+			if matchValue(ruleID, op, label, c.Value) {
+				return true
+			}
+		}
+		return false
+	case "read":
+		return email.Read
 	default:
 		return false
 	}
+}
 
-	// If no age rule, the result is just the content match
+// Match checks if an email matches a rule, including the age condition
+func Match(email Email, rule Rule) bool {
+	return rule.condition().evaluate(email, rule) && oldEnough(email, rule)
+}
+
+// oldEnough applies the rule's age condition. Without an age rule every
+// email qualifies; otherwise the email must be older than specified.
+func oldEnough(email Email, rule Rule) bool {
 	if rule.AgeDays <= 0 {
-		return contentMatch
+		return true
 	}
-
-	// If there is an age rule, check if the email is older than specified
-	isOldEnough := time.Since(email.Date).Hours() > float64(rule.AgeDays*24)
-
-	return contentMatch && isOldEnough
+	return time.Since(email.Date).Hours() > float64(rule.AgeDays*24)
 }
 
 // ParseQuery returns keyword tokens very simplistically.
@@ -0,0 +1,98 @@
+package rules
+
+import "time"
+
+// Trace records how one node of a condition tree evaluated.
+type Trace struct {
+	Op       string  `json:"op,omitempty"`
+	Type     string  `json:"type,omitempty"`
+	Header   string  `json:"header,omitempty"`
+	Value    string  `json:"value,omitempty"`
+	Match    string  `json:"match,omitempty"`
+	Result   bool    `json:"result"`
+	Children []Trace `json:"children,omitempty"`
+}
+
+// Explanation is a structured account of why an email did or did not match
+// a rule. Matched always agrees with Match.
+type Explanation struct {
+	Matched           bool    `json:"matched"`
+	Condition         Trace   `json:"condition"`
+	MatchedPredicates []Trace `json:"matched_predicates,omitempty"`
+	AgeDays           int     `json:"age_days"`
+	EmailAgeDays      float64 `json:"email_age_days"`
+	AgeMatched        bool    `json:"age_matched"`
+	Action            string  `json:"action,omitempty"` // set only when the rule matched
+}
+
+// Explain evaluates a rule against an email and records every step.
+func Explain(email Email, rule Rule) Explanation {
+	trace := rule.condition().explain(email, rule)
+	exp := Explanation{
+		Condition:         trace,
+		MatchedPredicates: matchedPredicates(trace, nil),
+		AgeDays:           rule.AgeDays,
+		EmailAgeDays:      time.Since(email.Date).Hours() / 24,
+		AgeMatched:        oldEnough(email, rule),
+	}
+	exp.Matched = trace.Result && exp.AgeMatched
+	if exp.Matched {
+		exp.Action = rule.Action
+	}
+	return exp
+}
+
+// explain mirrors evaluate but visits every child so the trace is complete.
+func (c Condition) explain(email Email, rule Rule) Trace {
+	t := Trace{Op: c.Op, Type: c.Type, Header: c.Header, Value: c.Value}
+	if !c.IsGroup() {
+		t.Match = c.matchOp(rule.MatchOp)
+		t.Result = c.matchPredicate(email, rule.ID, t.Match)
+		return t
+	}
+
+	for _, child := range c.Children {
+		t.Children = append(t.Children, child.explain(email, rule))
+	}
+	switch c.Op {
+	case OpAnd:
+		t.Result = len(t.Children) > 0
+		for _, child := range t.Children {
+			t.Result = t.Result && child.Result
+		}
+	case OpOr:
+		for _, child := range t.Children {
+			t.Result = t.Result || child.Result
+		}
+	case OpNot:
+		t.Result = len(t.Children) == 1 && !t.Children[0].Result
+	}
+	return t
+}
+
+// matchedPredicates collects the leaves that made a matching condition tree
+// match: true leaves, or under a NOT false ones. Branches that did not count
+// towards the result, such as a failed child of an OR, are left out.
+func matchedPredicates(t Trace, acc []Trace) []Trace {
+	if !t.Result {
+		return acc
+	}
+	return decidingPredicates(t, true, acc)
+}
+
+// decidingPredicates collects the leaves that made t evaluate to want
+func decidingPredicates(t Trace, want bool, acc []Trace) []Trace {
+	if t.Result != want {
+		return acc
+	}
+	if t.Op == "" {
+		return append(acc, t)
+	}
+	if t.Op == OpNot {
+		want = !want
+	}
+	for _, child := range t.Children {
+		acc = decidingPredicates(child, want, acc)
+	}
+	return acc
+}
@@ -0,0 +1,52 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExplainMatchedPredicates(t *testing.T) {
+	sender := Condition{Type: "sender", Value: "shop.example"}
+	otherSender := Condition{Type: "sender", Value: "bank.example"}
+	subject := Condition{Type: "subject", Value: "sale"}
+	read := Condition{Type: "read"}
+
+	email := Email{Sender: "deals@shop.example", Subject: "Big sale", Read: true, Date: time.Now()}
+
+	tests := []struct {
+		name    string
+		cond    Condition
+		matched bool
+		want    string // matched predicates as type=value
+	}{
+		{"single", sender, true, "sender=shop.example"},
+		{"AND matched", Condition{Op: OpAnd, Children: []Condition{sender, subject}}, true, "sender=shop.example,subject=sale"},
+		{"AND failed", Condition{Op: OpAnd, Children: []Condition{sender, otherSender}}, false, ""},
+		{"OR lists only true branches", Condition{Op: OpOr, Children: []Condition{otherSender, subject}}, true, "subject=sale"},
+		{"OR failed", Condition{Op: OpOr, Children: []Condition{otherSender}}, false, ""},
+		{"NOT of true leaf", Condition{Op: OpNot, Children: []Condition{read}}, false, ""},
+		{"NOT of false leaf", Condition{Op: OpNot, Children: []Condition{otherSender}}, true, "sender=bank.example"},
+		{"NOT of failed AND", Condition{Op: OpAnd, Children: []Condition{
+			subject,
+			{Op: OpNot, Children: []Condition{{Op: OpAnd, Children: []Condition{sender, otherSender}}}},
+		}}, true, "subject=sale,sender=bank.example"},
+		{"NOT of failed OR", Condition{Op: OpNot, Children: []Condition{{Op: OpOr, Children: []Condition{otherSender, {Type: "label", Value: "STARRED"}}}}}, true, "sender=bank.example,label=STARRED"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cond := tt.cond
+			exp := Explain(email, Rule{ID: "r", Condition: &cond, Action: ActionDelete})
+			if exp.Matched != tt.matched || exp.Matched != Match(email, Rule{ID: "r", Condition: &cond}) {
+				t.Errorf("matched = %v, want %v", exp.Matched, tt.matched)
+			}
+			var got []string
+			for _, p := range exp.MatchedPredicates {
+				got = append(got, p.Type+"="+p.Value)
+			}
+			if strings.Join(got, ",") != tt.want {
+				t.Errorf("matched predicates = %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
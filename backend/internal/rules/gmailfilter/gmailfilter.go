@@ -0,0 +1,507 @@
+// Package gmailfilter translates between MailCleaner rules and the Atom XML
+// produced by Gmail's "Settings > Filters > Export".
+package gmailfilter
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"backend/internal/database"
+	"backend/internal/rules"
+)
+
+// Issue describes a filter property or rule that could not be represented
+// on the other side. Skipped is set when the whole filter or rule was dropped.
+type Issue struct {
+	Entry    string `json:"entry"` // filter ID on import, rule ID on export
+	Property string `json:"property,omitempty"`
+	Value    string `json:"value,omitempty"`
+	Reason   string `json:"reason"`
+	Skipped  bool   `json:"skipped"`
+}
+
+// Imported is a rule created from a filter, with the filter it came from.
+type Imported struct {
+	Entry  string // filter ID
+	Params database.CreateRuleParams
+}
+
+// Report lists everything that was lost in translation.
+type Report struct {
+	Issues []Issue `json:"issues"`
+}
+
+func (r *Report) add(entry, property, value, reason string, skipped bool) {
+	r.Issues = append(r.Issues, Issue{Entry: entry, Property: property, Value: value, Reason: reason, Skipped: skipped})
+}
+
+// Decoding ignores namespaces so both prefixed and default-namespace
+// documents are accepted.
+type feedIn struct {
+	Entries []entryIn `xml:"entry"`
+}
+
+type entryIn struct {
+	ID         string     `xml:"id"`
+	Properties []property `xml:"property"`
+}
+
+type property struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+// Encoding uses literal prefixed names to match Gmail's own export.
+type feedOut struct {
+	XMLName xml.Name   `xml:"feed"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Apps    string     `xml:"xmlns:apps,attr"`
+	Title   string     `xml:"title"`
+	ID      string     `xml:"id"`
+	Updated string     `xml:"updated"`
+	Entries []entryOut `xml:"entry"`
+}
+
+type entryOut struct {
+	Category   category   `xml:"category"`
+	Title      string     `xml:"title"`
+	ID         string     `xml:"id"`
+	Updated    string     `xml:"updated"`
+	Content    string     `xml:"content"`
+	Properties []property `xml:"apps:property"`
+}
+
+type category struct {
+	Term string `xml:"term,attr"`
+}
+
+// Gmail filter property names
+const (
+	propFrom          = "from"
+	propSubject       = "subject"
+	propHasTheWord    = "hasTheWord"
+	propLabel         = "label"
+	propTrash         = "shouldTrash"
+	propArchive       = "shouldArchive"
+	propMarkAsRead    = "shouldMarkAsRead"
+	propSizeOperator  = "sizeOperator"
+	propSizeUnit      = "sizeUnit"
+	gmailOrSeparator  = " OR "
+	filterIDTemplate  = "tag:mail.google.com,2008:filter:%d"
+	feedIDTemplate    = "tag:mail.google.com,2008:filters:%s"
+	atomNamespace     = "http://www.w3.org/2005/Atom"
+	appsNamespace     = "http://schemas.google.com/apps/2006"
+	defaultRuleAction = rules.ActionDelete
+)
+
+// predicateTypes maps condition properties to rule predicate types
+var predicateTypes = map[string]string{
+	propFrom:       "sender",
+	propSubject:    "subject",
+	propHasTheWord: "keyword",
+}
+
+var olderThan = regexp.MustCompile(`^older_than:(\d+)([dmy])$`)
+
+// Import parses a Gmail filter export. Each filter becomes one rule per
+// supported action, all sharing the filter's conditions. The returned
+// params have no ID or UserID set.
+func Import(r io.Reader) ([]Imported, Report, error) {
+	var report Report
+	var in feedIn
+	if err := xml.NewDecoder(r).Decode(&in); err != nil {
+		return nil, report, fmt.Errorf("invalid filter XML: %w", err)
+	}
+
+	var imported []Imported
+	for i, e := range in.Entries {
+		entryID := e.ID
+		if entryID == "" {
+			entryID = fmt.Sprintf("entry %d", i+1)
+		}
+
+		var conds []rules.Condition
+		var actions []string
+		ageDays := 0
+		for _, p := range e.Properties {
+			value := strings.TrimSpace(p.Value)
+			switch p.Name {
+			case propFrom, propSubject:
+				conds = append(conds, orPredicates(predicateTypes[p.Name], value))
+			case propHasTheWord:
+				words, age := splitSearchWords(value, entryID, &report)
+				if age > 0 {
+					ageDays = age
+				}
+				conds = append(conds, words...)
+			case propLabel:
+				actions = append(actions, rules.ActionAddLabel+":"+value)
+			case propMarkAsRead:
+				if value == "true" {
+					actions = append(actions, rules.ActionMarkRead)
+				}
+			case propArchive:
+				if value == "true" {
+					actions = append(actions, rules.ActionArchive)
+				}
+			case propTrash:
+				if value == "true" {
+					actions = append(actions, rules.ActionDelete)
+				}
+			case propSizeOperator, propSizeUnit:
+				// Gmail writes these on every filter; they only matter with "size"
+			default:
+				report.add(entryID, p.Name, value, "filter property is not supported", false)
+			}
+		}
+
+		if len(conds) == 0 {
+			report.add(entryID, "", "", "filter has no supported conditions", true)
+			continue
+		}
+		if len(actions) == 0 {
+			report.add(entryID, "", "", "filter has no supported actions", true)
+			continue
+		}
+
+		ruleType, value := "compound", ""
+		cond := &rules.Condition{Op: rules.OpAnd, Children: conds}
+		if len(conds) == 1 {
+			cond = &conds[0]
+			if !cond.IsGroup() {
+				ruleType, value = cond.Type, cond.Value
+			}
+		}
+		for _, action := range actions {
+			imported = append(imported, Imported{Entry: entryID, Params: database.CreateRuleParams{
+				Type:       ruleType,
+				Value:      value,
+				Conditions: cond,
+				MatchOp:    rules.MatchContains,
+				Action:     action,
+				AgeDays:    ageDays,
+			}})
+		}
+	}
+	return imported, report, nil
+}
+
+// orPredicates turns "a OR b" into an OR group of predicates
+func orPredicates(ruleType, value string) rules.Condition {
+	value = strings.TrimSuffix(strings.TrimPrefix(value, "("), ")")
+	parts := strings.Split(value, gmailOrSeparator)
+	if len(parts) == 1 {
+		return *rules.Predicate(ruleType, strings.TrimSpace(value))
+	}
+	group := rules.Condition{Op: rules.OpOr}
+	for _, part := range parts {
+		group.Children = append(group.Children, *rules.Predicate(ruleType, strings.TrimSpace(part)))
+	}
+	return group
+}
+
+// splitSearchWords turns a Gmail search into keyword conditions. Gmail
+// requires every word, so each word, quoted phrase or "a OR b" becomes its
+// own condition, to be ANDed with the others; a word excluded with "-"
+// becomes a NOT. The only operator understood is older_than, which becomes
+// the rule's age.
+func splitSearchWords(value, entryID string, report *Report) ([]rules.Condition, int) {
+	var groups [][]rules.Condition
+	ageDays := 0
+	or := false
+	for _, token := range searchTokens(value) {
+		if token.text == "OR" && !token.negated {
+			or = len(groups) > 0
+			continue
+		}
+		if m := olderThan.FindStringSubmatch(token.text); m != nil && !token.negated {
+			n, _ := strconv.Atoi(m[1])
+			switch m[2] {
+			case "d":
+				ageDays = n
+			case "m":
+				ageDays = n * 30
+			case "y":
+				ageDays = n * 365
+			}
+			or = false
+			continue
+		}
+		if strings.Contains(token.text, ":") {
+			text := token.text
+			if token.negated {
+				text = "-" + text
+			}
+			report.add(entryID, propHasTheWord, text, "Gmail search operator is not supported", false)
+			or = false
+			continue
+		}
+		cond := *rules.Predicate("keyword", token.text)
+		if token.negated {
+			cond = rules.Condition{Op: rules.OpNot, Children: []rules.Condition{cond}}
+		}
+		if or {
+			groups[len(groups)-1] = append(groups[len(groups)-1], cond)
+		} else {
+			groups = append(groups, []rules.Condition{cond})
+		}
+		or = false
+	}
+
+	conds := make([]rules.Condition, 0, len(groups))
+	for _, group := range groups {
+		if len(group) == 1 {
+			conds = append(conds, group[0])
+			continue
+		}
+		conds = append(conds, rules.Condition{Op: rules.OpOr, Children: group})
+	}
+	return conds, ageDays
+}
+
+// searchToken is a word or quoted phrase of a Gmail search
+type searchToken struct {
+	text    string
+	negated bool // written with a leading "-"
+}
+
+// searchTokens splits a Gmail search into words, keeping quoted phrases
+// together and dropping the parentheses around OR groups.
+func searchTokens(value string) []searchToken {
+	var tokens []searchToken
+	var b strings.Builder
+	quoted, negated := false, false
+	flush := func() {
+		if b.Len() > 0 {
+			tokens = append(tokens, searchToken{text: b.String(), negated: negated})
+			b.Reset()
+			negated = false
+		}
+	}
+	for _, r := range value {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			flush()
+		case quoted:
+			b.WriteRune(r)
+		case r == '-' && b.Len() == 0 && !negated:
+			negated = true
+		case r == '(' || r == ')' || r == ' ' || r == '\t':
+			flush()
+			if r != '(' {
+				negated = false // a lone "-" excludes nothing
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	flush()
+	return tokens
+}
+
+// Export writes rules as a Gmail filter feed. Rules with identical
+// conditions are merged into one filter where their actions allow it.
+func Export(w io.Writer, ruleset []database.Rule, now time.Time) (Report, error) {
+	var report Report
+	out := feedOut{
+		Xmlns:   atomNamespace,
+		Apps:    appsNamespace,
+		Title:   "Mail Filters",
+		ID:      fmt.Sprintf(feedIDTemplate, strconv.FormatInt(now.Unix(), 10)),
+		Updated: now.UTC().Format(time.RFC3339),
+	}
+
+	type pending struct {
+		key   string
+		props map[string]string
+	}
+	var filters []*pending
+
+	for _, r := range ruleset {
+		props, err := conditionProperties(r)
+		if err != nil {
+			report.add(r.ID, "", "", err.Error(), true)
+			continue
+		}
+		actionProp, actionValue, err := actionProperty(r.Action)
+		if err != nil {
+			report.add(r.ID, "action", r.Action, err.Error(), true)
+			continue
+		}
+		if r.Stop {
+			report.add(r.ID, "stop", "true", "Gmail filters cannot stop later filters; exported without it", false)
+		}
+
+		key := propertyKey(props)
+		var target *pending
+		for _, f := range filters {
+			if _, taken := f.props[actionProp]; f.key == key && !taken {
+				target = f
+				break
+			}
+		}
+		if target == nil {
+			target = &pending{key: key, props: props}
+			filters = append(filters, target)
+		}
+		target.props[actionProp] = actionValue
+	}
+
+	for i, f := range filters {
+		e := entryOut{
+			Category: category{Term: "filter"},
+			Title:    "Mail Filter",
+			ID:       fmt.Sprintf(filterIDTemplate, now.Unix()*1000+int64(i)),
+			Updated:  out.Updated,
+		}
+		names := make([]string, 0, len(f.props))
+		for name := range f.props {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			e.Properties = append(e.Properties, property{Name: name, Value: f.props[name]})
+		}
+		out.Entries = append(out.Entries, e)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return report, err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// conditionProperties maps a rule's conditions to Gmail properties. Only
+// contains-matching sender/subject/keyword predicates, optionally ORed per
+// property and ANDed across properties, have a Gmail equivalent.
+func conditionProperties(r database.Rule) (map[string]string, error) {
+	cond := r.Conditions
+	if cond == nil {
+		cond = rules.Predicate(r.Type, r.Value)
+	}
+	props := make(map[string]string)
+
+	parts := []rules.Condition{*cond}
+	if cond.Op == rules.OpAnd {
+		parts = cond.Children
+	}
+	for _, part := range parts {
+		name, value, err := partProperty(part, r.MatchOp)
+		if err != nil {
+			return nil, err
+		}
+		if prev, dup := props[name]; dup {
+			// Gmail requires every search word, so keywords combine
+			if name != propHasTheWord {
+				return nil, fmt.Errorf("Gmail filters allow only one %s condition", name)
+			}
+			value = prev + " " + value
+		}
+		props[name] = value
+	}
+
+	if r.AgeDays > 0 {
+		age := fmt.Sprintf("older_than:%dd", r.AgeDays)
+		if words := props[propHasTheWord]; words != "" {
+			age = words + " " + age
+		}
+		props[propHasTheWord] = age
+	}
+	return props, nil
+}
+
+// partProperty maps a predicate, or an OR of same-typed predicates, to one property
+func partProperty(c rules.Condition, defaultOp string) (string, string, error) {
+	leaves := []rules.Condition{c}
+	if c.Op == rules.OpOr {
+		leaves = c.Children
+	} else if c.IsGroup() && c.Op != rules.OpNot {
+		return "", "", fmt.Errorf("%s groups have no Gmail filter equivalent", c.Op)
+	}
+
+	var name string
+	var values []string
+	for _, leaf := range leaves {
+		negated := false
+		if leaf.Op == rules.OpNot && len(leaf.Children) == 1 && leaf.Children[0].Type == "keyword" {
+			// Gmail excludes a word written with a leading "-"
+			leaf, negated = leaf.Children[0], true
+		}
+		if leaf.IsGroup() {
+			return "", "", fmt.Errorf("nested %s groups have no Gmail filter equivalent", leaf.Op)
+		}
+		op := leaf.Match
+		if op == "" {
+			op = defaultOp
+		}
+		if op != "" && op != rules.MatchContains {
+			return "", "", fmt.Errorf("%s matching has no Gmail filter equivalent", op)
+		}
+		leafName := ""
+		for prop, t := range predicateTypes {
+			if t == leaf.Type {
+				leafName = prop
+			}
+		}
+		if leafName == "" {
+			return "", "", fmt.Errorf("%s conditions have no Gmail filter equivalent", leaf.Type)
+		}
+		if name != "" && name != leafName {
+			return "", "", fmt.Errorf("OR across %s and %s has no Gmail filter equivalent", name, leafName)
+		}
+		name = leafName
+		value := leaf.Value
+		if name == propHasTheWord && strings.ContainsAny(value, " \t") {
+			value = `"` + value + `"` // a phrase, not separate words
+		}
+		if negated {
+			value = "-" + value
+		}
+		values = append(values, value)
+	}
+	if name == propHasTheWord && len(values) > 1 {
+		return name, "(" + strings.Join(values, gmailOrSeparator) + ")", nil
+	}
+	return name, strings.Join(values, gmailOrSeparator), nil
+}
+
+// actionProperty maps a rule action to a Gmail filter property
+func actionProperty(action string) (string, string, error) {
+	if action == "" {
+		action = defaultRuleAction
+	}
+	kind, arg := rules.ParseAction(action)
+	switch kind {
+	case rules.ActionDelete:
+		return propTrash, "true", nil
+	case rules.ActionArchive:
+		return propArchive, "true", nil
+	case rules.ActionMarkRead:
+		return propMarkAsRead, "true", nil
+	case rules.ActionAddLabel:
+		return propLabel, arg, nil
+	}
+	return "", "", fmt.Errorf("action %s has no Gmail filter equivalent", kind)
+}
+
+// propertyKey identifies a set of condition properties
+func propertyKey(props map[string]string) string {
+	names := make([]string, 0, len(props))
+	for name, value := range props {
+		names = append(names, name+"="+value)
+	}
+	sort.Strings(names)
+	return strings.Join(names, "\x00")
+}
@@ -0,0 +1,151 @@
+package gmailfilter
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"backend/internal/database"
+	"backend/internal/rules"
+)
+
+// feed wraps filter properties, one filter per map, in an export document
+func feed(filters ...map[string]string) string {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?><feed xmlns="http://www.w3.org/2005/Atom" xmlns:apps="http://schemas.google.com/apps/2006">`)
+	for i, props := range filters {
+		fmt.Fprintf(&b, `<entry><id>filter-%d</id>`, i+1)
+		for name, value := range props {
+			fmt.Fprintf(&b, `<apps:property name="%s" value="%s"/>`, name, strings.ReplaceAll(value, `"`, "&quot;"))
+		}
+		b.WriteString(`</entry>`)
+	}
+	b.WriteString(`</feed>`)
+	return b.String()
+}
+
+// describe writes a condition tree compactly, e.g. AND(keyword=a,NOT(keyword=b))
+func describe(c rules.Condition) string {
+	if !c.IsGroup() {
+		return c.Type + "=" + c.Value
+	}
+	parts := make([]string, len(c.Children))
+	for i, child := range c.Children {
+		parts[i] = describe(child)
+	}
+	return c.Op + "(" + strings.Join(parts, ",") + ")"
+}
+
+func TestImportHasTheWord(t *testing.T) {
+	tests := []struct {
+		name        string
+		words       string
+		want        string
+		ageDays     int
+		unsupported string
+	}{
+		{"one word", "invoice", "keyword=invoice", 0, ""},
+		{"every word required", "invoice overdue", "AND(keyword=invoice,keyword=overdue)", 0, ""},
+		{"phrase", `"weekly digest"`, "keyword=weekly digest", 0, ""},
+		{"OR group", "(sale OR offer) shoes", "AND(OR(keyword=sale,keyword=offer),keyword=shoes)", 0, ""},
+		{"negated word", "newsletter -important", "AND(keyword=newsletter,NOT(keyword=important))", 0, ""},
+		{"negated phrase", `sale -"final notice"`, "AND(keyword=sale,NOT(keyword=final notice))", 0, ""},
+		{"hyphenated word", "e-mail", "keyword=e-mail", 0, ""},
+		{"older_than", "receipt older_than:2m", "keyword=receipt", 60, ""},
+		{"unsupported operator", "receipt has:attachment", "keyword=receipt", 0, "has:attachment"},
+		{"negated operator", "receipt -is:starred", "keyword=receipt", 0, "-is:starred"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imported, report, err := Import(strings.NewReader(feed(map[string]string{propHasTheWord: tt.words, propTrash: "true"})))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(imported) != 1 {
+				t.Fatalf("imported %d rules, want 1; issues %+v", len(imported), report.Issues)
+			}
+			params := imported[0].Params
+			if got := describe(*params.Conditions); got != tt.want {
+				t.Errorf("conditions = %s, want %s", got, tt.want)
+			}
+			if params.AgeDays != tt.ageDays {
+				t.Errorf("age = %d, want %d", params.AgeDays, tt.ageDays)
+			}
+			var unsupported []string
+			for _, issue := range report.Issues {
+				unsupported = append(unsupported, issue.Value)
+			}
+			if strings.Join(unsupported, ",") != tt.unsupported {
+				t.Errorf("unsupported = %v, want %q", unsupported, tt.unsupported)
+			}
+		})
+	}
+}
+
+func TestImportSkipsFiltersWithoutSupportedParts(t *testing.T) {
+	imported, report, err := Import(strings.NewReader(feed(
+		map[string]string{propFrom: "a@example.com", propTrash: "true"},
+		map[string]string{propFrom: "b@example.com", "forwardTo": "c@example.com"},
+		map[string]string{"size": "1000", propTrash: "true"},
+	)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != 1 || imported[0].Entry != "filter-1" {
+		t.Fatalf("imported = %+v, want only filter-1", imported)
+	}
+	skipped := map[string]bool{}
+	for _, issue := range report.Issues {
+		if issue.Skipped {
+			skipped[issue.Entry] = true
+		}
+	}
+	if !skipped["filter-2"] || !skipped["filter-3"] || len(skipped) != 2 {
+		t.Errorf("skipped = %v, want filter-2 and filter-3", skipped)
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	keyword := func(v string) rules.Condition { return *rules.Predicate("keyword", v) }
+	ruleset := []database.Rule{
+		{ID: "sender", Type: "sender", Value: "deals@shop.example", Action: rules.ActionDelete},
+		{ID: "words", Type: "compound", Conditions: &rules.Condition{Op: rules.OpAnd, Children: []rules.Condition{
+			{Op: rules.OpOr, Children: []rules.Condition{keyword("sale"), keyword("clearance")}},
+			keyword("final notice"),
+			{Op: rules.OpNot, Children: []rules.Condition{keyword("receipt")}},
+		}}, Action: rules.ActionArchive, AgeDays: 30},
+		{ID: "label", Type: "subject", Value: "Invoice", Action: rules.ActionAddLabel + ":Bills"},
+	}
+
+	var out bytes.Buffer
+	report, err := Export(&out, ruleset, time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Issues) != 0 {
+		t.Fatalf("export issues: %+v", report.Issues)
+	}
+	imported, report, err := Import(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Issues) != 0 {
+		t.Errorf("import issues: %+v", report.Issues)
+	}
+	if len(imported) != len(ruleset) {
+		t.Fatalf("imported %d rules, want %d", len(imported), len(ruleset))
+	}
+	for i, r := range ruleset {
+		want := r.Conditions
+		if want == nil {
+			want = rules.Predicate(r.Type, r.Value)
+		}
+		got := imported[i].Params
+		if describe(*got.Conditions) != describe(*want) || got.Action != r.Action || got.AgeDays != r.AgeDays {
+			t.Errorf("rule %s came back as %s %s age %d, want %s %s age %d", r.ID,
+				describe(*got.Conditions), got.Action, got.AgeDays, describe(*want), r.Action, r.AgeDays)
+		}
+	}
+}
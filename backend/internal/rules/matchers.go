@@ -0,0 +1,154 @@
+package rules
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Match operators for predicate values
+const (
+	MatchContains = "contains"
+	MatchEquals   = "equals"
+	MatchPrefix   = "prefix"
+	MatchSuffix   = "suffix"
+	MatchGlob     = "glob"
+	MatchRegex    = "regex"
+)
+
+// ValidMatchOp reports whether op is a known match operator. An empty op
+// means "contains".
+func ValidMatchOp(op string) bool {
+	switch op {
+	case "", MatchContains, MatchEquals, MatchPrefix, MatchSuffix, MatchGlob, MatchRegex:
+		return true
+	}
+	return false
+}
+
+// validateValue checks the operator and, for patterns, that the value compiles
+func validateValue(op, value string) error {
+	if !ValidMatchOp(op) {
+		return fmt.Errorf("unknown match operator %q", op)
+	}
+	if op == MatchRegex || op == MatchGlob {
+		if _, err := compilePattern(op, value); err != nil {
+			return fmt.Errorf("invalid %s pattern %q: %w", op, value, err)
+		}
+	}
+	return nil
+}
+
+// patternCache holds compiled regex and glob patterns per rule ID so rules
+// are compiled once rather than for every email they are evaluated against.
+type patternCache struct {
+	mu     sync.RWMutex
+	byRule map[string]map[string]*regexp.Regexp
+}
+
+var compiled = &patternCache{byRule: make(map[string]map[string]*regexp.Regexp)}
+
+func (pc *patternCache) get(ruleID, key string) (*regexp.Regexp, bool) {
+	pc.mu.RLock()
+	defer pc.mu.RUnlock()
+	re, ok := pc.byRule[ruleID][key]
+	return re, ok
+}
+
+func (pc *patternCache) put(ruleID, key string, re *regexp.Regexp) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.byRule[ruleID] == nil {
+		pc.byRule[ruleID] = make(map[string]*regexp.Regexp)
+	}
+	pc.byRule[ruleID][key] = re
+}
+
+// Forget drops the compiled patterns of a rule. Call it when a rule is
+// updated or deleted.
+func Forget(ruleID string) {
+	compiled.mu.Lock()
+	defer compiled.mu.Unlock()
+	delete(compiled.byRule, ruleID)
+}
+
+// compilePattern turns a regex or glob value into a case-insensitive regexp
+func compilePattern(op, value string) (*regexp.Regexp, error) {
+	switch op {
+	case MatchRegex:
+		return regexp.Compile("(?i)" + value)
+	case MatchGlob:
+		return regexp.Compile("(?i)^" + GlobToRegex(value) + "$")
+	}
+	return nil, fmt.Errorf("operator %q does not use a pattern", op)
+}
+
+// GlobToRegex translates * and ? wildcards, quoting everything else. As in
+// Sieve's :matches, a backslash makes the next character literal, so \* is
+// a plain asterisk. The result is unanchored.
+func GlobToRegex(glob string) string {
+	var b strings.Builder
+	escaped := false
+	for _, r := range glob {
+		switch {
+		case escaped:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '*':
+			b.WriteString(".*")
+		case r == '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	if escaped {
+		b.WriteString(`\\`) // a trailing backslash stands for itself
+	}
+	return b.String()
+}
+
+// pattern returns the compiled pattern for a rule, using the cache when the
+// rule has an ID.
+func pattern(ruleID, op, value string) (*regexp.Regexp, error) {
+	if ruleID == "" {
+		return compilePattern(op, value)
+	}
+	key := op + ":" + value
+	if re, ok := compiled.get(ruleID, key); ok {
+		return re, nil
+	}
+	re, err := compilePattern(op, value)
+	if err != nil {
+		return nil, err
+	}
+	compiled.put(ruleID, key, re)
+	return re, nil
+}
+
+// matchValue applies a match operator to a single field. All operators are
+// case-insensitive.
+func matchValue(ruleID, op, field, value string) bool {
+	switch op {
+	case "", MatchContains:
+		return strings.Contains(strings.ToLower(field), strings.ToLower(value))
+	case MatchEquals:
+		return strings.EqualFold(field, value)
+	case MatchPrefix:
+		return strings.HasPrefix(strings.ToLower(field), strings.ToLower(value))
+	case MatchSuffix:
+		return strings.HasSuffix(strings.ToLower(field), strings.ToLower(value))
+	case MatchGlob, MatchRegex:
+		re, err := pattern(ruleID, op, value)
+		if err != nil {
+			// Invalid patterns are rejected when the rule is saved
+			return false
+		}
+		return re.MatchString(field)
+	default:
+		return false
+	}
+}
@@ -0,0 +1,66 @@
+package rules
+
+import "strings"
+
+// AppliedAction is one action chosen for an email and the rule it came from.
+type AppliedAction struct {
+	RuleID string `json:"rule_id"`
+	Action string `json:"action"`
+}
+
+// Plan runs the rules, in the order given, against an email and returns the
+// actions to apply. Every matching rule contributes its action unless it
+// conflicts with one already chosen:
+//   - only the first DELETE or ARCHIVE is kept, since both dispose of the email
+//   - ADD_LABEL:x and REMOVE_LABEL:x for the same label keep the first one
+//   - duplicate actions are dropped
+//
+// A matching rule with Stop set ends evaluation. Dispositions are ordered
+// last so label and read-state changes land before the email leaves the inbox.
+func Plan(email Email, ordered []Rule) []AppliedAction {
+	return plan(ordered, func(i int) bool { return Match(email, ordered[i]) })
+}
+
+// PlanMatched is Plan for callers that already know which rules matched,
+// such as the SQL evaluator. matched[i] corresponds to ordered[i].
+func PlanMatched(ordered []Rule, matched []bool) []AppliedAction {
+	return plan(ordered, func(i int) bool { return i < len(matched) && matched[i] })
+}
+
+func plan(ordered []Rule, matches func(i int) bool) []AppliedAction {
+	var actions []AppliedAction
+	var disposition *AppliedAction
+	markRead := false
+	labels := make(map[string]bool) // label names already added or removed
+
+	for i, rule := range ordered {
+		if !matches(i) {
+			continue
+		}
+		kind, arg := ParseAction(rule.Action)
+		switch kind {
+		case ActionDelete, ActionArchive:
+			if disposition == nil {
+				disposition = &AppliedAction{RuleID: rule.ID, Action: kind}
+			}
+		case ActionAddLabel, ActionRemoveLabel:
+			if key := strings.ToLower(arg); !labels[key] {
+				labels[key] = true
+				actions = append(actions, AppliedAction{RuleID: rule.ID, Action: kind + ":" + arg})
+			}
+		case ActionMarkRead:
+			if !markRead {
+				markRead = true
+				actions = append(actions, AppliedAction{RuleID: rule.ID, Action: kind})
+			}
+		}
+		if rule.Stop {
+			break
+		}
+	}
+
+	if disposition != nil {
+		actions = append(actions, *disposition)
+	}
+	return actions
+}
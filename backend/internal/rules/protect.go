@@ -0,0 +1,122 @@
+package rules
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// Kinds of protected sender entries
+const (
+	ProtectAddress = "address" // exact sender address
+	ProtectDomain  = "domain"  // sender domain, including subdomains
+	ProtectLabel   = "label"   // Gmail label ID such as STARRED or IMPORTANT
+)
+
+// Protection is one allowlist entry. Emails it covers are never trashed or
+// archived by rules or bulk deletes.
+type Protection struct {
+	ID    string `json:"id,omitempty"`
+	Kind  string `json:"kind"`
+	Value string `json:"value"`
+}
+
+// Validate checks the kind and normalises the value.
+func (p *Protection) Validate() error {
+	p.Value = strings.TrimSpace(p.Value)
+	if p.Value == "" {
+		return fmt.Errorf("%s protection requires a value", p.Kind)
+	}
+	switch p.Kind {
+	case ProtectAddress:
+		if !strings.Contains(p.Value, "@") {
+			return fmt.Errorf("%q is not an email address", p.Value)
+		}
+		p.Value = strings.ToLower(p.Value)
+	case ProtectDomain:
+		p.Value = strings.ToLower(strings.TrimPrefix(p.Value, "@"))
+	case ProtectLabel:
+		p.Value = strings.ToUpper(p.Value)
+	default:
+		return fmt.Errorf("unknown protection kind %q", p.Kind)
+	}
+	return nil
+}
+
+// Destructive reports whether an action removes an email from the inbox.
+func Destructive(action string) bool {
+	kind, _ := ParseAction(action)
+	return kind == ActionDelete || kind == ActionArchive
+}
+
+// SenderAddress extracts the bare, lower-cased address from a From header
+// such as "John Doe <john@example.com>".
+func SenderAddress(from string) string {
+	if addr, err := mail.ParseAddress(from); err == nil {
+		return strings.ToLower(addr.Address)
+	}
+	// Fall back to the text between angle brackets, or the whole value
+	if start, end := strings.Index(from, "<"), strings.LastIndex(from, ">"); start != -1 && end > start {
+		from = from[start+1 : end]
+	}
+	return strings.ToLower(strings.TrimSpace(from))
+}
+
+// ProtectedBy returns the first entry covering the email.
+func ProtectedBy(email Email, protections []Protection) (Protection, bool) {
+	addr := SenderAddress(email.Sender)
+	domain := ""
+	if at := strings.LastIndex(addr, "@"); at != -1 {
+		domain = addr[at+1:]
+	}
+	for _, p := range protections {
+		switch p.Kind {
+		case ProtectAddress:
+			if strings.EqualFold(addr, p.Value) {
+				return p, true
+			}
+		case ProtectDomain:
+			v := strings.ToLower(p.Value)
+			if domain == v || strings.HasSuffix(domain, "."+v) {
+				return p, true
+			}
+		case ProtectLabel:
+			for _, label := range email.Labels {
+				if strings.EqualFold(label, p.Value) {
+					return p, true
+				}
+			}
+		}
+	}
+	return Protection{}, false
+}
+
+// Protect drops destructive actions from a plan when the email is covered by
+// the allowlist. It returns the remaining actions and the entry that applied,
+// if any destructive action was removed.
+func Protect(email Email, actions []AppliedAction, protections []Protection) ([]AppliedAction, *Protection) {
+	if len(protections) == 0 {
+		return actions, nil
+	}
+	hasDestructive := false
+	for _, a := range actions {
+		if Destructive(a.Action) {
+			hasDestructive = true
+			break
+		}
+	}
+	if !hasDestructive {
+		return actions, nil
+	}
+	p, ok := ProtectedBy(email, protections)
+	if !ok {
+		return actions, nil
+	}
+	kept := make([]AppliedAction, 0, len(actions))
+	for _, a := range actions {
+		if !Destructive(a.Action) {
+			kept = append(kept, a)
+		}
+	}
+	return kept, &p
+}
@@ -0,0 +1,305 @@
+package sieve
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// token kinds produced by the lexer
+const (
+	tokIdent = iota
+	tokTag
+	tokString
+	tokNumber
+	tokPunct
+	tokEOF
+)
+
+type token struct {
+	kind int
+	text string
+	line int
+}
+
+// lex splits a script into tokens, dropping comments.
+func lex(src string) ([]token, error) {
+	var toks []token
+	line := 1
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end == -1 {
+				return nil, fmt.Errorf("line %d: unterminated comment", line)
+			}
+			line += strings.Count(src[i:i+2+end], "\n")
+			i += end + 4
+		case c == '"':
+			var b strings.Builder
+			start := line
+			i++
+			for {
+				if i >= len(src) {
+					return nil, fmt.Errorf("line %d: unterminated string", start)
+				}
+				if src[i] == '"' {
+					i++
+					break
+				}
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+				}
+				if src[i] == '\n' {
+					line++
+				}
+				b.WriteByte(src[i])
+				i++
+			}
+			toks = append(toks, token{kind: tokString, text: b.String(), line: start})
+		case c == ':':
+			j := i + 1
+			for j < len(src) && isIdentByte(src[j]) {
+				j++
+			}
+			if j == i+1 {
+				return nil, fmt.Errorf("line %d: empty tag", line)
+			}
+			toks = append(toks, token{kind: tokTag, text: strings.ToLower(src[i:j]), line: line})
+			i = j
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(src) && (unicode.IsDigit(rune(src[j])) || strings.ContainsRune("KMGkmg", rune(src[j]))) {
+				j++
+			}
+			toks = append(toks, token{kind: tokNumber, text: src[i:j], line: line})
+			i = j
+		case isIdentByte(c):
+			j := i
+			for j < len(src) && isIdentByte(src[j]) {
+				j++
+			}
+			word := strings.ToLower(src[i:j])
+			if word == "text" && j < len(src) && src[j] == ':' {
+				return nil, fmt.Errorf("line %d: multi-line strings are not supported", line)
+			}
+			toks = append(toks, token{kind: tokIdent, text: word, line: line})
+			i = j
+		case strings.ContainsRune(";{}[](),", rune(c)):
+			toks = append(toks, token{kind: tokPunct, text: string(c), line: line})
+			i++
+		default:
+			return nil, fmt.Errorf("line %d: unexpected character %q", line, c)
+		}
+	}
+	return append(toks, token{kind: tokEOF, line: line}), nil
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// test is a Sieve test such as `header :contains "from" "x"`.
+type test struct {
+	name       string
+	tags       []string
+	comparator string
+	args       [][]string // positional string and string-list arguments
+	tests      []test     // operands of allof, anyof and not
+	line       int
+}
+
+// hasTag reports whether the test or command carries a tag
+func (t test) hasTag(tag string) bool {
+	for _, tg := range t.tags {
+		if tg == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// command is a Sieve command; control commands carry a test and a block.
+type command struct {
+	test
+	cond  *test
+	block []command
+}
+
+// maxNesting bounds how deeply tests and blocks may nest, so a hostile
+// script can't exhaust the stack
+const maxNesting = 32
+
+type parser struct {
+	toks  []token
+	pos   int
+	depth int // current test and block nesting
+}
+
+// nest parses one nested test or block, enforcing maxNesting
+func (p *parser) nest(line int, parse func() error) error {
+	if p.depth >= maxNesting {
+		return fmt.Errorf("line %d: nested deeper than %d levels", line, maxNesting)
+	}
+	p.depth++
+	defer func() { p.depth-- }()
+	return parse()
+}
+
+// parse turns a script into its command list.
+func parse(src string) ([]command, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	cmds, err := p.commands()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("line %d: unexpected %q", t.line, t.text)
+	}
+	return cmds, nil
+}
+
+func (p *parser) peek() token { return p.toks[p.pos] }
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) punct(text string) bool {
+	if t := p.peek(); t.kind == tokPunct && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// commands parses until a closing brace or the end of input
+func (p *parser) commands() ([]command, error) {
+	var cmds []command
+	for {
+		t := p.peek()
+		if t.kind == tokEOF || (t.kind == tokPunct && t.text == "}") {
+			return cmds, nil
+		}
+		if t.kind != tokIdent {
+			return nil, fmt.Errorf("line %d: expected command, got %q", t.line, t.text)
+		}
+		p.next()
+		cmd := command{test: test{name: t.text, line: t.line}}
+		if err := p.arguments(&cmd.test); err != nil {
+			return nil, err
+		}
+		// A control command's single test was parsed as an operand
+		if len(cmd.tests) == 1 && (cmd.name == "if" || cmd.name == "elsif") {
+			cmd.cond = &cmd.tests[0]
+			cmd.tests = nil
+		}
+
+		switch {
+		case p.punct(";"):
+		case p.punct("{"):
+			var block []command
+			err := p.nest(t.line, func() (err error) {
+				block, err = p.commands()
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			if !p.punct("}") {
+				return nil, fmt.Errorf("line %d: missing closing brace", t.line)
+			}
+			cmd.block = block
+		default:
+			return nil, fmt.Errorf("line %d: expected ';' or '{' after %s", p.peek().line, t.text)
+		}
+		cmds = append(cmds, cmd)
+	}
+}
+
+// arguments reads tags, strings, lists and an optional trailing test or test list
+func (p *parser) arguments(t *test) error {
+	for {
+		tok := p.peek()
+		switch {
+		case tok.kind == tokTag:
+			p.next()
+			if tok.text == ":comparator" {
+				cmp := p.next()
+				if cmp.kind != tokString {
+					return fmt.Errorf("line %d: :comparator needs a string", cmp.line)
+				}
+				t.comparator = cmp.text
+				continue
+			}
+			t.tags = append(t.tags, tok.text)
+		case tok.kind == tokString || tok.kind == tokNumber:
+			p.next()
+			t.args = append(t.args, []string{tok.text})
+		case tok.kind == tokPunct && tok.text == "[":
+			p.next()
+			var list []string
+			for {
+				s := p.next()
+				if s.kind != tokString {
+					return fmt.Errorf("line %d: string list must contain strings", s.line)
+				}
+				list = append(list, s.text)
+				if p.punct("]") {
+					break
+				}
+				if !p.punct(",") {
+					return fmt.Errorf("line %d: expected ',' or ']' in string list", p.peek().line)
+				}
+			}
+			t.args = append(t.args, list)
+		case tok.kind == tokIdent:
+			p.next()
+			sub := test{name: tok.text, line: tok.line}
+			if err := p.nest(tok.line, func() error { return p.arguments(&sub) }); err != nil {
+				return err
+			}
+			t.tests = append(t.tests, sub)
+			return nil
+		case tok.kind == tokPunct && tok.text == "(":
+			p.next()
+			for {
+				id := p.next()
+				if id.kind != tokIdent {
+					return fmt.Errorf("line %d: expected test, got %q", id.line, id.text)
+				}
+				sub := test{name: id.text, line: id.line}
+				if err := p.nest(id.line, func() error { return p.arguments(&sub) }); err != nil {
+					return err
+				}
+				t.tests = append(t.tests, sub)
+				if p.punct(")") {
+					return nil
+				}
+				if !p.punct(",") {
+					return fmt.Errorf("line %d: expected ',' or ')' in test list", p.peek().line)
+				}
+			}
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,565 @@
+// Package sieve translates between MailCleaner rules and a practical subset
+// of RFC 5228 Sieve scripts, as used by Fastmail and Dovecot.
+//
+// Supported tests are header, address, exists, body (approximated by the
+// keyword predicate), hasflag "\\Seen", allof, anyof and not. Supported
+// actions are discard, fileinto (with :copy), addflag/setflag "\\Seen",
+// keep and stop.
+package sieve
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/textproto"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"backend/internal/database"
+	"backend/internal/rules"
+)
+
+// Issue describes a part of a script or a rule that could not be translated.
+// Skipped is set when the whole block or rule was dropped.
+type Issue struct {
+	Entry   string `json:"entry"` // script line on import, rule ID on export
+	Command string `json:"command,omitempty"`
+	Reason  string `json:"reason"`
+	Skipped bool   `json:"skipped"`
+}
+
+// Imported is a rule created from a block, with the line it came from.
+type Imported struct {
+	Entry  string // script line
+	Params database.CreateRuleParams
+}
+
+// Report lists everything that was lost in translation.
+type Report struct {
+	Issues []Issue `json:"issues"`
+}
+
+func (r *Report) add(entry, command, reason string, skipped bool) {
+	r.Issues = append(r.Issues, Issue{Entry: entry, Command: command, Reason: reason, Skipped: skipped})
+}
+
+const seenFlag = `\Seen`
+
+// Import parses a Sieve script. Each if/elsif block becomes one rule per
+// action, all sharing the block's test; a stop in the block is set on its
+// last rule. The returned params have no ID or UserID set.
+func Import(script string) ([]Imported, Report, error) {
+	var report Report
+	cmds, err := parse(script)
+	if err != nil {
+		return nil, report, fmt.Errorf("invalid Sieve script: %w", err)
+	}
+
+	var imported []Imported
+	for _, cmd := range cmds {
+		entry := "line " + strconv.Itoa(cmd.line)
+		switch cmd.name {
+		case "require", "keep", "stop":
+			continue
+		case "if", "elsif":
+		case "else":
+			report.add(entry, cmd.name, "else blocks have no test and cannot become a rule", true)
+			continue
+		default:
+			report.add(entry, cmd.name, "actions outside an if block are not supported", true)
+			continue
+		}
+		if cmd.name == "elsif" {
+			report.add(entry, cmd.name, "elsif imported as an independent if", false)
+		}
+		if cmd.cond == nil {
+			report.add(entry, cmd.name, "missing test", true)
+			continue
+		}
+
+		cond, err := condition(*cmd.cond, entry, &report)
+		if err != nil {
+			report.add(entry, cmd.cond.name, err.Error(), true)
+			continue
+		}
+		actions, stop := blockActions(cmd.block, &report)
+		if len(actions) == 0 {
+			report.add(entry, cmd.name, "block has no supported actions", true)
+			continue
+		}
+
+		ruleType, value := "compound", ""
+		if !cond.IsGroup() {
+			ruleType, value = cond.Type, cond.Value
+		}
+		for i, action := range actions {
+			imported = append(imported, Imported{Entry: entry, Params: database.CreateRuleParams{
+				Type:       ruleType,
+				Value:      value,
+				Conditions: cond,
+				MatchOp:    rules.MatchContains,
+				Action:     action,
+				Stop:       stop && i == len(actions)-1,
+			}})
+		}
+	}
+	return imported, report, nil
+}
+
+// blockActions maps the commands inside an if block to rule actions
+func blockActions(block []command, report *Report) ([]string, bool) {
+	var actions []string
+	stop := false
+	for _, cmd := range block {
+		entry := "line " + strconv.Itoa(cmd.line)
+		switch cmd.name {
+		case "discard":
+			actions = append(actions, rules.ActionDelete)
+		case "fileinto":
+			if len(cmd.args) != 1 || len(cmd.args[0]) != 1 {
+				report.add(entry, cmd.name, "fileinto needs one mailbox name", false)
+				continue
+			}
+			actions = append(actions, rules.ActionAddLabel+":"+cmd.args[0][0])
+			// Without :copy the message moves out of the inbox
+			if !cmd.hasTag(":copy") {
+				actions = append(actions, rules.ActionArchive)
+			}
+		case "addflag", "setflag":
+			if len(cmd.args) == 0 {
+				report.add(entry, cmd.name, "missing flag list", false)
+				continue
+			}
+			for _, flag := range flagList(cmd.args[len(cmd.args)-1]) {
+				if strings.EqualFold(flag, seenFlag) {
+					actions = append(actions, rules.ActionMarkRead)
+				} else {
+					report.add(entry, cmd.name, fmt.Sprintf("flag %s is not supported", flag), false)
+				}
+			}
+		case "stop":
+			stop = true
+		case "keep":
+		default:
+			report.add(entry, cmd.name, "command is not supported", false)
+		}
+	}
+	return actions, stop
+}
+
+// flagList splits a flag list whose strings may hold several space-separated flags
+func flagList(list []string) []string {
+	var flags []string
+	for _, s := range list {
+		flags = append(flags, strings.Fields(s)...)
+	}
+	return flags
+}
+
+// condition converts a Sieve test to a condition tree
+func condition(t test, entry string, report *Report) (*rules.Condition, error) {
+	switch t.name {
+	case "allof", "anyof":
+		op := rules.OpAnd
+		if t.name == "anyof" {
+			op = rules.OpOr
+		}
+		group := &rules.Condition{Op: op}
+		for _, sub := range t.tests {
+			c, err := condition(sub, entry, report)
+			if err != nil {
+				return nil, err
+			}
+			group.Children = append(group.Children, *c)
+		}
+		if len(group.Children) == 0 {
+			return nil, fmt.Errorf("%s needs at least one test", t.name)
+		}
+		return group, nil
+	case "not":
+		if len(t.tests) != 1 {
+			return nil, fmt.Errorf("not needs exactly one test")
+		}
+		c, err := condition(t.tests[0], entry, report)
+		if err != nil {
+			return nil, err
+		}
+		return &rules.Condition{Op: rules.OpNot, Children: []rules.Condition{*c}}, nil
+	case "header", "address":
+		return comparison(t, entry, report)
+	case "exists":
+		if len(t.args) != 1 {
+			return nil, fmt.Errorf("exists needs a header list")
+		}
+		var preds []rules.Condition
+		for _, name := range t.args[0] {
+			preds = append(preds, rules.Condition{Type: "header", Header: textproto.CanonicalMIMEHeaderKey(name)})
+		}
+		return group(rules.OpAnd, preds), nil
+	case "body":
+		if len(t.args) != 1 {
+			return nil, fmt.Errorf("body needs a key list")
+		}
+		op, err := matchType(t)
+		if err != nil {
+			return nil, err
+		}
+		report.add(entry, t.name, "body test approximated by a keyword match on subject and snippet", false)
+		var preds []rules.Condition
+		for _, key := range t.args[0] {
+			preds = append(preds, rules.Condition{Type: "keyword", Value: key, Match: op})
+		}
+		return group(rules.OpOr, preds), nil
+	case "hasflag":
+		if len(t.args) == 0 {
+			return nil, fmt.Errorf("hasflag needs a flag list")
+		}
+		flags := flagList(t.args[len(t.args)-1])
+		if len(flags) != 1 || !strings.EqualFold(flags[0], seenFlag) {
+			return nil, fmt.Errorf("only hasflag %q is supported", seenFlag)
+		}
+		return rules.Predicate("read", ""), nil
+	}
+	return nil, fmt.Errorf("test %s is not supported", t.name)
+}
+
+// comparison converts header and address tests. Every header/key pair
+// becomes a predicate and the pairs are ORed, as in RFC 5228.
+func comparison(t test, entry string, report *Report) (*rules.Condition, error) {
+	if len(t.args) != 2 {
+		return nil, fmt.Errorf("%s needs a header list and a key list", t.name)
+	}
+	op, err := matchType(t)
+	if err != nil {
+		return nil, err
+	}
+	if t.comparator != "" && t.comparator != "i;ascii-casemap" {
+		report.add(entry, t.name, fmt.Sprintf("comparator %s ignored; matching is case-insensitive", t.comparator), false)
+	}
+
+	var preds []rules.Condition
+	for _, name := range t.args[0] {
+		for _, key := range t.args[1] {
+			value, keyOp := key, op
+			if t.name == "address" {
+				value, keyOp, err = addressPart(t, key, op)
+				if err != nil {
+					return nil, err
+				}
+			}
+			c := rules.Condition{Value: value, Match: keyOp}
+			switch strings.ToLower(name) {
+			case "from":
+				c.Type = "sender"
+			case "subject":
+				c.Type = "subject"
+			default:
+				c.Type = "header"
+				c.Header = textproto.CanonicalMIMEHeaderKey(name)
+			}
+			// The rule-level default covers contains
+			if c.Match == rules.MatchContains {
+				c.Match = ""
+			}
+			preds = append(preds, c)
+		}
+	}
+	if len(preds) == 0 {
+		return nil, fmt.Errorf("%s has no header/key pairs", t.name)
+	}
+	return group(rules.OpOr, preds), nil
+}
+
+// matchType maps :contains, :is, :matches and :regex to match operators
+func matchType(t test) (string, error) {
+	op := rules.MatchContains
+	for _, tag := range t.tags {
+		switch tag {
+		case ":contains":
+			op = rules.MatchContains
+		case ":is":
+			op = rules.MatchEquals
+		case ":matches":
+			op = rules.MatchGlob
+		case ":regex":
+			op = rules.MatchRegex
+		case ":all", ":localpart", ":domain", ":text":
+		default:
+			return "", fmt.Errorf("%s %s is not supported", t.name, tag)
+		}
+	}
+	return op, nil
+}
+
+// Patterns delimiting the address in a From or To value, which may be a
+// bare address or "Name <address>"
+const (
+	addressStart = `(?:^\s*|<)`
+	addressEnd   = `(?:\s*$|>)`
+	addressChars = `[^<>@\s]*`
+)
+
+// addressPart turns an address test key into a regex predicate on the
+// address inside the header value, narrowed to the :localpart or :domain
+// the test asked for. Matching the raw value instead would let a display
+// name match, or keep :is from matching "Name <address>" at all.
+func addressPart(t test, key, op string) (string, string, error) {
+	var pattern string
+	switch op {
+	case rules.MatchEquals:
+		pattern = regexp.QuoteMeta(key)
+	case rules.MatchGlob:
+		pattern = addressGlob(key)
+	case rules.MatchContains:
+		pattern = addressChars + regexp.QuoteMeta(key) + addressChars
+	default:
+		if t.hasTag(":domain") || t.hasTag(":localpart") {
+			return "", "", fmt.Errorf("address part with :regex is not supported")
+		}
+		return key, op, nil
+	}
+
+	switch {
+	case t.hasTag(":domain"):
+		return "@" + pattern + addressEnd, rules.MatchRegex, nil
+	case t.hasTag(":localpart"):
+		return addressStart + pattern + "@", rules.MatchRegex, nil
+	}
+	if op == rules.MatchContains {
+		// Any part of the address, including the @
+		pattern = `[^<>\s]*` + regexp.QuoteMeta(key) + `[^<>\s]*`
+	}
+	return addressStart + pattern + addressEnd, rules.MatchRegex, nil
+}
+
+// addressGlob is GlobToRegex with wildcards that stay inside the address
+func addressGlob(glob string) string {
+	var b strings.Builder
+	escaped := false
+	for _, r := range glob {
+		switch {
+		case escaped:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '*':
+			b.WriteString(`[^<>\s]*`)
+		case r == '?':
+			b.WriteString(`[^<>\s]`)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	if escaped {
+		b.WriteString(`\\`)
+	}
+	return b.String()
+}
+
+// group wraps several conditions, or returns the only one
+func group(op string, children []rules.Condition) *rules.Condition {
+	if len(children) == 1 {
+		return &children[0]
+	}
+	return &rules.Condition{Op: op, Children: children}
+}
+
+// Export renders rules as a Sieve script. Consecutive rules with the same
+// conditions share one if block.
+func Export(ruleset []database.Rule) (string, Report) {
+	var report Report
+	requires := make(map[string]bool)
+
+	type block struct {
+		key   string
+		test  string
+		rules []database.Rule
+	}
+	var blocks []*block
+	for _, r := range ruleset {
+		if r.AgeDays > 0 {
+			report.add(r.ID, "", "age conditions have no Sieve equivalent", true)
+			continue
+		}
+		cond := r.Conditions
+		if cond == nil {
+			cond = rules.Predicate(r.Type, r.Value)
+		}
+		rendered, err := renderTest(*cond, r.MatchOp, requires)
+		if err != nil {
+			report.add(r.ID, "", err.Error(), true)
+			continue
+		}
+		key, _ := json.Marshal(cond)
+		if n := len(blocks); n > 0 && blocks[n-1].key == string(key)+r.MatchOp && !blocks[n-1].rules[len(blocks[n-1].rules)-1].Stop {
+			blocks[n-1].rules = append(blocks[n-1].rules, r)
+			continue
+		}
+		blocks = append(blocks, &block{key: string(key) + r.MatchOp, test: rendered, rules: []database.Rule{r}})
+	}
+
+	var body strings.Builder
+	for _, b := range blocks {
+		actions := renderActions(b.rules, requires, &report)
+		if len(actions) == 0 {
+			continue
+		}
+		fmt.Fprintf(&body, "\nif %s {\n", b.test)
+		for _, a := range actions {
+			fmt.Fprintf(&body, "    %s;\n", a)
+		}
+		body.WriteString("}\n")
+	}
+
+	var out strings.Builder
+	out.WriteString("# Exported from MailCleaner\n")
+	if len(requires) > 0 {
+		names := make([]string, 0, len(requires))
+		for name := range requires {
+			names = append(names, quote(name))
+		}
+		sort.Strings(names)
+		fmt.Fprintf(&out, "require [%s];\n", strings.Join(names, ", "))
+	}
+	out.WriteString(body.String())
+	return out.String(), report
+}
+
+// renderActions renders the actions of rules sharing one if block. A label
+// and an archive together become a plain fileinto, which moves the message.
+func renderActions(block []database.Rule, requires map[string]bool, report *Report) []string {
+	var labels []string
+	var archive *database.Rule
+	var actions []string
+	for i, r := range block {
+		action := r.Action
+		if action == "" {
+			action = rules.ActionDelete
+		}
+		kind, arg := rules.ParseAction(action)
+		switch kind {
+		case rules.ActionDelete:
+			actions = append(actions, "discard")
+		case rules.ActionMarkRead:
+			requires["imap4flags"] = true
+			actions = append(actions, "addflag "+quote(seenFlag))
+		case rules.ActionAddLabel:
+			labels = append(labels, arg)
+		case rules.ActionArchive:
+			archive = &block[i]
+		default:
+			report.add(r.ID, "", fmt.Sprintf("action %s has no Sieve equivalent", kind), true)
+		}
+	}
+
+	if len(labels) > 0 {
+		requires["fileinto"] = true
+	}
+	for i, label := range labels {
+		if archive != nil && i == len(labels)-1 {
+			actions = append(actions, "fileinto "+quote(label))
+			archive = nil
+			continue
+		}
+		requires["copy"] = true
+		actions = append(actions, "fileinto :copy "+quote(label))
+	}
+	if archive != nil {
+		report.add(archive.ID, "", "ARCHIVE without a label has no Sieve equivalent", true)
+	}
+	if len(actions) > 0 && block[len(block)-1].Stop {
+		actions = append(actions, "stop")
+	}
+	return actions
+}
+
+// renderTest renders a condition tree as a Sieve test
+func renderTest(c rules.Condition, defaultOp string, requires map[string]bool) (string, error) {
+	if c.IsGroup() {
+		var parts []string
+		for _, child := range c.Children {
+			s, err := renderTest(child, defaultOp, requires)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, s)
+		}
+		switch c.Op {
+		case rules.OpAnd:
+			return "allof(" + strings.Join(parts, ", ") + ")", nil
+		case rules.OpOr:
+			return "anyof(" + strings.Join(parts, ", ") + ")", nil
+		case rules.OpNot:
+			if len(parts) != 1 {
+				return "", fmt.Errorf("not group must have one child")
+			}
+			return "not " + parts[0], nil
+		}
+		return "", fmt.Errorf("unknown group %q", c.Op)
+	}
+
+	op := c.Match
+	if op == "" {
+		op = defaultOp
+	}
+	if op == "" {
+		op = rules.MatchContains
+	}
+	tag, value, err := sieveMatch(op, c.Value)
+	if err != nil {
+		return "", err
+	}
+	if op == rules.MatchRegex {
+		requires["regex"] = true
+	}
+
+	switch c.Type {
+	case "sender":
+		return fmt.Sprintf("header %s %s %s", tag, quote("from"), quote(value)), nil
+	case "subject":
+		return fmt.Sprintf("header %s %s %s", tag, quote("subject"), quote(value)), nil
+	case "header":
+		if c.Value == "" {
+			return "exists " + quote(c.Header), nil
+		}
+		return fmt.Sprintf("header %s %s %s", tag, quote(c.Header), quote(value)), nil
+	case "keyword":
+		requires["body"] = true
+		return fmt.Sprintf("anyof(header %s %s %s, body :text %s %s)", tag, quote("subject"), quote(value), tag, quote(value)), nil
+	case "read":
+		requires["imap4flags"] = true
+		return "hasflag " + quote(seenFlag), nil
+	}
+	return "", fmt.Errorf("%s conditions have no Sieve equivalent", c.Type)
+}
+
+// sieveMatch maps a match operator to a Sieve match type and key
+func sieveMatch(op, value string) (string, string, error) {
+	switch op {
+	case rules.MatchContains:
+		return ":contains", value, nil
+	case rules.MatchEquals:
+		return ":is", value, nil
+	case rules.MatchGlob:
+		return ":matches", value, nil
+	case rules.MatchRegex:
+		return ":regex", value, nil
+	case rules.MatchPrefix, rules.MatchSuffix:
+		if strings.ContainsAny(value, `*?\`) {
+			return "", "", fmt.Errorf("%s value %q cannot be expressed with :matches", op, value)
+		}
+		if op == rules.MatchPrefix {
+			return ":matches", value + "*", nil
+		}
+		return ":matches", "*" + value, nil
+	}
+	return "", "", fmt.Errorf("%s matching has no Sieve equivalent", op)
+}
+
+// quote renders a Sieve quoted string
+func quote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
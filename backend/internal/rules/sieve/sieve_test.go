@@ -0,0 +1,159 @@
+package sieve
+
+import (
+	"strings"
+	"testing"
+
+	"backend/internal/database"
+	"backend/internal/rules"
+)
+
+// describe writes a condition tree compactly, e.g. OR(sender:=a,subject:glob=b)
+func describe(c rules.Condition) string {
+	if !c.IsGroup() {
+		name := c.Type
+		if c.Header != "" {
+			name += "[" + c.Header + "]"
+		}
+		return name + ":" + c.Match + "=" + c.Value
+	}
+	parts := make([]string, len(c.Children))
+	for i, child := range c.Children {
+		parts[i] = describe(child)
+	}
+	return c.Op + "(" + strings.Join(parts, ",") + ")"
+}
+
+// importOne imports a script that must yield exactly one rule
+func importOne(t *testing.T, script string) database.CreateRuleParams {
+	t.Helper()
+	imported, report, err := Import(script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imported) != 1 {
+		t.Fatalf("imported %d rules, want 1; issues %+v", len(imported), report.Issues)
+	}
+	return imported[0].Params
+}
+
+func TestImportMatchesHonoursEscapes(t *testing.T) {
+	tests := []struct {
+		name    string
+		test    string
+		matches []string
+		misses  []string
+	}{
+		{"wildcard", `header :matches "subject" "50*off"`, []string{"50*off", "50% off"}, []string{"60% off"}},
+		{"escaped star", `header :matches "subject" "50\\*off"`, []string{"50*off"}, []string{"50% off", "50off"}},
+		{"escaped question mark", `header :matches "subject" "why\\?"`, []string{"why?"}, []string{"whys"}},
+		{"escaped backslash", `header :matches "subject" "a\\\\*"`, []string{`a\`, `a\b`}, []string{"ab"}},
+		{"address escape", `address :all :matches "from" "a\\?b@example.com"`, []string{"a?b@example.com", "Ann <a?b@example.com>"}, []string{"axb@example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := importOne(t, "if "+tt.test+" { discard; }")
+			rule := rules.Rule{Type: params.Type, Value: params.Value, Condition: params.Conditions, MatchOp: params.MatchOp}
+			for _, s := range tt.matches {
+				if !rules.Match(rules.Email{Subject: s, Sender: s}, rule) {
+					t.Errorf("%q does not match", s)
+				}
+			}
+			for _, s := range tt.misses {
+				if rules.Match(rules.Email{Subject: s, Sender: s}, rule) {
+					t.Errorf("%q matches", s)
+				}
+			}
+		})
+	}
+}
+
+func TestImportAddressParts(t *testing.T) {
+	tests := []struct {
+		test    string
+		matches []string
+		misses  []string
+	}{
+		{`address :domain :is "from" "example.com"`,
+			[]string{"jane@example.com", "Jane Doe <jane@example.com>"},
+			[]string{"example.com fans <x@other.org>", "jane@mail.example.com"}},
+		{`address :localpart :is "from" "jane"`,
+			[]string{"jane@example.com", "Jane <jane@example.com>"},
+			[]string{"jane <bob@example.com>", "janet@example.com"}},
+		{`address :all :is "from" "jane@example.com"`,
+			[]string{"jane@example.com", "Jane <jane@example.com>"},
+			[]string{"jane@example.com.evil <x@evil.test>"}},
+		{`address :domain :matches "from" "*.example.com"`,
+			[]string{"Jane <jane@mail.example.com>"},
+			[]string{"jane@example.com", "mail.example.com <x@other.org>"}},
+	}
+	for _, tt := range tests {
+		params := importOne(t, "if "+tt.test+" { discard; }")
+		rule := rules.Rule{Type: params.Type, Value: params.Value, Condition: params.Conditions, MatchOp: params.MatchOp}
+		for _, from := range tt.matches {
+			if !rules.Match(rules.Email{Sender: from}, rule) {
+				t.Errorf("%s: %q does not match", tt.test, from)
+			}
+		}
+		for _, from := range tt.misses {
+			if rules.Match(rules.Email{Sender: from}, rule) {
+				t.Errorf("%s: %q matches", tt.test, from)
+			}
+		}
+	}
+}
+
+func TestImportLimitsNesting(t *testing.T) {
+	nested := strings.Repeat("not ", maxNesting+1) + `header :contains "subject" "x"`
+	if _, _, err := Import("if " + nested + " { discard; }"); err == nil {
+		t.Error("deeply nested test imported, want an error")
+	}
+	shallow := strings.Repeat("not ", 3) + `header :contains "subject" "x"`
+	if _, _, err := Import("if " + shallow + " { discard; }"); err != nil {
+		t.Errorf("shallow test rejected: %v", err)
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	ruleset := []database.Rule{
+		{ID: "sender", Type: "sender", Value: "deals@shop.example", Action: rules.ActionDelete},
+		{ID: "glob", Type: "subject", Value: `50\*off*`, MatchOp: rules.MatchGlob, Action: rules.ActionMarkRead},
+		{ID: "label", Type: "compound", Conditions: &rules.Condition{Op: rules.OpAnd, Children: []rules.Condition{
+			{Type: "header", Header: "List-Id", Value: "news.example.com", Match: rules.MatchEquals},
+			{Op: rules.OpNot, Children: []rules.Condition{{Type: "read"}}},
+		}}, Action: rules.ActionAddLabel + ":News"},
+		{ID: "archive", Type: "compound", Conditions: &rules.Condition{Op: rules.OpAnd, Children: []rules.Condition{
+			{Type: "header", Header: "List-Id", Value: "news.example.com", Match: rules.MatchEquals},
+			{Op: rules.OpNot, Children: []rules.Condition{{Type: "read"}}},
+		}}, Action: rules.ActionArchive, Stop: true},
+	}
+
+	script, report := Export(ruleset)
+	if len(report.Issues) != 0 {
+		t.Fatalf("export issues: %+v", report.Issues)
+	}
+	imported, report, err := Import(script)
+	if err != nil {
+		t.Fatalf("%v in:\n%s", err, script)
+	}
+	if len(report.Issues) != 0 {
+		t.Errorf("import issues: %+v", report.Issues)
+	}
+	if len(imported) != len(ruleset) {
+		t.Fatalf("imported %d rules, want %d from:\n%s", len(imported), len(ruleset), script)
+	}
+	for i, r := range ruleset {
+		want := r.Conditions
+		if want == nil {
+			want = &rules.Condition{Type: r.Type, Value: r.Value}
+			if r.MatchOp != rules.MatchContains {
+				want.Match = r.MatchOp
+			}
+		}
+		got := imported[i].Params
+		if describe(*got.Conditions) != describe(*want) || got.Action != r.Action || got.Stop != r.Stop {
+			t.Errorf("rule %s came back as %s %s stop=%v, want %s %s stop=%v", r.ID,
+				describe(*got.Conditions), got.Action, got.Stop, describe(*want), r.Action, r.Stop)
+		}
+	}
+}
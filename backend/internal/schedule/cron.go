@@ -0,0 +1,234 @@
+package schedule
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron is a parsed standard 5-field cron expression:
+// minute hour day-of-month month day-of-week.
+type Cron struct {
+	expr   string
+	minute uint64 // bit n set when minute n matches
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	anyDom bool // day-of-month was "*"
+	anyDow bool // day-of-week was "*"
+}
+
+// field bounds and accepted names, in expression order
+var cronFields = []struct {
+	name     string
+	min, max int
+	names    []string
+}{
+	{"minute", 0, 59, nil},
+	{"hour", 0, 23, nil},
+	{"day of month", 1, 31, nil},
+	{"month", 1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{"day of week", 0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+// cronMacros are the common shorthands
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCron parses a 5-field cron expression. Fields accept *, numbers,
+// ranges (1-5), lists (7,19), steps (*/15, 0-30/10) and month or weekday
+// names; day-of-week 7 is Sunday, as is 0.
+func ParseCron(expr string) (*Cron, error) {
+	expr = strings.TrimSpace(expr)
+	spec := expr
+	if macro, ok := cronMacros[strings.ToLower(spec)]; ok {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", expr)
+	}
+
+	c := &Cron{expr: expr}
+	targets := []*uint64{&c.minute, &c.hour, &c.dom, &c.month, &c.dow}
+	for i, f := range fields {
+		bits, err := parseCronField(f, i)
+		if err != nil {
+			return nil, fmt.Errorf("cron %s: %w", cronFields[i].name, err)
+		}
+		*targets[i] = bits
+	}
+	// Fold 7 onto Sunday
+	if c.dow&(1<<7) != 0 {
+		c.dow = (c.dow | 1) &^ (1 << 7)
+	}
+	c.anyDom = fields[2] == "*" || strings.HasPrefix(fields[2], "*/")
+	c.anyDow = fields[4] == "*" || strings.HasPrefix(fields[4], "*/")
+	return c, nil
+}
+
+// parseCronField turns one comma-separated field into a bit set
+func parseCronField(field string, index int) (uint64, error) {
+	spec := cronFields[index]
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if slash := strings.Index(part, "/"); slash != -1 {
+			rangePart = part[:slash]
+			n, err := strconv.Atoi(part[slash+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+		}
+
+		lo, hi := spec.min, spec.max
+		switch {
+		case rangePart == "*":
+			if index == 4 {
+				hi = 6 // 7 would repeat Sunday
+			}
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if lo, err = cronValue(bounds[0], index); err != nil {
+				return 0, err
+			}
+			if hi, err = cronValue(bounds[1], index); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("range %q is backwards", rangePart)
+			}
+		default:
+			v, err := cronValue(rangePart, index)
+			if err != nil {
+				return 0, err
+			}
+			lo, hi = v, v
+			if step > 1 {
+				hi = spec.max // "5/15" means from 5 to the end
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// cronValue parses a number or name and checks it against the field bounds
+func cronValue(s string, index int) (int, error) {
+	spec := cronFields[index]
+	for i, name := range spec.names {
+		if strings.EqualFold(s, name) {
+			return i + spec.min, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	if v < spec.min || v > spec.max {
+		return 0, fmt.Errorf("%d is outside %d-%d", v, spec.min, spec.max)
+	}
+	return v, nil
+}
+
+// String returns the expression as written.
+func (c *Cron) String() string { return c.expr }
+
+// matches reports whether a local wall-clock time is in the schedule. As in
+// classic cron, when both day fields are restricted either may match.
+func (c *Cron) matches(year int, month time.Month, day, hour, min int) bool {
+	if c.minute&(1<<uint(min)) == 0 || c.hour&(1<<uint(hour)) == 0 || c.month&(1<<uint(month)) == 0 {
+		return false
+	}
+	weekday := time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Weekday()
+	domOK := c.dom&(1<<uint(day)) != 0
+	dowOK := c.dow&(1<<uint(weekday)) != 0
+	switch {
+	case c.anyDom && c.anyDow:
+		return true
+	case c.anyDom:
+		return dowOK
+	case c.anyDow:
+		return domOK
+	}
+	return domOK || dowOK
+}
+
+// Due reports whether the schedule fires in the minute containing now, with
+// wall-clock times read in loc. Across DST transitions it follows At: a
+// repeated wall-clock time fires only on its first occurrence, and times
+// skipped when clocks go forward fire once at the end of the gap.
+func (c *Cron) Due(loc *time.Location, now time.Time) bool {
+	now = now.In(loc).Truncate(time.Minute)
+	y, m, d := now.Date()
+	if c.matches(y, m, d, now.Hour(), now.Minute()) && now.Equal(At(y, m, d, now.Hour(), now.Minute(), loc)) {
+		return true
+	}
+
+	// At the end of a forward jump, catch up on the skipped wall-clock times
+	start, _ := now.ZoneBounds()
+	if !now.Equal(start) {
+		return false
+	}
+	before := now.Add(-time.Minute).In(loc)
+	from := wallClock(before).Add(time.Minute)
+	to := wallClock(now)
+	for t := from; t.Before(to); t = t.Add(time.Minute) {
+		ty, tm, td := t.Date()
+		if c.matches(ty, tm, td, t.Hour(), t.Minute()) {
+			return true
+		}
+	}
+	return false
+}
+
+// wallClock returns the local reading of t as a UTC time, for minute arithmetic
+func wallClock(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
+
+// weekdays maps day names to cron day-of-week numbers
+var weekdays = map[string]int{
+	"sunday": 0, "monday": 1, "tuesday": 2, "wednesday": 3, "thursday": 4, "friday": 5, "saturday": 6,
+}
+
+// FromFrequency converts the original frequency settings into a cron
+// expression. weekday is only used for weekly schedules and defaults to
+// Sunday.
+func FromFrequency(frequency, timeOfDay, weekday string) (string, error) {
+	at, err := time.Parse("15:04", timeOfDay)
+	if err != nil {
+		return "", fmt.Errorf("invalid automation time %q", timeOfDay)
+	}
+	switch frequency {
+	case "hourly":
+		return fmt.Sprintf("%d * * * *", at.Minute()), nil
+	case "daily":
+		return fmt.Sprintf("%d %d * * *", at.Minute(), at.Hour()), nil
+	case "weekly":
+		day := 0
+		if weekday != "" {
+			n, ok := weekdays[strings.ToLower(weekday)]
+			if !ok {
+				return "", fmt.Errorf("unknown weekday %q", weekday)
+			}
+			day = n
+		}
+		return fmt.Sprintf("%d %d * * %d", at.Minute(), at.Hour(), day), nil
+	}
+	return "", fmt.Errorf("unknown automation frequency %q", frequency)
+}
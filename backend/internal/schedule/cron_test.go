@@ -0,0 +1,123 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+// fires returns the minutes in [from, to) at which the schedule is due
+func fires(t *testing.T, expr string, loc *time.Location, from, to time.Time) []time.Time {
+	t.Helper()
+	c, err := ParseCron(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []time.Time
+	for now := from; now.Before(to); now = now.Add(time.Minute) {
+		if c.Due(loc, now) {
+			out = append(out, now)
+		}
+	}
+	return out
+}
+
+func TestDueAcrossDST(t *testing.T) {
+	ny, err := LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Clocks go from 02:00 EST to 03:00 EDT on 9 March 2025 and from
+	// 02:00 EDT back to 01:00 EST on 2 November 2025
+	spring := time.Date(2025, 3, 9, 0, 0, 0, 0, ny)
+	fall := time.Date(2025, 11, 2, 0, 0, 0, 0, ny)
+
+	tests := []struct {
+		name  string
+		expr  string
+		day   time.Time
+		count int
+		first time.Time // zero to skip the check
+	}{
+		{"skipped time fires at end of gap", "30 2 * * *", spring, 1, time.Date(2025, 3, 9, 7, 0, 0, 0, time.UTC)},
+		{"time before gap unaffected", "30 1 * * *", spring, 1, time.Date(2025, 3, 9, 6, 30, 0, 0, time.UTC)},
+		{"every 20 minutes on short day", "*/20 * * * *", spring, 23 * 3, time.Time{}},
+		{"repeated time fires once", "30 1 * * *", fall, 1, time.Date(2025, 11, 2, 5, 30, 0, 0, time.UTC)},
+		{"every 20 minutes on long day", "*/20 * * * *", fall, 24 * 3, time.Time{}},
+		{"hourly on long day", "0 * * * *", fall, 24, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := tt.day.AddDate(0, 0, 1)
+			got := fires(t, tt.expr, ny, tt.day.UTC(), next.UTC())
+			if len(got) != tt.count {
+				t.Fatalf("fired %d times, want %d: %v", len(got), tt.count, got)
+			}
+			if !tt.first.IsZero() && !got[0].Equal(tt.first) {
+				t.Errorf("first fired at %s, want %s", got[0], tt.first)
+			}
+		})
+	}
+}
+
+func TestDueFields(t *testing.T) {
+	monday := time.Date(2025, 6, 2, 9, 0, 0, 0, time.UTC) // Monday 2 June 2025
+	tests := []struct {
+		expr string
+		at   time.Time
+		want bool
+	}{
+		{"0 9 * * mon-fri", monday, true},
+		{"0 9 * * mon-fri", monday.AddDate(0, 0, 5), false}, // Saturday
+		{"0 9 * * 1-5", monday.AddDate(0, 0, 4), true},      // Friday
+		{"0 9 * * 7", monday.AddDate(0, 0, 6), true},        // Sunday as 7
+		{"0 9 * * sun", monday.AddDate(0, 0, 6), true},
+		{"0 9 * jun *", monday, true},
+		{"0 9 * jul *", monday, false},
+		{"*/15 * * * *", monday.Add(45 * time.Minute), true},
+		{"*/15 * * * *", monday.Add(50 * time.Minute), false},
+		{"5/20 * * * *", monday.Add(25 * time.Minute), true},
+		{"0-30/10 9 * * *", monday.Add(30 * time.Minute), true},
+		{"0-30/10 9 * * *", monday.Add(40 * time.Minute), false},
+		{"0 9,17 * * *", monday.Add(8 * time.Hour), true},
+		{"0 9 13 * fri", time.Date(2025, 6, 13, 9, 0, 0, 0, time.UTC), true}, // Friday the 13th
+		{"0 9 13 * fri", time.Date(2025, 6, 20, 9, 0, 0, 0, time.UTC), true}, // either day field
+		{"0 9 13 * fri", monday, false},
+		{"0 9 */2 * *", time.Date(2025, 6, 3, 9, 0, 0, 0, time.UTC), true},
+		{"0 9 */2 * mon", monday, true},
+		{"@daily", monday.Add(-9 * time.Hour), true},
+		{"@weekly", monday.Add(-9 * time.Hour), false},
+	}
+	for _, tt := range tests {
+		c, err := ParseCron(tt.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		if got := c.Due(time.UTC, tt.at); got != tt.want {
+			t.Errorf("%q due at %s = %v, want %v", tt.expr, tt.at.Format(time.RFC1123), got, tt.want)
+		}
+	}
+}
+
+func TestParseCronRejectsInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"abc * * * *",
+		"* * * foo *",
+		"@sometimes",
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("%q parsed, want an error", expr)
+		}
+	}
+}
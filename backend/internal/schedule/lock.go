@@ -0,0 +1,51 @@
+package schedule
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// slotTTL keeps claimed slots around long enough to cover restarts and
+// clock skew between replicas; slots are unique per minute so it only
+// bounds how long keys linger.
+const slotTTL = 48 * time.Hour
+
+// SlotLock lets replicas agree on who executes a scheduled run. Every
+// (user, slot) pair can be claimed exactly once, via SET NX in Redis.
+type SlotLock struct {
+	rdb   *redis.Client
+	owner string
+}
+
+// NewSlotLock creates a lock whose claims are tagged with this host and
+// process, which helps when tracing which replica ran a job.
+func NewSlotLock(rdb *redis.Client) *SlotLock {
+	host, _ := os.Hostname()
+	return &SlotLock{rdb: rdb, owner: fmt.Sprintf("%s:%d", host, os.Getpid())}
+}
+
+// Claim reports whether this replica won the user's run for the slot, the
+// minute the run is scheduled for.
+func (l *SlotLock) Claim(ctx context.Context, userID string, slot time.Time) (bool, error) {
+	return l.rdb.SetNX(ctx, slotKey(userID, slot), l.owner, slotTTL).Result()
+}
+
+// releaseScript deletes a slot key only if this replica still holds it
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// Release gives up a slot this replica claimed but could not run.
+func (l *SlotLock) Release(ctx context.Context, userID string, slot time.Time) error {
+	return releaseScript.Run(ctx, l.rdb, []string{slotKey(userID, slot)}, l.owner).Err()
+}
+
+func slotKey(userID string, slot time.Time) string {
+	return "scheduler:slot:" + userID + ":" + slot.UTC().Truncate(time.Minute).Format(time.RFC3339)
+}
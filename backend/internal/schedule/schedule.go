@@ -0,0 +1,60 @@
+// Package schedule decides when a user's automated cleanup is due. All
+// wall-clock times are interpreted in the user's own IANA time zone.
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DefaultTimezone is used for settings saved before time zones were
+// configurable, when every schedule ran on India Standard Time.
+const DefaultTimezone = "Asia/Kolkata"
+
+// LoadLocation resolves an IANA zone name such as "Europe/Berlin". The
+// server-dependent "Local" zone is rejected.
+func LoadLocation(name string) (*time.Location, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || name == "Local" {
+		return nil, fmt.Errorf("%q is not an IANA time zone", name)
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q", name)
+	}
+	return loc, nil
+}
+
+// At returns the instant a wall-clock time occurs on a local date. The
+// result is deterministic across DST transitions: a time that occurs twice
+// when clocks go back resolves to its first occurrence, and a time skipped
+// when clocks go forward resolves to the end of the gap.
+func At(year int, month time.Month, day, hour, min int, loc *time.Location) time.Time {
+	naive := time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+
+	// Try the offsets in effect either side of the date
+	var first time.Time
+	for _, probe := range []time.Time{naive.Add(-36 * time.Hour), naive.Add(36 * time.Hour)} {
+		_, offset := probe.In(loc).Zone()
+		t := naive.Add(-time.Duration(offset) * time.Second).In(loc)
+		y, m, d := t.Date()
+		if y == year && m == month && d == day && t.Hour() == hour && t.Minute() == min {
+			if first.IsZero() || t.Before(first) {
+				first = t
+			}
+		}
+	}
+	if !first.IsZero() {
+		return first
+	}
+
+	// The time was skipped. Read with the earlier offset it falls after the
+	// transition, so the zone it lands in starts exactly at the gap's end.
+	_, before := naive.Add(-36 * time.Hour).In(loc).Zone()
+	start, _ := naive.Add(-time.Duration(before) * time.Second).In(loc).ZoneBounds()
+	if start.IsZero() {
+		return time.Date(year, month, day, hour, min, 0, 0, loc)
+	}
+	return start.In(loc)
+}
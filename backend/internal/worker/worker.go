@@ -2,27 +2,77 @@ package worker
 
 import (
     "context"
+    "errors"
+    "fmt"
     "sync"
+    "time"
 )
 
-// Job represents a unit of work.
+// Errors returned by Submit.
+var (
+    ErrQueueFull = errors.New("worker queue is full")
+    ErrDuplicate = errors.New("job with this ID is already queued or running")
+)
+
+// Job represents a unit of work. Jobs with the same ID never run concurrently.
 type Job struct {
-    ID string
+    ID      string
     Execute func(context.Context) error
 }
 
+// Result reports how a job ended.
+type Result struct {
+    JobID    string
+    Err      error
+    Duration time.Duration
+}
+
+// Option configures a Pool.
+type Option func(*Pool)
+
+// WithTimeout bounds each job's run time. Zero means no limit.
+func WithTimeout(d time.Duration) Option {
+    return func(p *Pool) { p.timeout = d }
+}
+
+// WithQueueSize sets how many jobs may wait for a free worker.
+func WithQueueSize(n int) Option {
+    return func(p *Pool) { p.ch = make(chan Job, n) }
+}
+
+// WithResultHandler is called after every job, from the worker goroutine.
+func WithResultHandler(fn func(Result)) Option {
+    return func(p *Pool) { p.onResult = fn }
+}
+
 // Pool executes jobs with bounded concurrency.
 type Pool struct {
-    ch chan Job
-    wg sync.WaitGroup
+    size     int
+    timeout  time.Duration
+    ch       chan Job
+    onResult func(Result)
+    wg       sync.WaitGroup
+
+    mu      sync.Mutex
+    pending map[string]bool // IDs queued or running
 }
 
-func New(size int) *Pool {
-    return &Pool{ch: make(chan Job), wg: sync.WaitGroup{}}
+// New creates a pool of size workers. The queue holds size jobs unless
+// WithQueueSize says otherwise.
+func New(size int, opts ...Option) *Pool {
+    if size < 1 {
+        size = 1
+    }
+    p := &Pool{size: size, ch: make(chan Job, size), pending: make(map[string]bool)}
+    for _, opt := range opts {
+        opt(p)
+    }
+    return p
 }
 
-func (p *Pool) Run(ctx context.Context, size int) {
-    for i := 0; i < size; i++ {
+// Run starts the workers. They stop when ctx is cancelled.
+func (p *Pool) Run(ctx context.Context) {
+    for i := 0; i < p.size; i++ {
         p.wg.Add(1)
         go func() {
             defer p.wg.Done()
@@ -31,12 +81,62 @@ func (p *Pool) Run(ctx context.Context, size int) {
                 case <-ctx.Done():
                     return
                 case job := <-p.ch:
-                    _ = job.Execute(ctx)
+                    p.execute(ctx, job)
                 }
             }
         }()
     }
 }
 
-func (p *Pool) Submit(j Job) { p.ch <- j }
-func (p *Pool) Wait()        { p.wg.Wait() }
+// execute runs one job under the pool timeout and reports its result
+func (p *Pool) execute(ctx context.Context, job Job) {
+    defer func() {
+        p.mu.Lock()
+        delete(p.pending, job.ID)
+        p.mu.Unlock()
+    }()
+
+    if p.timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, p.timeout)
+        defer cancel()
+    }
+    start := time.Now()
+    err := safeExecute(ctx, job)
+    if err == nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+        err = fmt.Errorf("job %s: %w", job.ID, ctx.Err())
+    }
+    if p.onResult != nil {
+        p.onResult(Result{JobID: job.ID, Err: err, Duration: time.Since(start)})
+    }
+}
+
+// safeExecute turns a panicking job into an error
+func safeExecute(ctx context.Context, job Job) (err error) {
+    defer func() {
+        if r := recover(); r != nil {
+            err = fmt.Errorf("job %s panicked: %v", job.ID, r)
+        }
+    }()
+    return job.Execute(ctx)
+}
+
+// Submit queues a job without blocking. It fails when the queue is full or
+// a job with the same ID has not finished yet.
+func (p *Pool) Submit(j Job) error {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    if p.pending[j.ID] {
+        return ErrDuplicate
+    }
+    select {
+    case p.ch <- j:
+        p.pending[j.ID] = true
+        return nil
+    default:
+        return ErrQueueFull
+    }
+}
+
+// Wait blocks until all workers have stopped.
+func (p *Pool) Wait() { p.wg.Wait() }
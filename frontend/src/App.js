@@ -2430,6 +2430,8 @@ function PaginatedEmailList({ title, fetcher, actions, onViewEmail, isGmailSourc
 }
 
 
+const browserTimeZone = Intl.DateTimeFormat().resolvedOptions().timeZone;
+
 function Settings() {
   const [settings, setSettings] = React.useState({ automation_enabled: false, automation_frequency: 'daily', automation_time: '09:00', automation_day_of_week: 'sunday' });
   const [quickSyncMs, setQuickSyncMs] = React.useState(() => {
@@ -2472,6 +2474,12 @@ function Settings() {
       automation_frequency: settings.automation_frequency,
       automation_time: settings.automation_time,
       automation_day_of_week: settings.automation_day_of_week,
+      timezone: settings.timezone || browserTimeZone,
+      automation_cron: settings.automation_frequency === 'custom' ? settings.automation_cron : '',
+      max_emails_per_run: Number(settings.max_emails_per_run) || 0,
+      max_mailbox_percent: Number(settings.max_mailbox_percent) || 0,
+      quarantine_enabled: !!settings.quarantine_enabled,
+      quarantine_days: Number(settings.quarantine_days) || 7,
     };
     api.saveSettings(payload).then(newSettings => {
       setSettings(newSettings);
@@ -2481,6 +2489,46 @@ function Settings() {
     });
   };
 
+  const handleRunNow = (dryRun) => {
+    setMessage('');
+    setError('');
+    api.runAutomation(dryRun).then(({ run }) => {
+      if (dryRun) {
+        const planned = (run.outcomes || []).filter(o => o.status === 'planned').length;
+        setMessage(`Preview: automation would clean ${planned} of ${run.emails_matched} matching emails`);
+      } else {
+        setMessage(`Automation run ${run.status}: ${run.emails_matched} emails matched your rules`);
+      }
+    }).catch(err => {
+      setError(err.message || 'Failed to run automation');
+    });
+  };
+
+  const handlePause = (days) => {
+    setMessage('');
+    setError('');
+    const until = new Date(Date.now() + days * 24 * 60 * 60 * 1000).toISOString();
+    api.pauseAutomation(until).then(newSettings => {
+      setSettings(newSettings);
+      setMessage(`Automation paused until ${new Date(newSettings.paused_until).toLocaleString()}`);
+    }).catch(err => {
+      setError(err.message || 'Failed to pause automation');
+    });
+  };
+
+  const handleResume = () => {
+    setMessage('');
+    setError('');
+    api.resumeAutomation().then(newSettings => {
+      setSettings(newSettings);
+      setMessage('Automation resumed');
+    }).catch(err => {
+      setError(err.message || 'Failed to resume automation');
+    });
+  };
+
+  const isPaused = settings.paused_until && new Date(settings.paused_until) > new Date();
+
   const handleSaveQuickSync = () => {
     const safe = Math.max(5000, Math.min(10 * 60 * 1000, Number(quickSyncMs) || 30000));
     localStorage.setItem('quickSyncMs', String(safe));
@@ -2600,9 +2648,23 @@ function Settings() {
                     >
                       <MenuItem value="daily">Daily</MenuItem>
                       <MenuItem value="weekly">Weekly</MenuItem>
+                      <MenuItem value="custom">Custom (cron)</MenuItem>
                     </Select>
                   </FormControl>
                 </Grid>
+                {settings.automation_frequency === 'custom' && (
+                  <Grid item xs={12}>
+                    <TextField
+                      fullWidth
+                      label="Cron Schedule"
+                      value={settings.automation_cron || ''}
+                      onChange={(e) => setSettings(s => ({ ...s, automation_cron: e.target.value }))}
+                      disabled={!settings.automation_enabled}
+                      helperText="minute hour day-of-month month day-of-week, e.g. 0 7,19 * * 1-5"
+                      InputLabelProps={{ shrink: true }}
+                    />
+                  </Grid>
+                )}
                 {settings.automation_frequency === 'weekly' && (
                   <Grid item xs={12}>
                     <FormControl fullWidth>
@@ -2647,6 +2709,64 @@ function Settings() {
                     InputLabelProps={{ shrink: true }}
                   />
                 </Grid>
+                <Grid item xs={12}>
+                  <TextField
+                    fullWidth
+                    label="Time Zone"
+                    value={settings.timezone || browserTimeZone}
+                    onChange={(e) => setSettings(s => ({ ...s, timezone: e.target.value }))}
+                    disabled={!settings.automation_enabled}
+                    helperText="IANA name, e.g. Europe/London"
+                    InputLabelProps={{ shrink: true }}
+                  />
+                </Grid>
+                <Grid item xs={12} sm={6}>
+                  <TextField
+                    fullWidth
+                    label="Max Emails per Run"
+                    type="number"
+                    value={settings.max_emails_per_run ?? 500}
+                    onChange={(e) => setSettings(s => ({ ...s, max_emails_per_run: e.target.value }))}
+                    disabled={!settings.automation_enabled}
+                    helperText="0 for no limit"
+                    InputLabelProps={{ shrink: true }}
+                  />
+                </Grid>
+                <Grid item xs={12} sm={6}>
+                  <TextField
+                    fullWidth
+                    label="Max % of Mailbox per Run"
+                    type="number"
+                    value={settings.max_mailbox_percent ?? 25}
+                    onChange={(e) => setSettings(s => ({ ...s, max_mailbox_percent: e.target.value }))}
+                    disabled={!settings.automation_enabled}
+                    helperText="0 for no limit"
+                    InputLabelProps={{ shrink: true }}
+                  />
+                </Grid>
+                <Grid item xs={12} sm={6}>
+                  <FormControlLabel
+                    control={
+                      <Switch
+                        checked={!!settings.quarantine_enabled}
+                        onChange={(e) => setSettings(s => ({ ...s, quarantine_enabled: e.target.checked }))}
+                        disabled={!settings.automation_enabled}
+                      />
+                    }
+                    label="Quarantine deletes before trashing"
+                  />
+                </Grid>
+                <Grid item xs={12} sm={6}>
+                  <TextField
+                    fullWidth
+                    label="Quarantine Days"
+                    type="number"
+                    value={settings.quarantine_days ?? 7}
+                    onChange={(e) => setSettings(s => ({ ...s, quarantine_days: e.target.value }))}
+                    disabled={!settings.automation_enabled || !settings.quarantine_enabled}
+                    InputLabelProps={{ shrink: true }}
+                  />
+                </Grid>
               </Grid>
             </CardContent>
             <CardActions sx={{ justifyContent: 'center', p: 3 }}>
@@ -2664,6 +2784,24 @@ function Settings() {
                 Save Settings
               </Button>
             </CardActions>
+            <CardContent sx={{ pt: 0, pb: 3, display: 'flex', flexDirection: 'column', alignItems: 'center', gap: 2 }}>
+              {isPaused && (
+                <Typography variant="body2" color="warning.main">
+                  Paused until {new Date(settings.paused_until).toLocaleString()}
+                </Typography>
+              )}
+              <Box sx={{ display: 'flex', gap: 1, flexWrap: 'wrap', justifyContent: 'center' }}>
+                <Button variant="outlined" onClick={() => handleRunNow(true)}>Preview Run</Button>
+                <Button variant="outlined" onClick={() => handleRunNow(false)}>Run Now</Button>
+                {isPaused ? (
+                  <Button variant="outlined" color="warning" onClick={handleResume}>Resume</Button>
+                ) : (
+                  <Button variant="outlined" color="warning" onClick={() => handlePause(1)} disabled={!settings.automation_enabled}>
+                    Skip Next Day
+                  </Button>
+                )}
+              </Box>
+            </CardContent>
           </Card>
         </Grid>
 
@@ -2847,6 +2985,51 @@ function Settings() {
   );
 }
 
+// Switches between the Gmail mailboxes linked to the account
+function MailboxSelector() {
+  const [mailboxes, setMailboxes] = React.useState([]);
+  const [current, setCurrent] = React.useState(api.getMailbox() || '');
+
+  React.useEffect(() => {
+    api.fetchMailboxes().then(data => {
+      const list = data.mailboxes || [];
+      setMailboxes(list);
+      // Forget a selection that is no longer linked
+      if (!list.some(m => m.id === api.getMailbox())) {
+        api.setMailbox(null);
+        setCurrent(list.length > 0 ? list[0].id : '');
+      }
+    }).catch(err => console.error('Failed to load mailboxes:', err));
+  }, []);
+
+  const handleChange = (e) => {
+    if (e.target.value === 'link') {
+      window.location.href = api.linkMailboxUrl;
+      return;
+    }
+    api.setMailbox(e.target.value);
+    setCurrent(e.target.value);
+    window.location.reload(); // every view reloads its data for the new mailbox
+  };
+
+  if (mailboxes.length === 0) {
+    return null;
+  }
+  return (
+    <Select
+      size="small"
+      value={current}
+      onChange={handleChange}
+      sx={{ color: 'inherit', minWidth: 200, '.MuiOutlinedInput-notchedOutline': { borderColor: 'rgba(255,255,255,0.3)' } }}
+    >
+      {mailboxes.map(m => (
+        <MenuItem key={m.id} value={m.id}>{m.email}</MenuItem>
+      ))}
+      <MenuItem value="link">+ Link another mailbox</MenuItem>
+    </Select>
+  );
+}
+
 function Navbar({ tab, setTab, onLogout, theme, setTheme, onInboxClick }) {
   const tabs = [
     { id: 'dashboard', label: 'Dashboard', icon: <DashboardIcon /> },
@@ -2896,6 +3079,7 @@ function Navbar({ tab, setTab, onLogout, theme, setTheme, onInboxClick }) {
           </Box>
 
           <Box sx={{ display: 'flex', alignItems: 'center', gap: 1 }}>
+            <MailboxSelector />
             <IconButton 
               color="inherit" 
               onClick={() => setTheme(theme === 'light' ? 'dark' : 'light')}
@@ -5,6 +5,17 @@
 
 const API_BASE = process.env.REACT_APP_API_BASE || 'http://localhost:8080';
 
+// The linked mailbox requests act on; none means the one the account signed up with
+const MAILBOX_KEY = 'mailboxId';
+export const getMailbox = () => localStorage.getItem(MAILBOX_KEY);
+export const setMailbox = (mailboxId) => {
+  if (mailboxId) {
+    localStorage.setItem(MAILBOX_KEY, mailboxId);
+  } else {
+    localStorage.removeItem(MAILBOX_KEY);
+  }
+};
+
 /**
  * Enhanced request wrapper with better error handling and longer timeout for sync operations
  * @param {string} endpoint - API endpoint path
@@ -24,6 +35,7 @@ async function request(endpoint, options = {}) {
       credentials: 'include',
       headers: {
         'Content-Type': 'application/json',
+        ...(getMailbox() ? { 'X-Mailbox-ID': getMailbox() } : {}),
         ...options.headers,
       },
     });
@@ -133,17 +145,57 @@ async function del(endpoint) {
   return request(endpoint, { method: 'DELETE' });
 }
 
+/**
+ * Queues a background job and polls it until it finishes
+ * @param {string} endpoint - API endpoint that responds with a job_id
+ * @param {any} data - Request body data
+ * @returns {Promise<any>} - The finished job's result
+ */
+async function runJob(endpoint, data = null) {
+  const { job_id: jobId } = await post(endpoint, data);
+  for (;;) {
+    await new Promise((resolve) => setTimeout(resolve, 1000));
+    const { job } = await get(`/jobs/${jobId}`);
+    if (job.status === 'succeeded') return job.result || {};
+    if (job.status === 'failed') throw new Error(job.last_error || 'Job failed');
+    if (job.status === 'cancelled') throw new Error('Job was cancelled');
+  }
+}
+
 // =============================================================================
 // AUTH ENDPOINTS
 // =============================================================================
 
 export const loginUrl = `${API_BASE}/auth/google/login`;
 
+/** Google sign-in that adds another mailbox to the signed-in account */
+export const linkMailboxUrl = `${API_BASE}/auth/google/login?link=true`;
+
+/**
+ * List the account's linked mailboxes. Sent without a selection so a
+ * mailbox that was unlinked elsewhere can't make it fail.
+ * @returns {Promise<{mailboxes: any[], current: string}>}
+ */
+export const fetchMailboxes = () => request('/mailboxes', { headers: { 'X-Mailbox-ID': '' } });
+
 /**
  * Logout the current user
  * @returns {Promise<any>}
  */
-export const logout = () => post('/logout');
+export const logout = () => post('/logout').finally(() => setMailbox(null));
+
+/**
+ * List the user's signed-in sessions; `current` is this browser's
+ * @returns {Promise<{sessions: any[], current: string}>}
+ */
+export const fetchSessions = () => get('/sessions');
+
+/**
+ * Sign out one session, e.g. on a lost device
+ * @param {string} sessionId
+ * @returns {Promise<any>}
+ */
+export const revokeSession = (sessionId) => del(`/sessions/${sessionId}`);
 
 /**
  * Check if user is authenticated
@@ -158,7 +210,7 @@ export const healthz = () => get('/healthz');
 export const fetchEmails = () => get('/emails');
 export const fetchEmailsPaginated = (page = 1, pageSize = 10, filter = '') => 
   get('/emails/paginated', { page: String(page), pageSize: String(pageSize), filter });
-export const syncEmails = () => post('/emails/sync');
+export const syncEmails = () => runJob('/emails/sync');
 export const syncHistory = () => post('/emails/sync-history');
 export const getSyncProgress = () => get('/emails/sync/progress');
 export const fetchEmailDetails = (id) => get(`/emails/${id}`);
@@ -175,10 +227,10 @@ export const deleteEmailPermanently = (id) => del(`/emails/trash/${id}`);
 export const unarchiveEmail = (id) => post(`/emails/${id}/unarchive`);
 
 // Bulk action endpoints
-export const bulkMarkRead = (emailIds) => post('/emails/bulk/read', { emailIds });
-export const bulkMarkUnread = (emailIds) => post('/emails/bulk/unread', { emailIds });
-export const bulkDelete = (emailIds) => post('/emails/bulk/delete', { emailIds });
-export const bulkArchive = (emailIds) => post('/emails/bulk/archive', { emailIds });
+export const bulkMarkRead = (emailIds) => runJob('/emails/bulk/read', { emailIds });
+export const bulkMarkUnread = (emailIds) => runJob('/emails/bulk/unread', { emailIds });
+export const bulkDelete = (emailIds) => runJob('/emails/bulk/delete', { emailIds });
+export const bulkArchive = (emailIds) => runJob('/emails/bulk/archive', { emailIds });
 
 // =============================================================================
 // RULES ENDPOINTS
@@ -193,9 +245,17 @@ export const updateRule = (id, rule) => put(`/rules/${id}`, rule);
 // CLEANING ENDPOINTS
 // =============================================================================
 
-export const triggerClean = (data = null) => post('/clean', data);
+export const triggerClean = (data = null) => runJob('/clean', data);
 export const previewClean = () => post('/clean/preview');
 export const fetchCleanHistory = () => get('/clean/history');
+export const undoClean = (historyId) => runJob(`/clean/history/${historyId}/undo`);
+
+// =============================================================================
+// JOB ENDPOINTS
+// =============================================================================
+
+export const fetchJob = (id) => get(`/jobs/${id}`);
+export const cancelJob = (id) => post(`/jobs/${id}/cancel`);
 
 // =============================================================================
 // BLOCK & UNSUBSCRIBE ENDPOINTS
@@ -229,6 +289,11 @@ export const fetchStats = () => get('/stats');
 
 export const fetchSettings = () => get('/settings');
 export const saveSettings = (settings) => post('/settings', settings);
+export const runAutomation = (dryRun = false) => runJob(`/automation/run${dryRun ? '?dry_run=true' : ''}`);
+export const pauseAutomation = (until) => post(`/automation/pause?until=${encodeURIComponent(until)}`);
+export const resumeAutomation = () => post('/automation/resume');
+export const fetchQuarantine = () => get('/quarantine');
+export const releaseQuarantine = (emailId) => post(`/quarantine/${emailId}/release`);
 
 // =============================================================================
 // DEBUG/ADMIN ENDPOINTS